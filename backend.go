@@ -0,0 +1,122 @@
+package s3backup
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/dnnrly/s3backup/local"
+	"github.com/dnnrly/s3backup/memory"
+	"github.com/dnnrly/s3backup/s3"
+)
+
+const (
+	// BackendS3 stores files in an S3 bucket, as in s3://bucket/prefix
+	BackendS3 = "s3"
+	// BackendFile stores files in a local directory, as in file:///mnt/backup
+	BackendFile = "file"
+	// BackendMemory stores files in memory until the program exits, as in
+	// mem://name
+	BackendMemory = "mem"
+)
+
+var (
+	memoryLock   sync.Mutex
+	memoryStores = map[string]*memory.Store{}
+)
+
+// parseBackend splits a backend URL in to its scheme and the location that it
+// refers to
+func parseBackend(backend string) (*url.URL, error) {
+	u, err := url.Parse(backend)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend %s: %w", backend, err)
+	}
+
+	switch u.Scheme {
+	case BackendS3:
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid backend %s: no bucket", backend)
+		}
+	case BackendFile:
+		if filePath(u) == "" {
+			return nil, fmt.Errorf("invalid backend %s: no directory", backend)
+		}
+	case BackendMemory:
+	default:
+		return nil, fmt.Errorf("unknown backend %s", backend)
+	}
+
+	return u, nil
+}
+
+// ValidateBackend checks that a backend URL is one that can be opened
+func ValidateBackend(backend string) error {
+	if backend == "" {
+		return nil
+	}
+
+	_, err := parseBackend(backend)
+	return err
+}
+
+// OpenBackend creates the store that a backend URL refers to. The S3 config
+// holds the credentials and region for the S3 backend, and is used on its own
+// when there is no URL. An s3 URL replaces the bucket and prefix in the
+// config, so configs that set both are rejected when they are read. Memory
+// stores with the same name are shared.
+func OpenBackend(backend string, config s3.Config) (ObjectStore, error) {
+	if backend == "" {
+		return newS3Store(config)
+	}
+
+	u, err := parseBackend(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case BackendFile:
+		store, err := local.NewStore(filePath(u))
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case BackendMemory:
+		memoryLock.Lock()
+		defer memoryLock.Unlock()
+
+		store, found := memoryStores[u.Host+u.Path]
+		if !found {
+			store = memory.NewStore()
+			memoryStores[u.Host+u.Path] = store
+		}
+		return store, nil
+	}
+
+	config.Bucket = u.Host
+	config.Prefix = strings.Trim(u.Path, "/")
+	return newS3Store(config)
+}
+
+func newS3Store(config s3.Config) (ObjectStore, error) {
+	store, err := s3.NewStore(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// filePath finds the directory that a file URL refers to, which may be
+// relative if the URL has a host
+func filePath(u *url.URL) string {
+	p := u.Path
+	if u.Host != "" && u.Host != "localhost" {
+		p = u.Host + p
+	}
+
+	return filepath.FromSlash(p)
+}
@@ -0,0 +1,460 @@
+package s3backup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dnnrly/s3backup/local"
+	"github.com/dnnrly/s3backup/memory"
+	"github.com/dnnrly/s3backup/s3"
+	"github.com/dnnrly/s3backup/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateBackend(t *testing.T) {
+	assert.NoError(t, ValidateBackend(""))
+	assert.NoError(t, ValidateBackend("s3://bucket/prefix"))
+	assert.NoError(t, ValidateBackend("file:///mnt/backup"))
+	assert.NoError(t, ValidateBackend("mem://test"))
+
+	assert.Error(t, ValidateBackend("s3:///prefix"))
+	assert.Error(t, ValidateBackend("file://"))
+	assert.Error(t, ValidateBackend("ftp://server/backup"))
+	assert.Error(t, ValidateBackend("://bad"))
+}
+
+func TestOpenBackend_S3(t *testing.T) {
+	store, err := OpenBackend("s3://bucket/prefix", s3.Config{Region: "eu-west-1"})
+
+	assert.NoError(t, err)
+	assert.IsType(t, &s3.Store{}, store)
+}
+
+func TestS3Store_HeadMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodHead, r.Method)
+		assert.Equal(t, "/bucket/prefix/a.jpg", r.URL.Path)
+		w.Header().Set("Content-Length", "6")
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("Last-Modified", "Sun, 18 Oct 2026 10:00:00 GMT")
+		w.Header().Set("X-Amz-Meta-Owner", "me")
+	}))
+	defer server.Close()
+
+	store, err := s3.NewStore(s3.Config{Endpoint: server.URL, Bucket: "bucket", Prefix: "prefix", Region: "eu-west-1", ID: "id", Key: "key"})
+	require.NoError(t, err)
+
+	info, err := store.Head("a.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, "a.jpg", info.Key)
+	assert.Equal(t, int64(6), info.Size)
+	assert.Equal(t, "abc", info.ETag)
+	assert.Equal(t, map[string]string{"Owner": "me"}, info.Metadata)
+}
+
+func TestOpenBackend_Memory(t *testing.T) {
+	store, err := OpenBackend("mem://backend-test", s3.Config{})
+	require.NoError(t, err)
+	assert.IsType(t, &memory.Store{}, store)
+
+	require.NoError(t, store.Save("a/b", bytes.NewBufferString("data")))
+
+	same, err := OpenBackend("mem://backend-test", s3.Config{})
+	require.NoError(t, err)
+	r, err := same.GetByKey("a/b")
+	require.NoError(t, err)
+	data, _ := ioutil.ReadAll(r)
+	assert.Equal(t, "data", string(data))
+
+	other, err := OpenBackend("mem://other-backend-test", s3.Config{})
+	require.NoError(t, err)
+	_, err = other.GetByKey("a/b")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+func TestOpenBackend_File(t *testing.T) {
+	root, err := ioutil.TempDir("", "s3backup-backend")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	store, err := OpenBackend("file://"+filepath.ToSlash(filepath.Join(root, "backup")), s3.Config{})
+	require.NoError(t, err)
+	assert.IsType(t, &local.Store{}, store)
+
+	require.NoError(t, store.Save("photos/a.jpg", bytes.NewBufferString("jpg")))
+	data, err := ioutil.ReadFile(filepath.Join(root, "backup", "photos", "a.jpg"))
+	require.NoError(t, err)
+	assert.Equal(t, "jpg", string(data))
+
+	r, err := store.GetByKey("photos/a.jpg")
+	require.NoError(t, err)
+	data, _ = ioutil.ReadAll(r)
+	assert.Equal(t, "jpg", string(data))
+
+	require.NoError(t, store.Save("../../outside", bytes.NewBufferString("x")))
+	_, err = os.Stat(filepath.Join(root, "backup", "outside"))
+	assert.NoError(t, err, "keys can't escape the store directory")
+
+	require.NoError(t, store.Delete("photos/a.jpg"))
+	require.NoError(t, store.Delete("photos/a.jpg"))
+	_, err = store.GetByKey("photos/a.jpg")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	files, err := ioutil.ReadDir(filepath.Join(root, "backup", "photos"))
+	require.NoError(t, err)
+	assert.Empty(t, files, "no temporary files are left behind")
+}
+
+func TestOpenBackend_RoundTrip(t *testing.T) {
+	root := createTestTree(t, map[string]string{
+		"a":     "file a",
+		"dir/b": "file b",
+	})
+	defer os.RemoveAll(root)
+
+	store, err := OpenBackend("mem://round-trip-test", s3.Config{})
+	require.NoError(t, err)
+
+	s := &Scanner{Walker: FilePathWalker, Hasher: FileHasher, Workers: 2}
+	local, err := s.Scan("", root)
+	require.NoError(t, err)
+
+	u := &Uploader{
+		Store: store,
+		GetFile: func(p string) (io.ReadCloser, error) {
+			return os.Open(p)
+		},
+		ParallelLimit: 2,
+		BatchSize:     2,
+	}
+	updated, err := u.Upload(local, &Index{Files: map[string]Sourcefile{}})
+	require.NoError(t, err)
+
+	target, err := ioutil.TempDir("", "s3backup-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(target)
+
+	require.NoError(t, RestoreFiles(updated, store, target, 2))
+	data, err := ioutil.ReadFile(filepath.Join(target, "dir", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, "file b", string(data))
+}
+
+func testRepository(t *testing.T, store ObjectStore) {
+	for _, k := range []string{"photos/2020/a.jpg", "photos/2020/b.jpg", "photos/2021/c.jpg", "photos-old/d.jpg", "docs/e.txt"} {
+		require.NoError(t, store.Save(k, bytes.NewBufferString("contents of "+k)))
+	}
+
+	listed := []string{}
+	err := store.List("photos/", func(o ObjectInfo) error {
+		listed = append(listed, o.Key)
+		assert.Equal(t, int64(len("contents of "+o.Key)), o.Size)
+		assert.NotEmpty(t, o.ETag)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"photos/2020/a.jpg", "photos/2020/b.jpg", "photos/2021/c.jpg"}, listed)
+
+	listed = []string{}
+	err = store.List("photos", func(o ObjectInfo) error {
+		listed = append(listed, o.Key)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 4, len(listed))
+
+	stop := errors.New("stop")
+	count := 0
+	err = store.List("", func(o ObjectInfo) error {
+		count++
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 1, count)
+
+	err = store.List("nothing/here/", func(o ObjectInfo) error {
+		t.Errorf("unexpected object %s", o.Key)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	info, err := store.Head("docs/e.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "docs/e.txt", info.Key)
+	assert.Equal(t, int64(len("contents of docs/e.txt")), info.Size)
+	assert.False(t, info.LastModified.IsZero())
+	assert.NotNil(t, info.Metadata)
+
+	_, err = store.Head("docs/missing.txt")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	require.NoError(t, store.Copy("docs/e.txt", "archive/e.txt"))
+	r, err := store.GetByKey("archive/e.txt")
+	require.NoError(t, err)
+	data, _ := ioutil.ReadAll(r)
+	assert.Equal(t, "contents of docs/e.txt", string(data))
+
+	for _, tc := range []struct {
+		offset, length int64
+		expected       string
+	}{
+		{0, 8, "contents"},
+		{12, 4, "docs"},
+		{12, -1, "docs/e.txt"},
+		{17, 100, "e.txt"},
+		{100, 5, ""},
+	} {
+		r, err := store.GetRange("docs/e.txt", tc.offset, tc.length)
+		require.NoError(t, err)
+		data, _ := ioutil.ReadAll(r)
+		assert.NoError(t, r.Close())
+		assert.Equal(t, tc.expected, string(data), "%d-%d", tc.offset, tc.length)
+	}
+
+	_, err = store.GetRange("docs/missing.txt", 0, 1)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	_, err = store.GetRange("docs/e.txt", -1, 4)
+	assert.Error(t, err)
+
+	err = store.Copy("docs/missing.txt", "archive/missing.txt")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	etag, err := store.SaveIfMatch("index", bytes.NewBufferString("1"), "")
+	require.NoError(t, err)
+	_, err = store.SaveIfMatch("index", bytes.NewBufferString("2"), "")
+	assert.True(t, errors.Is(err, ErrConflict), "must not exist")
+	_, err = store.SaveIfMatch("index", bytes.NewBufferString("22"), "stale")
+	assert.True(t, errors.Is(err, ErrConflict), "stale ETag")
+	next, err := store.SaveIfMatch("index", bytes.NewBufferString("333"), etag)
+	require.NoError(t, err)
+	assert.NotEqual(t, etag, next)
+	info, err = store.Head("index")
+	require.NoError(t, err)
+	assert.Equal(t, next, info.ETag)
+	assert.Equal(t, int64(3), info.Size)
+
+	require.NoError(t, store.Delete("photos/2020/a.jpg", "photos/2020/b.jpg", "not/there"))
+	_, err = store.Head("photos/2020/a.jpg")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	_, err = store.Head("photos/2021/c.jpg")
+	assert.NoError(t, err)
+}
+
+func TestMemoryStore_Repository(t *testing.T) {
+	testRepository(t, memory.NewStore())
+}
+
+func TestLocalStore_Repository(t *testing.T) {
+	root, err := ioutil.TempDir("", "s3backup-backend")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	store, err := local.NewStore(root)
+	require.NoError(t, err)
+
+	testRepository(t, store)
+}
+
+func TestMemoryStore_ETagChanges(t *testing.T) {
+	store := memory.NewStore()
+	require.NoError(t, store.Save("a", bytes.NewBufferString("1")))
+	before, err := store.Head("a")
+	require.NoError(t, err)
+
+	require.NoError(t, store.Save("a", bytes.NewBufferString("2")))
+	after, err := store.Head("a")
+	require.NoError(t, err)
+
+	assert.NotEqual(t, before.ETag, after.ETag)
+}
+
+func TestLocalStore_ETagChanges(t *testing.T) {
+	root, err := ioutil.TempDir("", "s3backup-backend")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	store, err := local.NewStore(root)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Save("a", bytes.NewBufferString("1")))
+	before, err := store.Head("a")
+	require.NoError(t, err)
+
+	require.NoError(t, store.Save("a", bytes.NewBufferString("2")))
+	modified := before.LastModified
+	require.NoError(t, os.Chtimes(filepath.Join(root, "a"), modified, modified))
+	after, err := store.Head("a")
+	require.NoError(t, err)
+
+	assert.Equal(t, before.Size, after.Size)
+	assert.Equal(t, before.LastModified, after.LastModified)
+	assert.NotEqual(t, before.ETag, after.ETag, "same size and time but different contents")
+}
+
+func TestLocalStore_SaveIfMatchAcrossStores(t *testing.T) {
+	root, err := ioutil.TempDir("", "s3backup-backend")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	// each store stands in for a separate process using the same directory
+	increment := func(store *local.Store) error {
+		for {
+			info, err := store.Head("counter")
+			if err != nil {
+				return err
+			}
+			r, err := store.GetByKey("counter")
+			if err != nil {
+				return err
+			}
+			data, err := ioutil.ReadAll(r)
+			_ = r.Close()
+			if err != nil {
+				return err
+			}
+
+			n := 0
+			_, _ = fmt.Sscanf(string(data), "%d", &n)
+			_, err = store.SaveIfMatch("counter", strings.NewReader(fmt.Sprintf("%d", n+1)), info.ETag)
+			if !errors.Is(err, ErrConflict) {
+				return err
+			}
+		}
+	}
+
+	first, err := local.NewStore(root)
+	require.NoError(t, err)
+	require.NoError(t, first.Save("counter", strings.NewReader("0")))
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		store, err := local.NewStore(root)
+		require.NoError(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				assert.NoError(t, increment(store))
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, "40", readKey(t, first, "counter"))
+	keys := []string{}
+	require.NoError(t, first.List("", func(o ObjectInfo) error {
+		keys = append(keys, o.Key)
+		return nil
+	}))
+	assert.Equal(t, []string{"counter"}, keys, "lock files aren't listed")
+}
+
+func TestParallelReader(t *testing.T) {
+	data := randomData(1, 1000)
+	lock := sync.Mutex{}
+	fetched := []int64{}
+	fetch := func(offset, length int64) ([]byte, error) {
+		lock.Lock()
+		fetched = append(fetched, offset)
+		lock.Unlock()
+		return data[offset : offset+length], nil
+	}
+
+	r := storage.NewParallelReader(data[:100], int64(len(data)), 64, 3, fetch)
+	got, err := ioutil.ReadAll(r)
+
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, data, got)
+	assert.Equal(t, 15, len(fetched))
+}
+
+func TestParallelReader_FetchError(t *testing.T) {
+	data := randomData(1, 1000)
+	fetch := func(offset, length int64) ([]byte, error) {
+		if offset >= 500 {
+			return nil, errors.New("connection reset")
+		}
+		return data[offset : offset+length], nil
+	}
+
+	r := storage.NewParallelReader(nil, int64(len(data)), 100, 2, fetch)
+	got, err := ioutil.ReadAll(r)
+
+	assert.EqualError(t, err, "connection reset")
+	assert.Equal(t, data[:500], got)
+}
+
+func TestParallelReader_Close(t *testing.T) {
+	lock := sync.Mutex{}
+	count := 0
+	fetch := func(offset, length int64) ([]byte, error) {
+		lock.Lock()
+		count++
+		lock.Unlock()
+		return make([]byte, length), nil
+	}
+
+	r := storage.NewParallelReader(nil, 1000000, 10, 2, fetch)
+	_, err := r.Read(make([]byte, 5))
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	time.Sleep(10 * time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.True(t, count < 10, "fetched %d parts after closing", count)
+}
+
+func TestParallelReader_Concurrency(t *testing.T) {
+	data := randomData(1, 1000)
+	lock := sync.Mutex{}
+	running, most := 0, 0
+	fetch := func(offset, length int64) ([]byte, error) {
+		lock.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		lock.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		lock.Lock()
+		running--
+		lock.Unlock()
+		return data[offset : offset+length], nil
+	}
+
+	r := storage.NewParallelReader(nil, int64(len(data)), 50, 3, fetch)
+	got := []byte{}
+	buf := make([]byte, 10)
+	for {
+		n, err := r.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		time.Sleep(time.Millisecond)
+	}
+
+	assert.Equal(t, data, got)
+	lock.Lock()
+	defer lock.Unlock()
+	assert.True(t, most <= 3, "fetched %d parts at once", most)
+	assert.True(t, most > 1, "parts weren't fetched at the same time")
+}
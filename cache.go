@@ -0,0 +1,152 @@
+package s3backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CacheEntry holds what was known about a file the last time that it was hashed
+type CacheEntry struct {
+	// Key is the location of this file in a bucket
+	Key string `yaml:"key"`
+	// Hash is the hashed value of the file contents
+	Hash string `yaml:"hash"`
+	// Size is the size of the file contents in bytes
+	Size int64 `yaml:"size"`
+	// ModTime is when the file was last modified
+	ModTime time.Time `yaml:"mod_time"`
+	// Inode identifies the file on disk, where the filesystem supports it
+	Inode uint64 `yaml:"inode,omitempty"`
+}
+
+// Cache remembers the hashes of local files so that files which haven't
+// changed since the last scan don't need to be read again. A file is thought
+// to be unchanged if its size, modification time and inode are the same.
+type Cache struct {
+	// Files maps the location of each file relative to the directory that
+	// was scanned to what was known about it
+	Files map[string]CacheEntry `yaml:"files"`
+
+	lock sync.Mutex
+}
+
+// NewCache creates a Cache from Yaml
+func NewCache(buf string) (*Cache, error) {
+	cache := &Cache{}
+	err := yaml.Unmarshal([]byte(buf), cache)
+	if err != nil {
+		return nil, err
+	}
+
+	if cache.Files == nil {
+		cache.Files = map[string]CacheEntry{}
+	}
+
+	return cache, nil
+}
+
+// NewCacheFromFile reads a Cache from a file, returning an empty Cache if the
+// file doesn't exist yet
+func NewCacheFromFile(p string) (*Cache, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(p))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return NewCache("")
+		}
+		return nil, fmt.Errorf("unable to read cache: %w", err)
+	}
+
+	cache, err := NewCache(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read cache %s: %w", p, err)
+	}
+
+	return cache, nil
+}
+
+// Encode the cache data as Yaml
+func (c *Cache) Encode() (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	out, err := yaml.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	return string(out), nil
+}
+
+// SaveFile writes the cache to a file
+func (c *Cache) SaveFile(p string) error {
+	data, err := c.Encode()
+	if err != nil {
+		return fmt.Errorf("unable to create cache: %w", err)
+	}
+
+	tmp := p + ".tmp"
+	err = ioutil.WriteFile(tmp, []byte(data), 0644)
+	if err != nil {
+		return fmt.Errorf("unable to write cache: %w", err)
+	}
+
+	err = os.Rename(tmp, p)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("unable to write cache: %w", err)
+	}
+
+	return nil
+}
+
+// Lookup finds the hash of the file at 'p' if it hasn't changed since it was
+// put in the cache
+func (c *Cache) Lookup(p string, info os.FileInfo) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, found := c.Files[p]
+	if !found || entry.Hash == "" {
+		return "", false
+	}
+
+	if entry.Size != info.Size() ||
+		!entry.ModTime.Equal(info.ModTime()) ||
+		entry.Inode != fileInode(info) {
+		return "", false
+	}
+
+	return entry.Hash, true
+}
+
+// Update records the hash of the file at 'p'
+func (c *Cache) Update(p string, src Sourcefile, info os.FileInfo) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.Files[p] = CacheEntry{
+		Key:     src.Key,
+		Hash:    src.Hash,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Inode:   fileInode(info),
+	}
+}
+
+// Prune removes every file from the cache that isn't in the index
+func (c *Cache) Prune(index *Index) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for p := range c.Files {
+		if _, found := index.Files[p]; !found {
+			delete(c.Files, p)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package s3backup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache_EncodeDecode(t *testing.T) {
+	modTime := time.Date(2020, 6, 1, 12, 30, 15, 123456789, time.UTC)
+	cache, err := NewCache("")
+	require.NoError(t, err)
+	cache.Files["a"] = CacheEntry{Key: "a", Hash: "hash", Size: 10, ModTime: modTime, Inode: 42}
+
+	data, err := cache.Encode()
+	require.NoError(t, err)
+
+	decoded, err := NewCache(data)
+	require.NoError(t, err)
+
+	entry := decoded.Files["a"]
+	assert.Equal(t, "a", entry.Key)
+	assert.Equal(t, "hash", entry.Hash)
+	assert.Equal(t, int64(10), entry.Size)
+	assert.True(t, modTime.Equal(entry.ModTime))
+	assert.Equal(t, uint64(42), entry.Inode)
+}
+
+func TestNewCache_Invalid(t *testing.T) {
+	_, err := NewCache("files: [")
+	assert.Error(t, err)
+}
+
+func TestNewCacheFromFile_Missing(t *testing.T) {
+	cache, err := NewCacheFromFile("does-not-exist.yaml")
+
+	assert.NoError(t, err)
+	assert.Empty(t, cache.Files)
+}
+
+func TestCache_Lookup(t *testing.T) {
+	root := createTestTree(t, map[string]string{"a": "file a"})
+	defer os.RemoveAll(root)
+	p := filepath.Join(root, "a")
+
+	info, err := os.Stat(p)
+	require.NoError(t, err)
+
+	cache, _ := NewCache("")
+	_, found := cache.Lookup(p, info)
+	assert.False(t, found)
+
+	cache.Update(p, Sourcefile{Key: "a", Hash: "hash"}, info)
+	hash, found := cache.Lookup(p, info)
+	assert.True(t, found)
+	assert.Equal(t, "hash", hash)
+
+	require.NoError(t, os.Chtimes(p, time.Now(), info.ModTime().Add(time.Second)))
+	info, err = os.Stat(p)
+	require.NoError(t, err)
+	_, found = cache.Lookup(p, info)
+	assert.False(t, found, "modification time changed")
+
+	cache.Update(p, Sourcefile{Key: "a", Hash: "hash"}, info)
+	require.NoError(t, ioutil.WriteFile(p, []byte("longer file a"), 0644))
+	require.NoError(t, os.Chtimes(p, time.Now(), info.ModTime()))
+	info, err = os.Stat(p)
+	require.NoError(t, err)
+	_, found = cache.Lookup(p, info)
+	assert.False(t, found, "size changed")
+}
+
+func TestCache_SaveFile(t *testing.T) {
+	root := createTestTree(t, map[string]string{})
+	defer os.RemoveAll(root)
+	p := filepath.Join(root, ".s3backup.yaml")
+
+	cache, _ := NewCache("")
+	cache.Files["a"] = CacheEntry{Key: "a", Hash: "hash"}
+	require.NoError(t, cache.SaveFile(p))
+
+	loaded, err := NewCacheFromFile(p)
+	require.NoError(t, err)
+	assert.Equal(t, "hash", loaded.Files["a"].Hash)
+}
+
+func TestCache_Prune(t *testing.T) {
+	cache, _ := NewCache("")
+	cache.Files["a"] = CacheEntry{Key: "a"}
+	cache.Files["b"] = CacheEntry{Key: "b"}
+
+	cache.Prune(&Index{Files: map[string]Sourcefile{"a": Sourcefile{Key: "a"}}})
+
+	assert.Contains(t, cache.Files, "a")
+	assert.NotContains(t, cache.Files, "b")
+}
@@ -0,0 +1,316 @@
+package s3backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"sync"
+)
+
+const (
+	// DefaultChunkMinFileSize is the smallest file that is chunked when no
+	// size has been configured
+	DefaultChunkMinFileSize = 16 * 1024 * 1024
+	// DefaultChunkAverageSize is the average chunk size when no size has been
+	// configured
+	DefaultChunkAverageSize = 1024 * 1024
+
+	chunkPrefix = "chunks"
+)
+
+// ChunkConfig controls how large files are split in to chunks. The boundaries
+// between chunks are found from the file contents using a rolling hash so that
+// a small change to a file only changes the chunks around it.
+type ChunkConfig struct {
+	// Enabled turns chunking on
+	Enabled bool `yaml:"enabled"`
+	// MinFileSize is the size in bytes of the smallest file that is chunked
+	MinFileSize int64 `yaml:"min_file_size"`
+	// AverageSize is the size in bytes that chunks will be on average, it is
+	// rounded up to a power of 2
+	AverageSize int `yaml:"average_size"`
+}
+
+// gearTable holds the random values used by the rolling hash. They are made
+// from hashes so that chunk boundaries never change between versions.
+var gearTable = func() [256]uint64 {
+	t := [256]uint64{}
+	for i := range t {
+		sum := sha256.Sum256([]byte{byte(i)})
+		t[i] = binary.LittleEndian.Uint64(sum[:8])
+	}
+	return t
+}()
+
+// chunker splits a stream of data in to content defined chunks
+type chunker struct {
+	r    *bufio.Reader
+	min  int
+	max  int
+	mask uint64
+	buf  []byte
+}
+
+func newChunker(r io.Reader, config ChunkConfig) *chunker {
+	avg := config.AverageSize
+	if avg <= 0 {
+		avg = DefaultChunkAverageSize
+	}
+	shift := uint(bits.Len(uint(avg - 1)))
+
+	return &chunker{
+		r:    bufio.NewReader(r),
+		min:  (1 << shift) / 4,
+		max:  (1 << shift) * 8,
+		mask: 1<<shift - 1,
+	}
+}
+
+// Next reads the next chunk of data, returning io.EOF when there is nothing left.
+// The chunk is only valid until the next call to Next.
+func (c *chunker) Next() ([]byte, error) {
+	c.buf = c.buf[:0]
+	hash := uint64(0)
+
+	for {
+		b, err := c.r.ReadByte()
+		if err == io.EOF && len(c.buf) > 0 {
+			return c.buf, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		c.buf = append(c.buf, b)
+		hash = (hash << 1) + gearTable[b]
+
+		if (len(c.buf) >= c.min && hash&c.mask == 0) || len(c.buf) >= c.max {
+			return c.buf, nil
+		}
+	}
+}
+
+// ChunkKey creates the key that a chunk with the given contents is stored
+// under. When 'encryption' is set the key is named with it, so that it
+// doesn't give away the hash of the chunk.
+func ChunkKey(bucketRoot string, chunk []byte, encryption *Encryption) string {
+	sum := sha256.Sum256(chunk)
+	key := fmt.Sprintf("%s/%s", chunkPrefix, objectName(sum[:], encryption))
+	if bucketRoot != "" {
+		key = fmt.Sprintf("%s/%s", bucketRoot, key)
+	}
+
+	return key
+}
+
+// storedChunk is a chunk that has been, or is being, put in the store. Done
+// is closed once it has been stored or has failed with err.
+type storedChunk struct {
+	done chan struct{}
+	err  error
+}
+
+// chunkSet keeps track of the chunks that are in the store and the ones that
+// are being uploaded, so that a file is only treated as stored once every
+// one of its chunks really is
+type chunkSet struct {
+	lock sync.Mutex
+	keys map[string]*storedChunk
+}
+
+func newChunkSet(index *Index) *chunkSet {
+	stored := &storedChunk{done: make(chan struct{})}
+	close(stored.done)
+
+	c := &chunkSet{
+		keys: map[string]*storedChunk{},
+	}
+	for _, v := range index.Files {
+		for _, k := range v.Chunks {
+			c.keys[k] = stored
+		}
+	}
+
+	return c
+}
+
+// claim returns true if the caller should store the chunk, in which case it
+// must call finish once it has. Otherwise the chunk is stored or being stored
+// by someone else, and claim waits for them and returns their error.
+func (c *chunkSet) claim(key string) (bool, error) {
+	c.lock.Lock()
+	chunk, found := c.keys[key]
+	if !found {
+		c.keys[key] = &storedChunk{done: make(chan struct{})}
+	}
+	c.lock.Unlock()
+
+	if !found {
+		return true, nil
+	}
+
+	<-chunk.done
+	if chunk.err != nil {
+		return false, fmt.Errorf("unable to store chunk %s: %w", key, chunk.err)
+	}
+
+	return false, nil
+}
+
+// finish records whether a claimed chunk was stored. A chunk that failed is
+// forgotten so that a later file can try to store it again.
+func (c *chunkSet) finish(key string, err error) {
+	c.lock.Lock()
+	chunk := c.keys[key]
+	if err != nil {
+		delete(c.keys, key)
+	}
+	c.lock.Unlock()
+
+	chunk.err = err
+	close(chunk.done)
+}
+
+// saveChunks splits the data in to chunks and puts any that are not already
+// stored in to the store, compressed with the codec. Chunks that another
+// upload is storing are waited for. It returns the keys of all the chunks in
+// order once every one of them is in the store. Chunks that are stored are
+// counted by 'sent' and the rest are taken off what is queued.
+func (u *Uploader) saveChunks(codec string, r io.Reader, sent *sentCounter) ([]string, error) {
+	c := newChunker(r, u.Chunking)
+	keys := []string{}
+
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		key := ChunkKey(u.BucketRoot, chunk, u.Encryption) + codecSuffix(codec)
+		claimed, err := u.chunks.claim(key)
+		if err != nil {
+			return nil, err
+		}
+		if claimed {
+			doLog("Uploading chunk %s\n", key)
+			err := u.saveChunk(key, codec, sent.reader(bytes.NewReader(chunk)))
+			u.chunks.finish(key, err)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			sent.skipped(int64(len(chunk)))
+		}
+
+		keys = append(keys, key)
+	}
+}
+
+func (u *Uploader) saveChunk(key, codec string, chunk io.Reader) error {
+	c, err := compress(codec, chunk)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = c.Close()
+	}()
+
+	return u.Store.Save(key, c)
+}
+
+// chunkReader reads the chunks of a file one after another
+type chunkReader struct {
+	repo    FileRepository
+	keys    []string
+	codec   string
+	current io.ReadCloser
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.current == nil {
+			if len(c.keys) == 0 {
+				return 0, io.EOF
+			}
+
+			r, err := openStored(c.repo, c.keys[0], c.codec)
+			if err != nil {
+				return 0, err
+			}
+			c.current, c.keys = r, c.keys[1:]
+		}
+
+		n, err := c.current.Read(p)
+		if err == io.EOF {
+			err = c.Close()
+			if n == 0 && err == nil {
+				continue
+			}
+		}
+
+		return n, err
+	}
+}
+
+func (c *chunkReader) Close() error {
+	if c.current == nil {
+		return nil
+	}
+
+	err := c.current.Close()
+	c.current = nil
+	return err
+}
+
+// openObject gets the contents of a file from the store, putting the chunks
+// back together if it has been split up and decompressing it
+func openObject(repo FileRepository, src Sourcefile) (io.ReadCloser, error) {
+	if len(src.Chunks) == 0 {
+		return openStored(repo, src.Key, src.Codec)
+	}
+
+	return &chunkReader{repo: repo, keys: src.Chunks, codec: src.Codec}, nil
+}
+
+func openStored(repo FileRepository, key, codec string) (io.ReadCloser, error) {
+	r, err := repo.GetByKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	src := &sourceReader{r: r}
+	d, err := decompress(codec, src)
+	if err != nil {
+		_ = r.Close()
+		return nil, src.decodeError(err)
+	}
+
+	return &readCloser{
+		Reader: &decodedReader{r: d, src: src},
+		close: func() error {
+			err := d.Close()
+			if closeErr := r.Close(); err == nil {
+				err = closeErr
+			}
+			return err
+		},
+	}, nil
+}
+
+// readCloser reads from one place and closes everything that it was read
+// from when it is closed
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.close()
+}
@@ -0,0 +1,278 @@
+package s3backup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	_, _ = rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func readChunks(t *testing.T, data []byte, config ChunkConfig) [][]byte {
+	c := newChunker(bytes.NewReader(data), config)
+	chunks := [][]byte{}
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		require.NoError(t, err)
+		chunks = append(chunks, append([]byte{}, chunk...))
+	}
+}
+
+func TestChunker(t *testing.T) {
+	data := randomData(1, 64*1024)
+	config := ChunkConfig{AverageSize: 1024}
+
+	chunks := readChunks(t, data, config)
+
+	assert.True(t, len(chunks) > 16, "found %d chunks", len(chunks))
+	assert.Equal(t, data, bytes.Join(chunks, nil))
+	for _, c := range chunks[:len(chunks)-1] {
+		assert.True(t, len(c) >= 256, "chunk of %d bytes is too small", len(c))
+		assert.True(t, len(c) <= 8*1024, "chunk of %d bytes is too large", len(c))
+	}
+}
+
+func TestChunker_Empty(t *testing.T) {
+	assert.Equal(t, 0, len(readChunks(t, []byte{}, ChunkConfig{})))
+}
+
+func TestChunker_SmallChangeKeepsMostChunks(t *testing.T) {
+	data := randomData(1, 64*1024)
+	config := ChunkConfig{AverageSize: 1024}
+	before := map[string]bool{}
+	for _, c := range readChunks(t, data, config) {
+		before[ChunkKey("", c, nil)] = true
+	}
+
+	changed := append([]byte{}, data[:30000]...)
+	changed = append(changed, []byte("a few extra bytes")...)
+	changed = append(changed, data[30000:]...)
+
+	after := readChunks(t, changed, config)
+	added := 0
+	for _, c := range after {
+		if !before[ChunkKey("", c, nil)] {
+			added++
+		}
+	}
+
+	assert.True(t, added <= 2, "%d of %d chunks changed", added, len(after))
+}
+
+func TestChunkKey(t *testing.T) {
+	assert.Equal(t, "chunks/e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", ChunkKey("", []byte{}, nil))
+	assert.Equal(t, "root/chunks/e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", ChunkKey("root", []byte{}, nil))
+}
+
+func TestUploader_Chunking(t *testing.T) {
+	files := map[string][]byte{
+		"big":   randomData(1, 64*1024),
+		"small": []byte("small file"),
+	}
+	local := &Index{
+		Files: map[string]Sourcefile{
+			"big":   Sourcefile{Key: "big", Hash: hashOf(string(files["big"])), Size: 64 * 1024},
+			"small": Sourcefile{Key: "small", Hash: hashOf("small file"), Size: 10},
+		},
+	}
+
+	mock := &mockStore{FailAfter: 999}
+	u := &Uploader{
+		Store: mock,
+		GetFile: func(p string) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(files[p])), nil
+		},
+		ParallelLimit: 2,
+		BatchSize:     2,
+		Chunking:      ChunkConfig{Enabled: true, MinFileSize: 1024, AverageSize: 1024},
+	}
+
+	updated, err := u.Upload(local, &Index{})
+	require.NoError(t, err)
+
+	assert.Nil(t, updated.Files["small"].Chunks)
+	assert.Contains(t, mock.Keys, "small")
+	assert.NotContains(t, mock.Keys, "big")
+	chunks := updated.Files["big"].Chunks
+	assert.True(t, len(chunks) > 16)
+	for _, c := range chunks {
+		assert.True(t, strings.HasPrefix(c, "chunks/"))
+		assert.Contains(t, mock.Keys, c)
+	}
+
+	uploadedBefore := len(mock.Keys)
+	files["big"] = append(append(append([]byte{}, files["big"][:30000]...), 'x'), files["big"][30000:]...)
+	local.Files["big"] = Sourcefile{Key: "big", Hash: hashOf(string(files["big"])), Size: int64(len(files["big"]))}
+
+	updated, err = u.Upload(local, updated)
+	require.NoError(t, err)
+
+	newChunks := len(mock.Keys) - uploadedBefore - 1
+	assert.True(t, newChunks <= 2, "uploaded %d new chunks", newChunks)
+
+	target, err := ioutil.TempDir("", "s3backup-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(target)
+
+	err = RestoreFiles(updated, mock, target, 2)
+	require.NoError(t, err)
+
+	got, err := ioutil.ReadFile(filepath.Join(target, "big"))
+	assert.NoError(t, err)
+	assert.Equal(t, files["big"], got)
+
+	assert.True(t, VerifyIndex(updated, mock, 2).OK())
+}
+
+func TestVerifyIndex_MissingChunk(t *testing.T) {
+	mock := &mockStore{
+		Keys:      []string{"chunks/1"},
+		Values:    []string{"file "},
+		FailAfter: 99,
+	}
+	index := &Index{
+		Files: map[string]Sourcefile{
+			"1": Sourcefile{Key: "a", Hash: hashOf("file 1"), Chunks: []string{"chunks/1", "chunks/2"}},
+		},
+	}
+
+	report := VerifyIndex(index, mock, 2)
+
+	assert.Equal(t, []string{"a"}, report.Missing)
+}
+
+func TestChunkSet_WaitsForPendingChunk(t *testing.T) {
+	chunks := newChunkSet(&Index{Files: map[string]Sourcefile{
+		"a": Sourcefile{Chunks: []string{"stored"}},
+	}})
+
+	claimed, err := chunks.claim("stored")
+	assert.False(t, claimed)
+	assert.NoError(t, err)
+
+	claimed, err = chunks.claim("new")
+	require.True(t, claimed)
+	require.NoError(t, err)
+
+	waited := make(chan error)
+	go func() {
+		claimed, err := chunks.claim("new")
+		assert.False(t, claimed)
+		waited <- err
+	}()
+
+	select {
+	case <-waited:
+		t.Fatal("claim returned before the chunk was stored")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	oops := errors.New("oops")
+	chunks.finish("new", oops)
+	assert.True(t, errors.Is(<-waited, oops))
+
+	claimed, err = chunks.claim("new")
+	assert.True(t, claimed, "a chunk that failed can be stored again")
+	assert.NoError(t, err)
+	chunks.finish("new", nil)
+
+	claimed, err = chunks.claim("new")
+	assert.False(t, claimed)
+	assert.NoError(t, err)
+}
+
+// failChunkStore fails the first save of one chunk, slowly enough that other
+// uploads of the same chunk have reached it
+type failChunkStore struct {
+	*mockStore
+	key    string
+	lock   sync.Mutex
+	failed bool
+}
+
+func (s *failChunkStore) Save(key string, data io.Reader) error {
+	if key == s.key {
+		s.lock.Lock()
+		fail := !s.failed
+		s.failed = true
+		s.lock.Unlock()
+
+		if fail {
+			time.Sleep(50 * time.Millisecond)
+			return errors.New("oops")
+		}
+	}
+
+	return s.mockStore.Save(key, data)
+}
+
+func TestUploader_SharedChunkFails(t *testing.T) {
+	config := ChunkConfig{Enabled: true, MinFileSize: 1024, AverageSize: 1024}
+	data := randomData(2, 16*1024)
+	local := &Index{Files: map[string]Sourcefile{
+		"a": Sourcefile{Key: "a", Hash: hashOf(string(data)), Size: int64(len(data))},
+		"b": Sourcefile{Key: "b", Hash: hashOf(string(data)), Size: int64(len(data))},
+		"c": Sourcefile{Key: "c", Hash: hashOf("small"), Size: 5},
+	}}
+
+	store := &failChunkStore{
+		mockStore: &mockStore{FailAfter: 999},
+		key:       ChunkKey("", readChunks(t, data, config)[0], nil),
+	}
+	u := &Uploader{
+		Store: store,
+		GetFile: func(p string) (io.ReadCloser, error) {
+			if p == "c" {
+				return ioutil.NopCloser(strings.NewReader("small")), nil
+			}
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		},
+		ParallelLimit:   3,
+		BatchSize:       1,
+		Chunking:        config,
+		ContinueOnError: true,
+	}
+
+	updated, err := u.Upload(local, &Index{Files: map[string]Sourcefile{}})
+
+	failed := &UploadError{}
+	require.True(t, errors.As(err, &failed), "%v", err)
+	require.NotNil(t, updated)
+	assert.Equal(t, 3, len(failed.Failed)+len(updated.Files))
+	assert.Contains(t, updated.Files, "c")
+
+	saved, err := store.GetByKey(indexFile)
+	require.NoError(t, err)
+	defer saved.Close()
+	b, err := ioutil.ReadAll(saved)
+	require.NoError(t, err)
+	index, err := NewIndex(string(b))
+	require.NoError(t, err)
+
+	for _, i := range []*Index{updated, index} {
+		for p, v := range i.Files {
+			for _, c := range v.Chunks {
+				_, err := store.Head(c)
+				assert.NoError(t, err, "%s points at missing chunk %s", p, c)
+			}
+		}
+	}
+}
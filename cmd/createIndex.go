@@ -16,7 +16,10 @@ var createIndexCmd = &cobra.Command{
 	Long: `This command generates an index file that sits at the root of
 your S3 bucket, avoiding all of the index performance issues with
 scanning all the files. It identifies all of the meta data you
-need to manage the files that have been backed up.`,
+need to manage the files that have been backed up.
+
+If the index file already exists then it is used as a cache, so that
+files which haven't changed are not hashed again.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		data, err := createIndex()
 		if err != nil {
@@ -36,15 +39,28 @@ need to manage the files that have been backed up.`,
 func init() {
 	rootCmd.AddCommand(createIndexCmd)
 	createIndexCmd.Flags().StringVar(&optIndexFile, "file", optIndexFile, "Location of the index file to write")
+	createIndexCmd.Flags().BoolVar(&optFullRehash, "full-rehash", optFullRehash, "Hash every file again instead of using the existing index file")
 }
 
 func createIndex() (string, error) {
-	index, err := s3backup.NewIndexFromRoot("", optIndexDirectory, s3backup.FilePathWalker, s3backup.FileHasher)
+	ignore, err := s3backup.NewIgnorer(s3backup.IgnoreConfig{})
+	if err != nil {
+		return "", err
+	}
+
+	scanner := &s3backup.Scanner{
+		Walker:  s3backup.FilePathWalker,
+		Hasher:  s3backup.FileHasher,
+		Workers: s3backup.DefaultHashWorkers,
+		Cache:   readCache(optIndexFile),
+		Ignore:  ignore,
+	}
+	_, err = scanner.Scan("", optIndexDirectory)
 	if err != nil {
 		return "", fmt.Errorf("Unable to read files for index: %w", err)
 	}
 
-	data, err := index.Encode()
+	data, err := scanner.Cache.Encode()
 	if err != nil {
 		return "", fmt.Errorf("Unable to create index: %w", err)
 	}
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/dnnrly/s3backup"
+)
+
+// exitPartial is the status that s3backup exits with when the backup finished
+// but some of the files could not be uploaded
+const exitPartial = 2
+
+// uploadFailures finds the files that could not be uploaded with
+// --continue-on-error, or nil if that isn't why 'err' happened
+func uploadFailures(err error) *s3backup.UploadError {
+	failed := &s3backup.UploadError{}
+	if errors.As(err, &failed) {
+		return failed
+	}
+
+	return nil
+}
+
+// printFailures lists the files that could not be uploaded and why
+func printFailures(failed *s3backup.UploadError) {
+	fmt.Fprintf(os.Stderr, "Unable to upload %d files, they will be tried again by the next backup:\n", len(failed.Failed))
+	for _, f := range failed.Failed {
+		fmt.Fprintf(os.Stderr, "  %s: %s\n", f.Path, f.Err)
+	}
+}
+
+// printSkipped lists the files that were left out of a backup because they
+// disappeared, couldn't be read or changed while they were being uploaded
+func printSkipped(skipped *s3backup.SkipLog) {
+	files := skipped.Files()
+	if len(files) == 0 {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "Skipped %d files, they will be tried again by the next backup:\n", len(files))
+	for _, f := range files {
+		fmt.Fprintf(os.Stderr, "  %s\n", f.Err)
+	}
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dnnrly/s3backup"
+	"golang.org/x/term"
+)
+
+const (
+	// progressRefresh is how often the progress is redrawn on a terminal
+	progressRefresh = 200 * time.Millisecond
+	// progressLogInterval is how often the progress is logged when the
+	// output isn't a terminal
+	progressLogInterval = time.Minute
+)
+
+// startProgress shows how a backup is getting on until the returned function
+// is called, which shows it one last time. On a terminal the progress is
+// redrawn on a single line, otherwise or with --verbose it is logged every
+// progressLogInterval.
+func startProgress(progress *s3backup.Progress) func() {
+	live := !verbose && isTerminal(os.Stdout)
+	interval := progressLogInterval
+	if live {
+		interval = progressRefresh
+	}
+
+	show := func(stats s3backup.ProgressStats) {
+		if live {
+			fmt.Fprintf(os.Stdout, "\r\033[K%s", stats)
+		} else {
+			log.Printf("Progress: %s", stats)
+		}
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				show(progress.Stats(now))
+			}
+		}
+	}()
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-finished
+			show(progress.Stats(time.Now()))
+			if live {
+				fmt.Fprintln(os.Stdout)
+			}
+		})
+	}
+}
+
+// isTerminal returns true if 'f' is a terminal rather than a file, a pipe or
+// a device like /dev/null
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
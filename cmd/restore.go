@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/dnnrly/s3backup"
+)
+
+var (
+	optRestoreTarget   = ""
+	optRestorePrefixes = []string{}
+	optRestoreHashes   = []string{}
+	optRestoreDeleted  = false
+)
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore [glob...]",
+	Short: "Restores your backed up files from S3",
+	Long: `This command reads the index at the root of your S3 bucket and
+downloads every file in it, writing each one to its original relative
+path below the target directory. Each file is checked against the
+hash in the index before it is put in place.
+
+You can restore just some of your files by passing shell globs that
+are matched against the file paths in the index, where '**' matches
+any number of directories. Directory prefixes and exact hashes can be
+selected as well. Files that have been deleted locally are only
+restored if you ask for them.`,
+	Run: doRestore,
+}
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+	restoreCmd.Flags().StringVarP(&optIndexDirectory, "root", "r", optIndexDirectory, "directory that was backed up, used to migrate indexes from older versions")
+	restoreCmd.Flags().StringVar(&optJob, "job", optJob, "Restore the files backed up by this job from your config")
+	restoreCmd.Flags().StringVar(&optRestoreTarget, "to", optRestoreTarget, "Directory to restore files in to")
+	restoreCmd.Flags().StringArrayVar(&optRestorePrefixes, "prefix", optRestorePrefixes, "Restore only files below this directory")
+	restoreCmd.Flags().StringArrayVar(&optRestoreHashes, "hash", optRestoreHashes, "Restore only files with this hash")
+	restoreCmd.Flags().BoolVar(&optRestoreDeleted, "include-deleted", optRestoreDeleted, "Also restore files that have been deleted locally")
+	_ = restoreCmd.MarkFlagRequired("to")
+}
+
+func doRestore(cmd *cobra.Command, args []string) {
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+
+	config := readConfig()
+	job, err := selectedJob(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	store, remoteIndex, err := openJob(config, job)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	if !optRestoreDeleted {
+		remoteIndex = remoteIndex.Current()
+	}
+
+	filter := s3backup.IndexFilter{
+		Globs:    args,
+		Prefixes: optRestorePrefixes,
+		Hashes:   optRestoreHashes,
+	}
+	selected, err := remoteIndex.Filter(filter)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	if !filter.Empty() && len(selected.Files) == 0 {
+		fmt.Fprintln(os.Stderr, "No files in the index match")
+		os.Exit(1)
+	}
+
+	err = s3backup.RestoreFiles(selected, store, optRestoreTarget, 5)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Printf("Restored %d files to %s\n", len(selected.Files), optRestoreTarget)
+}
@@ -1,25 +1,29 @@
 package cmd
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path"
+	"path/filepath"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	awss3 "github.com/aws/aws-sdk-go/service/s3"
 	"github.com/spf13/cobra"
 
 	"github.com/dnnrly/s3backup"
-	"github.com/dnnrly/s3backup/s3"
 )
 
 var (
 	cfgFile           = "config.yaml"
 	optIndexDirectory = "."
 	optIndexFile      = ".s3backup.yaml"
+	optDryRun         = false
+	optDelete         = false
+	optCacheFile      = ""
+	optFullRehash     = false
+	optContinue       = false
 	verbose           = false
 
 	indexFile = ".index.yaml"
@@ -49,6 +53,11 @@ func Execute() {
 
 func init() {
 	rootCmd.Flags().StringVarP(&optIndexDirectory, "root", "r", optIndexDirectory, "index scan root directory")
+	rootCmd.Flags().BoolVar(&optDryRun, "dry-run", optDryRun, "Show what would be uploaded without changing anything")
+	rootCmd.Flags().BoolVar(&optDelete, "delete", optDelete, "Remove files deleted locally once their grace period has passed")
+	rootCmd.Flags().StringVar(&optCacheFile, "cache", optCacheFile, fmt.Sprintf("Location of the hash cache (default is %s in the scan root)", optIndexFile))
+	rootCmd.Flags().BoolVar(&optFullRehash, "full-rehash", optFullRehash, "Hash every file again instead of using the hash cache")
+	rootCmd.Flags().BoolVar(&optContinue, "continue-on-error", optContinue, "Carry on with the other files when one can't be uploaded")
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", cfgFile, fmt.Sprintf("config file (default is %s)", cfgFile))
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", verbose, "Verbose output")
 }
@@ -62,11 +71,20 @@ func doLog(format string, args ...interface{}) {
 func doUpload(cmd *cobra.Command, args []string) {
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 
+	ctx, abort, stop := interruptContext()
+	defer stop()
+
 	config := readConfig()
-	store := createStore(config.S3)
-	remoteIndex := readRemoteIndex(config, store)
-	localIndex := createLocalIndex()
-	err := s3backup.UploadDifferences(localIndex, remoteIndex, 5, 5, store, getFile)
+	err := runJob(ctx, abort, config, defaultJob(), optCacheFile)
+	if interrupted(err) {
+		fmt.Fprintln(os.Stderr, "Backup interrupted, the files uploaded so far have been saved")
+		stop()
+		os.Exit(exitInterrupted)
+	}
+	if failed := uploadFailures(err); failed != nil {
+		printFailures(failed)
+		os.Exit(exitPartial)
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
@@ -76,6 +94,149 @@ func doUpload(cmd *cobra.Command, args []string) {
 	os.Exit(0)
 }
 
+// defaultJob is the job that backs up the directory given by --root when no
+// job has been named
+func defaultJob() s3backup.JobConfig {
+	return s3backup.JobConfig{
+		Sources: []string{optIndexDirectory},
+	}
+}
+
+// runJob backs up the sources of a job, or shows what would be backed up for
+// a dry run. If the context is cancelled then the scan stops, or the uploads
+// in progress are finished and the index is saved before the context's error
+// is returned. Closing 'abort' stops the uploads in progress as well, and
+// the index is saved with the files that had finished. Files that couldn't
+// be uploaded with --continue-on-error are returned in an UploadError once
+// everything else has been done.
+func runJob(ctx context.Context, abort <-chan struct{}, config *s3backup.Config, job s3backup.JobConfig, cacheFile string) error {
+	encryption, err := createEncryption(config)
+	if err != nil {
+		return err
+	}
+
+	store, err := createStore(config, job, encryption)
+	if err != nil {
+		return err
+	}
+
+	var lock *s3backup.Lock
+	if !optDryRun && !config.Lock.Disabled {
+		lock, err = s3backup.AcquireLock(store, job.IndexKey(), config.Lock.TTL)
+		if err != nil {
+			return err
+		}
+		defer releaseLock(lock)
+	}
+
+	remote, remoteIndex, err := readRemoteIndex(store, job)
+	if err != nil {
+		return err
+	}
+	remote.Lock = lock
+
+	migrated, err := migrateIndex(remoteIndex, job)
+	if err != nil {
+		return err
+	}
+
+	skipped := &s3backup.SkipLog{}
+	defer printSkipped(skipped)
+
+	progress := s3backup.NewProgress()
+	stopProgress := startProgress(progress)
+	defer stopProgress()
+
+	localIndex, err := createLocalIndex(ctx, config, job, encryption, cacheFile, skipped, progress)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if optDryRun {
+		stopProgress()
+		return s3backup.NewPlan(localIndex, remoteIndex, skipped.IndexPaths()).WriteText(os.Stdout)
+	}
+
+	now := time.Now()
+	deleted := remoteIndex.MarkDeleted(localIndex, skipped.IndexPaths(), now)
+
+	journal, err := openJournal(config, job)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = journal.Close()
+	}()
+
+	uploader := &s3backup.Uploader{
+		Store:           store,
+		GetFile:         getFile,
+		ParallelLimit:   5,
+		BatchSize:       5,
+		BucketRoot:      job.Prefix,
+		Chunking:        config.Chunking,
+		Compression:     config.Compression,
+		Remote:          remote,
+		Journal:         journal,
+		Retry:           config.Retry,
+		ContinueOnError: optContinue,
+		FileErrors:      config.FileErrors,
+		Skipped:         skipped,
+		Progress:        progress,
+		Encryption:      encryption,
+		Abort:           abort,
+	}
+	updatedIndex, err := uploader.UploadContext(ctx, localIndex, remoteIndex)
+	uploadErr := uploadFailures(err)
+	if err != nil && uploadErr == nil {
+		return err
+	}
+
+	purged := []string{}
+	if optDelete {
+		purged, err = s3backup.PurgeDeleted(updatedIndex, store, config.Delete.Grace(), now)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+		}
+	}
+
+	if deleted > 0 || len(purged) > 0 || migrated {
+		doLog("Recording %d deleted and %d purged files", deleted, len(purged))
+		if saveErr := remote.Save(updatedIndex); saveErr != nil {
+			return saveErr
+		}
+	}
+
+	if uploadErr != nil {
+		return uploadErr
+	}
+
+	return err
+}
+
+// openJournal opens the journal of uploads for a job, which is kept in the
+// user's cache directory
+func openJournal(config *s3backup.Config, job s3backup.JobConfig) (*s3backup.Journal, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+
+	p := filepath.Join(dir, "s3backup", job.JournalFile(config))
+	doLog("Using upload journal %s\n", p)
+	return s3backup.OpenJournal(p)
+}
+
+// releaseLock gives up the lock on an index once a backup has finished with it
+func releaseLock(lock *s3backup.Lock) {
+	if err := lock.Release(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to release lock: %s\n", err.Error())
+	}
+}
+
 func readConfig() *s3backup.Config {
 	doLog("Reading config")
 	config, err := s3backup.NewConfigFromFile(cfgFile)
@@ -87,65 +248,160 @@ func readConfig() *s3backup.Config {
 	return config
 }
 
-func createStore(config s3.Config) *s3.Store {
-	doLog("Creating S3 resources")
-	store, err := s3.NewStore(config)
+// createEncryption creates the Encryption from the config, or returns nil if
+// encryption is turned off
+func createEncryption(config *s3backup.Config) (*s3backup.Encryption, error) {
+	if !config.Encryption.Enabled() {
+		return nil, nil
+	}
+
+	return s3backup.NewEncryption(config.Encryption)
+}
+
+// createStore opens the store for a job, encrypting everything in it with
+// 'encryption' if it is set
+func createStore(config *s3backup.Config, job s3backup.JobConfig, encryption *s3backup.Encryption) (s3backup.ObjectStore, error) {
+	doLog("Creating store")
+	store, err := s3backup.OpenBackend(job.BackendURL(config), job.S3(config.S3))
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(1)
+		return nil, err
 	}
 
-	return store
+	if encryption != nil {
+		doLog("Encrypting contents of store")
+		store = &s3backup.EncryptedStore{
+			ObjectStore: store,
+			Encryption:  encryption,
+		}
+	}
+
+	return &s3backup.RetryStore{
+		ObjectStore: store,
+		Retry:       config.Retry,
+	}, nil
 }
 
-func readRemoteIndex(config *s3backup.Config, store *s3.Store) *s3backup.Index {
-	doLog("Reading remote index from %s\n", config.S3.Bucket)
-	remoteIndex := &s3backup.Index{}
-	indexReader, err := store.GetByKey(indexFile)
+// readRemoteIndex reads the index of a job from the store, returning it along
+// with the RemoteIndex used to save it again
+func readRemoteIndex(store s3backup.ObjectStore, job s3backup.JobConfig) (*s3backup.RemoteIndex, *s3backup.Index, error) {
+	doLog("Reading remote index from %s\n", job.IndexKey())
+	remote := s3backup.NewRemoteIndex(store, job.IndexKey())
+	index, err := remote.Read()
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == awss3.ErrCodeNoSuchKey {
-			doLog("Remote index does not exist, using empty index")
-			err = nil
-		} else {
-			fmt.Fprintln(os.Stderr, err.Error())
-			os.Exit(1)
+		return nil, nil, err
+	}
+
+	return remote, index, nil
+}
+
+// createLocalIndex scans all of the sources of a job. Each source keeps its
+// own hash cache unless 'cacheFile' is set, which can only be done for a job
+// with one source as each scan prunes the files of other sources from the
+// cache. Files that are left out because they can't be read are recorded in
+// 'skipped', and 'progress' is told about each file as it is found and hashed.
+// Cancelling the context stops the scan. With the content layout, files are
+// named with 'encryption' if it is set.
+func createLocalIndex(ctx context.Context, config *s3backup.Config, job s3backup.JobConfig, encryption *s3backup.Encryption, cacheFile string, skipped *s3backup.SkipLog, progress s3backup.Reporter) (*s3backup.Index, error) {
+	if cacheFile != "" && len(job.Sources) > 1 {
+		return nil, fmt.Errorf("a hash cache file can only be given for a job with one source, this one has %d", len(job.Sources))
+	}
+
+	localIndex := &s3backup.Index{
+		Version: s3backup.IndexVersion,
+		Files:   map[string]s3backup.Sourcefile{},
+	}
+
+	for source, to := range job.SourcePaths() {
+		sourceCache := cacheFile
+		if sourceCache == "" {
+			sourceCache = filepath.Join(source, optIndexFile)
 		}
-	} else {
-		buf := &bytes.Buffer{}
-		_, _ = buf.ReadFrom(indexReader)
-		remoteIndex, err = s3backup.NewIndex(buf.String())
+
+		ignore, err := s3backup.NewIgnorer(config.Ignore)
+		if err != nil {
+			return nil, err
+		}
+
+		sourceSkipped := &s3backup.SkipLog{}
+		doLog("Creating index of %s", source)
+		scanner := &s3backup.Scanner{
+			Walker:     s3backup.FilePathWalker,
+			Hasher:     s3backup.FileHasher,
+			Workers:    config.HashWorkers,
+			Cache:      readCache(sourceCache),
+			Ignore:     ignore,
+			FileErrors: config.FileErrors,
+			Skipped:    sourceSkipped,
+			Progress:   progress,
+		}
+		index, err := scanner.ScanContext(ctx, path.Join(job.Prefix, to), source)
+		if err != nil {
+			return nil, err
+		}
+
+		err = scanner.Cache.SaveFile(sourceCache)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err.Error())
-			os.Exit(1)
 		}
+
+		for f, v := range index.Files {
+			localIndex.Add(path.Join(to, f), v)
+		}
+		skipped.Merge(sourceSkipped, to)
 	}
 
-	return remoteIndex
+	if config.Layout == s3backup.LayoutContent {
+		err := localIndex.UseContentKeys(job.Prefix, encryption)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return localIndex, nil
 }
 
-func createLocalIndex() *s3backup.Index {
-	doLog("Creating index")
-	localIndex, err := s3backup.NewIndexFromRoot(
-		"",
-		optIndexDirectory,
-		s3backup.FilePathWalker,
-		s3backup.FileHasher,
-	)
+// migrateIndex rewrites a remote index written by an older version so that
+// its paths are relative to the sources of the job. Relative paths are taken
+// to be from the working directory. It returns true if the index was changed,
+// or an error if it has files but none of them are in the sources.
+func migrateIndex(index *s3backup.Index, job s3backup.JobConfig) (bool, error) {
+	if index.Version >= s3backup.IndexVersion {
+		return false, nil
+	}
+
+	wd, err := os.Getwd()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(1)
+		return false, fmt.Errorf("unable to migrate the remote index: %w", err)
+	}
+
+	moved, err := index.Migrate(job.SourcePaths(), wd)
+	if err != nil {
+		return false, fmt.Errorf("unable to migrate the remote index, run this from the directory that was backed up or set it with --root: %w", err)
 	}
+	doLog("Migrated %d files in the remote index to paths relative to their source", moved)
 
-	return localIndex
+	return true, nil
 }
 
-func getFile(p string) io.ReadCloser {
-	r, err := os.Open(path.Clean(p))
+// readCache loads the hashes from the last scan. If the cache can't be used
+// then every file is hashed again.
+func readCache(p string) *s3backup.Cache {
+	empty, _ := s3backup.NewCache("")
+	if optFullRehash {
+		doLog("Ignoring hash cache")
+		return empty
+	}
 
+	doLog("Reading hash cache from %s", p)
+	cache, err := s3backup.NewCacheFromFile(p)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(1)
+		return empty
 	}
 
-	return r
+	return cache
+}
+
+func getFile(p string) (io.ReadCloser, error) {
+	return os.Open(path.Clean(p))
 }
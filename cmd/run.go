@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/dnnrly/s3backup"
+)
+
+var (
+	optJob    = ""
+	optRunAll = false
+)
+
+// runCmd represents the run command
+var runCmd = &cobra.Command{
+	Use:   "run [job]",
+	Short: "Runs a backup job from your config",
+	Long: `This command runs one of the jobs defined in the jobs section of
+your config. Each job backs up its own source directories to its own
+bucket and prefix, keeping a separate index.
+
+All of the jobs can be run one after the other with --all. A job
+that fails doesn't stop the others from running.`,
+	Args: cobra.MaximumNArgs(1),
+	Run:  doRun,
+}
+
+func init() {
+	rootCmd.AddCommand(runCmd)
+	runCmd.Flags().BoolVar(&optRunAll, "all", optRunAll, "Run all of the jobs")
+	runCmd.Flags().BoolVar(&optDryRun, "dry-run", optDryRun, "Show what would be uploaded without changing anything")
+	runCmd.Flags().BoolVar(&optDelete, "delete", optDelete, "Remove files deleted locally once their grace period has passed")
+	runCmd.Flags().BoolVar(&optFullRehash, "full-rehash", optFullRehash, "Hash every file again instead of using the hash cache")
+	runCmd.Flags().BoolVar(&optContinue, "continue-on-error", optContinue, "Carry on with the other files when one can't be uploaded")
+}
+
+func doRun(cmd *cobra.Command, args []string) {
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+
+	if optRunAll == (len(args) == 1) {
+		fmt.Fprintln(os.Stderr, "Either name a job or use --all")
+		os.Exit(1)
+	}
+
+	ctx, abort, stop := interruptContext()
+	defer stop()
+
+	config := readConfig()
+	names := args
+	if optRunAll {
+		names = config.JobNames()
+	}
+
+	failed := 0
+	partial := 0
+	for _, name := range names {
+		job, err := config.Job(name)
+		if err == nil {
+			doLog("Running job %s", name)
+			err = runJob(ctx, abort, config, job, "")
+		}
+
+		if interrupted(err) {
+			fmt.Fprintf(os.Stderr, "Job %s interrupted, the files uploaded so far have been saved\n", name)
+			stop()
+			os.Exit(exitInterrupted)
+		}
+		if uploadErr := uploadFailures(err); uploadErr != nil {
+			fmt.Fprintf(os.Stderr, "Job %s finished with errors\n", name)
+			printFailures(uploadErr)
+			partial++
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Job %s failed: %s\n", name, err.Error())
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d jobs failed\n", failed, len(names))
+		os.Exit(1)
+	}
+
+	if partial > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d jobs could not upload every file\n", partial, len(names))
+		os.Exit(exitPartial)
+	}
+
+	doLog("Finished")
+	os.Exit(0)
+}
+
+// selectedJob finds the job named with --job, or the job that backs up the
+// directory given by --root if there isn't one
+func selectedJob(config *s3backup.Config) (s3backup.JobConfig, error) {
+	if optJob == "" {
+		return defaultJob(), nil
+	}
+
+	return config.Job(optJob)
+}
+
+// openJob creates the store for a job and reads its remote index. An index
+// written by an older version is migrated but not saved.
+func openJob(config *s3backup.Config, job s3backup.JobConfig) (s3backup.ObjectStore, *s3backup.Index, error) {
+	encryption, err := createEncryption(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	store, err := createStore(config, job, encryption)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, remoteIndex, err := readRemoteIndex(store, job)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := migrateIndex(remoteIndex, job); err != nil {
+		return nil, nil, err
+	}
+
+	return store, remoteIndex, nil
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	// exitInterrupted is the status that s3backup exits with when it has
+	// been stopped by SIGINT or SIGTERM
+	exitInterrupted = 130
+
+	// shutdownTimeout is how long the uploads in progress are given to
+	// finish after being asked to stop
+	shutdownTimeout = time.Minute
+)
+
+// interruptContext creates a context that is cancelled when s3backup is asked
+// to stop with SIGINT or SIGTERM, so that no more files are hashed or
+// uploaded and the index can be saved. If the uploads in progress take longer
+// than shutdownTimeout, or another signal arrives, then the returned channel
+// is closed to stop them, and the index is saved with the files that have
+// finished. A third signal makes s3backup exit straight away. The returned
+// function stops listening for signals.
+func interruptContext() (context.Context, <-chan struct{}, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	abort := make(chan struct{})
+	signals := make(chan os.Signal, 3)
+	done := make(chan struct{})
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			fmt.Fprintf(os.Stderr, "Received %s, finishing the uploads in progress and saving the index\n", sig)
+			cancel()
+		case <-done:
+			return
+		}
+
+		select {
+		case sig := <-signals:
+			fmt.Fprintf(os.Stderr, "Received %s again, stopping the uploads in progress and saving the index\n", sig)
+		case <-time.After(shutdownTimeout):
+			fmt.Fprintf(os.Stderr, "Uploads did not finish within %s, stopping them and saving the index\n", shutdownTimeout)
+		case <-done:
+			return
+		}
+		close(abort)
+
+		select {
+		case sig := <-signals:
+			fmt.Fprintf(os.Stderr, "Received %s again, stopping now\n", sig)
+		case <-done:
+			return
+		}
+		os.Exit(exitInterrupted)
+	}()
+
+	return ctx, abort, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel()
+	}
+}
+
+// interrupted returns true if 'err' is because s3backup was asked to stop
+func interrupted(err error) bool {
+	return errors.Is(err, context.Canceled)
+}
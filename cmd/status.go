@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/dnnrly/s3backup"
+)
+
+var (
+	optStatusJSON = false
+)
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Shows what the next backup would do",
+	Long: `This command indexes your local files and compares them with the
+index at the root of your S3 bucket. It shows the files that are new,
+modified, unchanged, deleted locally and skipped because they couldn't
+be read, along with the number of files and bytes in each category.
+Nothing is written to the bucket.`,
+	Run: doStatus,
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+	statusCmd.Flags().StringVarP(&optIndexDirectory, "root", "r", optIndexDirectory, "index scan root directory")
+	statusCmd.Flags().StringVar(&optJob, "job", optJob, "Show the status of this job from your config")
+	statusCmd.Flags().BoolVar(&optStatusJSON, "json", optStatusJSON, "Output the status as JSON")
+}
+
+func doStatus(cmd *cobra.Command, args []string) {
+	config := readConfig()
+	job, err := selectedJob(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	_, remoteIndex, err := openJob(config, job)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	encryption, err := createEncryption(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	skipped := &s3backup.SkipLog{}
+	localIndex, err := createLocalIndex(context.Background(), config, job, encryption, "", skipped, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	plan := s3backup.NewPlan(localIndex, remoteIndex, skipped.IndexPaths())
+
+	if optStatusJSON {
+		err = plan.WriteJSON(os.Stdout)
+	} else {
+		err = plan.WriteText(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
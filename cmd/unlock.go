@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/dnnrly/s3backup"
+)
+
+var (
+	optUnlockForce = false
+)
+
+// unlockCmd represents the unlock command
+var unlockCmd = &cobra.Command{
+	Use:   "unlock",
+	Short: "Removes the lock left on an index by a backup",
+	Long: `A backup locks the index in your bucket while it runs so that
+another backup of the same files can't overwrite it. If a backup is
+killed without releasing its lock then the next backup has to wait for
+the lock to expire.
+
+This command removes the lock straight away. A lock that hasn't expired
+may still be held by a running backup, so it is only removed with
+--force.`,
+	Run: doUnlock,
+}
+
+func init() {
+	rootCmd.AddCommand(unlockCmd)
+	unlockCmd.Flags().StringVarP(&optIndexDirectory, "root", "r", optIndexDirectory, "index scan root directory")
+	unlockCmd.Flags().StringVar(&optJob, "job", optJob, "Unlock the index of this job from your config")
+	unlockCmd.Flags().BoolVar(&optUnlockForce, "force", optUnlockForce, "Remove the lock even if it hasn't expired")
+}
+
+func doUnlock(cmd *cobra.Command, args []string) {
+	config := readConfig()
+	job, err := selectedJob(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	encryption, err := createEncryption(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	store, err := createStore(config, job, encryption)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	lease, err := s3backup.ReadLease(store, job.IndexKey())
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Println("Index is not locked")
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	if !lease.Expired(time.Now()) && !optUnlockForce {
+		fmt.Fprintf(os.Stderr, "Index is locked by %s, use --force to remove the lock anyway\n", lease)
+		os.Exit(1)
+	}
+
+	if err := s3backup.BreakLock(store, job.IndexKey()); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Printf("Removed lock held by %s\n", lease)
+	os.Exit(0)
+}
@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/dnnrly/s3backup"
+)
+
+var (
+	optVerifySample  = 0
+	optVerifyPercent = 0.0
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Checks that your backed up files are intact",
+	Long: `This command downloads the objects listed in the index at the root
+of your S3 bucket and checks that their contents still match the
+hashes in the index. It reports any objects that are missing, that
+could not be read or that do not match.
+
+Large indexes can be spot checked by verifying a random sample of
+the files instead of all of them.`,
+	Run: doVerify,
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+	verifyCmd.Flags().StringVarP(&optIndexDirectory, "root", "r", optIndexDirectory, "directory that was backed up, used to migrate indexes from older versions")
+	verifyCmd.Flags().StringVar(&optJob, "job", optJob, "Verify the files backed up by this job from your config")
+	verifyCmd.Flags().IntVar(&optVerifySample, "sample", optVerifySample, "Verify this many files chosen at random")
+	verifyCmd.Flags().Float64Var(&optVerifyPercent, "percent", optVerifyPercent, "Verify this percentage of files chosen at random")
+}
+
+func doVerify(cmd *cobra.Command, args []string) {
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+
+	if optVerifySample != 0 && optVerifyPercent != 0 {
+		fmt.Fprintln(os.Stderr, "Only one of --sample and --percent can be used")
+		os.Exit(1)
+	}
+	if optVerifySample < 0 {
+		fmt.Fprintln(os.Stderr, "--sample can't be negative")
+		os.Exit(1)
+	}
+	if optVerifyPercent < 0 || optVerifyPercent > 100 {
+		fmt.Fprintln(os.Stderr, "--percent must be between 0 and 100")
+		os.Exit(1)
+	}
+
+	config := readConfig()
+	job, err := selectedJob(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	store, remoteIndex, err := openJob(config, job)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	toVerify := remoteIndex
+	sample := optVerifySample
+	if optVerifyPercent != 0 {
+		sample = int(math.Ceil(float64(len(remoteIndex.Files)) * optVerifyPercent / 100))
+	}
+	if sample > 0 {
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+		toVerify = remoteIndex.Sample(sample, rnd)
+	}
+
+	report := s3backup.VerifyIndex(toVerify, store, 5)
+
+	for _, k := range report.Missing {
+		fmt.Printf("missing: %s\n", k)
+	}
+	for _, k := range report.Corrupted {
+		fmt.Printf("corrupted: %s\n", k)
+	}
+	for _, k := range report.Unreadable {
+		fmt.Printf("unreadable: %s\n", k)
+	}
+	for _, k := range report.Mismatched {
+		fmt.Printf("mismatched: %s\n", k)
+	}
+
+	fmt.Printf(
+		"Checked %d objects for %d of %d files: %d missing, %d corrupted, %d unreadable, %d mismatched\n",
+		report.Checked,
+		len(toVerify.Files),
+		len(remoteIndex.Files),
+		len(report.Missing),
+		len(report.Corrupted),
+		len(report.Unreadable),
+		len(report.Mismatched),
+	)
+
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,200 @@
+package s3backup
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// CodecNone stores data as it is
+	CodecNone = ""
+	// CodecGzip compresses data with gzip
+	CodecGzip = "gzip"
+	// CodecZstd compresses data with zstandard
+	CodecZstd = "zstd"
+
+	codecNoneName = "none"
+)
+
+// compressedExtensions are file types that are already compressed, so there is
+// nothing to gain from compressing them again
+var compressedExtensions = []string{
+	"7z", "avi", "bz2", "docx", "flac", "gif", "gz", "heic", "jpeg", "jpg",
+	"m4a", "mkv", "mov", "mp3", "mp4", "ogg", "png", "pptx", "rar", "tgz",
+	"webm", "webp", "xlsx", "xz", "zip", "zst",
+}
+
+// CompressionConfig defines how the contents of files are compressed before
+// they are put in the store. Rules are checked in order and the first one that
+// matches a file decides its codec. Files that are already compressed are
+// skipped unless a rule says otherwise, and everything else uses Codec.
+type CompressionConfig struct {
+	// Codec is used for files that don't match any rule
+	Codec string `yaml:"codec"`
+	// MinSize is the size in bytes of the smallest file that is compressed
+	MinSize int64 `yaml:"min_size"`
+	// Rules choose the codec for particular files
+	Rules []CompressionRule `yaml:"rules"`
+}
+
+// CompressionRule chooses the codec for files by their extension and size
+type CompressionRule struct {
+	// Extensions that this rule matches, any file matches if this is empty
+	Extensions []string `yaml:"extensions"`
+	// MinSize is the size in bytes of the smallest file that this rule matches
+	MinSize int64 `yaml:"min_size"`
+	// MaxSize is the size in bytes of the largest file that this rule matches,
+	// there is no limit if this is 0
+	MaxSize int64 `yaml:"max_size"`
+	// Codec to use for matching files, where 'none' turns compression off
+	Codec string `yaml:"codec"`
+}
+
+func (r CompressionRule) match(ext string, size int64) bool {
+	if size < r.MinSize || (r.MaxSize > 0 && size > r.MaxSize) {
+		return false
+	}
+
+	return len(r.Extensions) == 0 || hasExtension(r.Extensions, ext)
+}
+
+func hasExtension(extensions []string, ext string) bool {
+	for _, e := range extensions {
+		if strings.EqualFold(strings.TrimPrefix(e, "."), ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Validate checks that all of the codecs in the config are known
+func (c CompressionConfig) Validate() error {
+	if err := validateCodec(c.Codec); err != nil {
+		return err
+	}
+
+	for _, r := range c.Rules {
+		if err := validateCodec(r.Codec); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateCodec(codec string) error {
+	switch codec {
+	case CodecNone, codecNoneName, CodecGzip, CodecZstd:
+		return nil
+	}
+
+	return fmt.Errorf("unknown compression codec %s", codec)
+}
+
+// CodecFor works out which codec should be used for the file at 'p'
+func (c CompressionConfig) CodecFor(p string, size int64) string {
+	ext := strings.TrimPrefix(filepath.Ext(p), ".")
+
+	codec := c.Codec
+	matched := false
+	for _, r := range c.Rules {
+		if r.match(ext, size) {
+			codec, matched = r.Codec, true
+			break
+		}
+	}
+
+	if !matched && (size < c.MinSize || hasExtension(compressedExtensions, ext)) {
+		return CodecNone
+	}
+
+	if codec == codecNoneName {
+		return CodecNone
+	}
+
+	return codec
+}
+
+// codecSuffix is added to the keys of chunks so that the same chunk stored with
+// different codecs doesn't clash
+func codecSuffix(codec string) string {
+	switch codec {
+	case CodecGzip:
+		return ".gz"
+	case CodecZstd:
+		return ".zst"
+	}
+
+	return ""
+}
+
+// compress returns a reader of the contents of 'r' compressed with the codec.
+// The reader must be closed so that the compression can stop early.
+func compress(codec string, r io.Reader) (io.ReadCloser, error) {
+	if codec == CodecNone {
+		return ioutil.NopCloser(r), nil
+	}
+
+	if err := validateCodec(codec); err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		var w io.WriteCloser
+		var err error
+		switch codec {
+		case CodecGzip:
+			w = gzip.NewWriter(pw)
+		case CodecZstd:
+			w, err = zstd.NewWriter(pw, zstd.WithEncoderConcurrency(1))
+		}
+
+		if err == nil {
+			_, err = io.Copy(w, r)
+			closeErr := w.Close()
+			if err == nil {
+				err = closeErr
+			}
+		}
+
+		pw.CloseWithError(err)
+	}()
+
+	return pr, nil
+}
+
+// decompress returns a reader of the contents of 'r' after decoding it with
+// the codec
+func decompress(codec string, r io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case CodecNone:
+		return ioutil.NopCloser(r), nil
+	case CodecGzip:
+		return gzip.NewReader(r)
+	case CodecZstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zstdReader{d}, nil
+	}
+
+	return nil, fmt.Errorf("unknown compression codec %s", codec)
+}
+
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+func (z zstdReader) Close() error {
+	z.Decoder.Close()
+	return nil
+}
@@ -0,0 +1,128 @@
+package s3backup
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressionConfig_CodecFor(t *testing.T) {
+	config := CompressionConfig{
+		Codec:   CodecZstd,
+		MinSize: 100,
+		Rules: []CompressionRule{
+			{Extensions: []string{".log"}, Codec: CodecGzip},
+			{Extensions: []string{"bin"}, MinSize: 1000, Codec: "none"},
+			{Extensions: []string{"png"}, Codec: CodecGzip},
+		},
+	}
+
+	tests := []struct {
+		path  string
+		size  int64
+		codec string
+	}{
+		{"a/b.txt", 500, CodecZstd},
+		{"a/b.txt", 50, CodecNone},
+		{"a/b.log", 500, CodecGzip},
+		{"a/b.LOG", 10, CodecGzip},
+		{"a/b.bin", 500, CodecZstd},
+		{"a/b.bin", 5000, CodecNone},
+		{"a/photo.jpg", 5000, CodecNone},
+		{"a/photo.JPEG", 5000, CodecNone},
+		{"a/image.png", 5000, CodecGzip},
+		{"a/noext", 5000, CodecZstd},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.codec, config.CodecFor(tt.path, tt.size), "%s with size %d", tt.path, tt.size)
+	}
+
+	assert.Equal(t, CodecNone, CompressionConfig{}.CodecFor("a/b.txt", 500))
+}
+
+func TestCompress_RoundTrip(t *testing.T) {
+	data := []byte(strings.Repeat("some very compressible text\n", 1000))
+
+	for _, codec := range []string{CodecNone, CodecGzip, CodecZstd} {
+		c, err := compress(codec, bytes.NewReader(data))
+		require.NoError(t, err)
+		compressed, err := ioutil.ReadAll(c)
+		require.NoError(t, err)
+		assert.NoError(t, c.Close())
+
+		if codec != CodecNone {
+			assert.True(t, len(compressed) < len(data)/10, "%s compressed to %d bytes", codec, len(compressed))
+		}
+
+		d, err := decompress(codec, bytes.NewReader(compressed))
+		require.NoError(t, err)
+		got, err := ioutil.ReadAll(d)
+		assert.NoError(t, err)
+		assert.NoError(t, d.Close())
+		assert.Equal(t, data, got, codec)
+	}
+}
+
+func TestCompress_UnknownCodec(t *testing.T) {
+	_, err := compress("lzma", strings.NewReader(""))
+	assert.Error(t, err)
+
+	_, err = decompress("lzma", strings.NewReader(""))
+	assert.Error(t, err)
+}
+
+func TestUploader_Compression(t *testing.T) {
+	files := map[string]string{
+		"log.txt":   strings.Repeat("a log line\n", 1000),
+		"photo.jpg": strings.Repeat("not really a photo\n", 1000),
+		"big.csv":   strings.Repeat("1,2,3,4\n", 10000),
+	}
+	local := &Index{Files: map[string]Sourcefile{}}
+	for p, contents := range files {
+		local.Files[p] = Sourcefile{Key: p, Hash: hashOf(contents), Size: int64(len(contents))}
+	}
+
+	mock := &mockStore{FailAfter: 999}
+	u := &Uploader{
+		Store: mock,
+		GetFile: func(p string) (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader(files[p])), nil
+		},
+		ParallelLimit: 2,
+		BatchSize:     5,
+		Chunking:      ChunkConfig{Enabled: true, MinFileSize: 50000, AverageSize: 1024},
+		Compression:   CompressionConfig{Codec: CodecZstd, Rules: []CompressionRule{{Extensions: []string{"txt"}, Codec: CodecGzip}}},
+	}
+
+	updated, err := u.Upload(local, &Index{})
+	require.NoError(t, err)
+
+	assert.Equal(t, CodecGzip, updated.Files["log.txt"].Codec)
+	assert.Equal(t, CodecNone, updated.Files["photo.jpg"].Codec)
+	assert.Equal(t, CodecZstd, updated.Files["big.csv"].Codec)
+	assert.NotEmpty(t, updated.Files["big.csv"].Chunks)
+	for _, c := range updated.Files["big.csv"].Chunks {
+		assert.True(t, strings.HasSuffix(c, ".zst"), c)
+	}
+
+	target, err := ioutil.TempDir("", "s3backup-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(target)
+
+	require.NoError(t, RestoreFiles(updated, mock, target, 2))
+	for p, contents := range files {
+		got, err := ioutil.ReadFile(filepath.Join(target, p))
+		assert.NoError(t, err)
+		assert.Equal(t, contents, string(got))
+	}
+
+	assert.True(t, VerifyIndex(updated, mock, 2).OK())
+}
@@ -5,14 +5,58 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"time"
 
 	"github.com/dnnrly/s3backup/s3"
 	"gopkg.in/yaml.v2"
 )
 
+const (
+	// DefaultGracePeriod is how long deleted files are kept when no grace
+	// period has been configured
+	DefaultGracePeriod = 30 * 24 * time.Hour
+)
+
 // Config defines the configuration for the whole tool
 type Config struct {
 	S3 s3.Config `yaml:"s3"`
+	// Backend is the URL of where files are stored, such as s3://bucket/prefix,
+	// file:///mnt/backup or mem://test. The S3 config is used if this is empty.
+	Backend string `yaml:"backend"`
+	// Layout is how files are arranged in the store, either LayoutPath or
+	// LayoutContent
+	Layout      string            `yaml:"layout"`
+	Delete      DeleteConfig      `yaml:"delete"`
+	Chunking    ChunkConfig       `yaml:"chunking"`
+	Encryption  EncryptionConfig  `yaml:"encryption"`
+	Compression CompressionConfig `yaml:"compression"`
+	Ignore      IgnoreConfig      `yaml:"ignore"`
+	Lock        LockConfig        `yaml:"lock"`
+	Retry       RetryConfig       `yaml:"retry"`
+	FileErrors  FileErrorConfig   `yaml:"file_errors"`
+	// HashWorkers is the number of files that are hashed at the same time
+	HashWorkers int `yaml:"hash_workers"`
+	// Jobs are named backups that can be run on their own
+	Jobs map[string]JobConfig `yaml:"jobs"`
+}
+
+// DeleteConfig defines how files that have been deleted locally are removed
+// from the store
+type DeleteConfig struct {
+	// GracePeriod is how long a deleted file is kept before it is removed. It
+	// is nil when it hasn't been configured, as zero means that deleted files
+	// are removed straight away.
+	GracePeriod *time.Duration `yaml:"grace_period"`
+}
+
+// Grace is how long a deleted file is kept before it is removed, which is
+// DefaultGracePeriod if no grace period has been configured
+func (c DeleteConfig) Grace() time.Duration {
+	if c.GracePeriod == nil {
+		return DefaultGracePeriod
+	}
+
+	return *c.GracePeriod
 }
 
 // NewConfigFromString generates a config object from the string
@@ -23,6 +67,100 @@ func NewConfigFromString(data string) (*Config, error) {
 		return nil, err
 	}
 
+	switch config.Layout {
+	case "":
+		config.Layout = LayoutPath
+	case LayoutPath, LayoutContent:
+	default:
+		return nil, fmt.Errorf("unknown layout %s", config.Layout)
+	}
+
+	if err := config.Compression.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := config.Ignore.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := ValidateBackend(config.Backend); err != nil {
+		return nil, err
+	}
+
+	if config.Backend != "" && config.S3.Bucket != "" {
+		return nil, fmt.Errorf("s3 bucket %s can't be used with backend %s, put the bucket in the backend URL", config.S3.Bucket, config.Backend)
+	}
+
+	if err := config.Retry.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := config.FileErrors.Validate(); err != nil {
+		return nil, err
+	}
+
+	for name, job := range config.Jobs {
+		if err := job.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid job %s: %w", name, err)
+		}
+		if backend := job.BackendURL(config); backend != "" && job.Bucket != "" {
+			return nil, fmt.Errorf("invalid job %s: bucket %s can't be used with backend %s, put the bucket in the backend URL", name, job.Bucket, backend)
+		}
+		job.Prefix = cleanPrefix(job.Prefix)
+		config.Jobs[name] = job
+	}
+
+	if config.HashWorkers <= 0 {
+		config.HashWorkers = DefaultHashWorkers
+	}
+
+	if config.Delete.GracePeriod == nil {
+		grace := DefaultGracePeriod
+		config.Delete.GracePeriod = &grace
+	} else if *config.Delete.GracePeriod < 0 {
+		return nil, fmt.Errorf("delete grace period must not be negative")
+	}
+
+	if config.Lock.TTL == 0 {
+		config.Lock.TTL = DefaultLockTTL
+	}
+
+	if config.Retry.Attempts == 0 {
+		config.Retry.Attempts = DefaultRetryAttempts
+	}
+
+	if config.Retry.Backoff == 0 {
+		config.Retry.Backoff = DefaultRetryBackoff
+	}
+
+	if config.Retry.MaxBackoff == 0 {
+		config.Retry.MaxBackoff = DefaultRetryMaxBackoff
+	}
+
+	if config.Retry.Jitter == 0 {
+		config.Retry.Jitter = DefaultRetryJitter
+	}
+
+	if config.FileErrors.Missing == "" {
+		config.FileErrors.Missing = PolicyWarn
+	}
+
+	if config.FileErrors.PermissionDenied == "" {
+		config.FileErrors.PermissionDenied = PolicyWarn
+	}
+
+	if config.FileErrors.Changed == "" {
+		config.FileErrors.Changed = PolicyWarn
+	}
+
+	if config.Chunking.MinFileSize == 0 {
+		config.Chunking.MinFileSize = DefaultChunkMinFileSize
+	}
+
+	if config.Chunking.AverageSize == 0 {
+		config.Chunking.AverageSize = DefaultChunkAverageSize
+	}
+
 	return config, nil
 }
 
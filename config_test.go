@@ -2,9 +2,11 @@ package s3backup
 
 import (
 	"testing"
+	"time"
 
 	"github.com/dnnrly/s3backup/s3"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewConfigFromString_DiscoversParseError(t *testing.T) {
@@ -35,6 +37,29 @@ s3:
 			Key:    "Key-1",
 			Token:  "Token-1",
 		},
+		Layout: LayoutPath,
+		Delete: DeleteConfig{
+			GracePeriod: durationPtr(DefaultGracePeriod),
+		},
+		Chunking: ChunkConfig{
+			MinFileSize: DefaultChunkMinFileSize,
+			AverageSize: DefaultChunkAverageSize,
+		},
+		Lock: LockConfig{
+			TTL: DefaultLockTTL,
+		},
+		Retry: RetryConfig{
+			Attempts:   DefaultRetryAttempts,
+			Backoff:    DefaultRetryBackoff,
+			MaxBackoff: DefaultRetryMaxBackoff,
+			Jitter:     DefaultRetryJitter,
+		},
+		FileErrors: FileErrorConfig{
+			Missing:          PolicyWarn,
+			PermissionDenied: PolicyWarn,
+			Changed:          PolicyWarn,
+		},
+		HashWorkers: DefaultHashWorkers,
 	}
 
 	config, err := NewConfigFromString(data)
@@ -42,3 +67,230 @@ s3:
 	assert.NoError(t, err)
 	assert.Equal(t, expected, config)
 }
+
+func durationPtr(d time.Duration) *time.Duration {
+	return &d
+}
+
+func TestNewConfigFromString_GracePeriod(t *testing.T) {
+	tests := []struct {
+		data  string
+		grace time.Duration
+	}{
+		{data: "delete:\n  grace_period: 72h\n", grace: 72 * time.Hour},
+		{data: "delete:\n  grace_period: 0s\n", grace: 0},
+		{data: "delete:\n  grace_period: 0\n", grace: 0},
+		{data: "delete:\n", grace: DefaultGracePeriod},
+		{data: "layout: path\n", grace: DefaultGracePeriod},
+	}
+
+	for _, tt := range tests {
+		config, err := NewConfigFromString(tt.data)
+
+		require.NoError(t, err, tt.data)
+		assert.Equal(t, tt.grace, config.Delete.Grace(), tt.data)
+		assert.Equal(t, tt.grace, *config.Delete.GracePeriod, tt.data)
+	}
+
+	_, err := NewConfigFromString("delete:\n  grace_period: -1h\n")
+	assert.Error(t, err)
+
+	assert.Equal(t, DefaultGracePeriod, DeleteConfig{}.Grace())
+}
+
+func TestNewConfigFromString_Layout(t *testing.T) {
+	config, err := NewConfigFromString(`layout: content`)
+	assert.NoError(t, err)
+	assert.Equal(t, LayoutContent, config.Layout)
+
+	config, err = NewConfigFromString(`layout: unknown`)
+	assert.Error(t, err)
+	assert.Nil(t, config)
+}
+
+func TestNewConfigFromString_Chunking(t *testing.T) {
+	data := `
+chunking:
+  enabled: true
+  min_file_size: 1000
+  average_size: 100
+`
+	config, err := NewConfigFromString(data)
+
+	assert.NoError(t, err)
+	assert.Equal(t, ChunkConfig{Enabled: true, MinFileSize: 1000, AverageSize: 100}, config.Chunking)
+}
+
+func TestNewConfigFromString_Encryption(t *testing.T) {
+	data := `
+encryption:
+  key_file: /etc/s3backup.key
+`
+	config, err := NewConfigFromString(data)
+
+	assert.NoError(t, err)
+	assert.True(t, config.Encryption.Enabled())
+	assert.Equal(t, "/etc/s3backup.key", config.Encryption.KeyFile)
+}
+
+func TestNewConfigFromString_Compression(t *testing.T) {
+	data := `
+compression:
+  codec: zstd
+  min_size: 1024
+  rules:
+    - extensions: [log, csv]
+      codec: gzip
+`
+	config, err := NewConfigFromString(data)
+
+	assert.NoError(t, err)
+	assert.Equal(t, CompressionConfig{
+		Codec:   CodecZstd,
+		MinSize: 1024,
+		Rules: []CompressionRule{
+			{Extensions: []string{"log", "csv"}, Codec: CodecGzip},
+		},
+	}, config.Compression)
+
+	config, err = NewConfigFromString(`compression: {codec: lzma}`)
+	assert.Error(t, err)
+	assert.Nil(t, config)
+}
+
+func TestNewConfigFromString_Ignore(t *testing.T) {
+	data := `
+ignore:
+  exclude: [node_modules/, "*.swp"]
+  include: [important.swp]
+`
+	config, err := NewConfigFromString(data)
+
+	assert.NoError(t, err)
+	assert.Equal(t, IgnoreConfig{
+		Exclude: []string{"node_modules/", "*.swp"},
+		Include: []string{"important.swp"},
+	}, config.Ignore)
+
+	config, err = NewConfigFromString(`ignore: {exclude: ["[a-"]}`)
+	assert.Error(t, err)
+	assert.Nil(t, config)
+}
+
+func TestNewConfigFromString_Jobs(t *testing.T) {
+	data := `
+jobs:
+  photos:
+    sources: [/home/me/photos, /media/camera]
+    prefix: /photos/
+  docs:
+    sources: [/home/me/docs]
+    bucket: other-bucket
+    index: indexes/docs.yaml
+`
+	config, err := NewConfigFromString(data)
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]JobConfig{
+		"photos": JobConfig{
+			Sources: []string{"/home/me/photos", "/media/camera"},
+			Prefix:  "photos",
+		},
+		"docs": JobConfig{
+			Sources: []string{"/home/me/docs"},
+			Bucket:  "other-bucket",
+			Index:   "indexes/docs.yaml",
+		},
+	}, config.Jobs)
+
+	config, err = NewConfigFromString(`jobs: {photos: {prefix: photos}}`)
+	assert.Error(t, err)
+	assert.Nil(t, config)
+}
+
+func TestNewConfigFromString_Backend(t *testing.T) {
+	config, err := NewConfigFromString(`backend: file:///mnt/backup`)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "file:///mnt/backup", config.Backend)
+
+	config, err = NewConfigFromString(`backend: ftp://server/backup`)
+	assert.Error(t, err)
+	assert.Nil(t, config)
+
+	config, err = NewConfigFromString(`jobs: {usb: {sources: [a], backend: "ftp://server"}}`)
+	assert.Error(t, err)
+	assert.Nil(t, config)
+}
+
+func TestNewConfigFromString_BackendAndBucket(t *testing.T) {
+	config, err := NewConfigFromString(`{backend: "s3://bucket/prefix", s3: {bucket: other}}`)
+	assert.Error(t, err)
+	assert.Nil(t, config)
+
+	config, err = NewConfigFromString(`jobs: {usb: {sources: [a], backend: "file:///mnt/usb", bucket: other}}`)
+	assert.Error(t, err)
+	assert.Nil(t, config)
+
+	config, err = NewConfigFromString(`{backend: "file:///mnt/usb", jobs: {usb: {sources: [a], bucket: other}}}`)
+	assert.Error(t, err)
+	assert.Nil(t, config)
+
+	config, err = NewConfigFromString(`{s3: {bucket: bucket}, jobs: {usb: {sources: [a], backend: "file:///mnt/usb"}}}`)
+	assert.NoError(t, err, "a job's backend is used in place of the s3 bucket")
+	assert.NotNil(t, config)
+}
+
+func TestNewConfigFromString_Lock(t *testing.T) {
+	config, err := NewConfigFromString(`lock: {ttl: 2m}`)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2*time.Minute, config.Lock.TTL)
+	assert.False(t, config.Lock.Disabled)
+
+	config, err = NewConfigFromString(`lock: {disabled: true}`)
+
+	assert.NoError(t, err)
+	assert.True(t, config.Lock.Disabled)
+}
+
+func TestNewConfigFromString_Retry(t *testing.T) {
+	data := `
+retry:
+  attempts: 3
+  backoff: 1s
+`
+	config, err := NewConfigFromString(data)
+
+	assert.NoError(t, err)
+	assert.Equal(t, RetryConfig{
+		Attempts:   3,
+		Backoff:    time.Second,
+		MaxBackoff: DefaultRetryMaxBackoff,
+		Jitter:     DefaultRetryJitter,
+	}, config.Retry)
+
+	config, err = NewConfigFromString(`retry: {jitter: 2}`)
+	assert.Error(t, err)
+	assert.Nil(t, config)
+}
+
+func TestNewConfigFromString_FileErrors(t *testing.T) {
+	data := `
+file_errors:
+  missing: skip
+  permission_denied: fail
+`
+	config, err := NewConfigFromString(data)
+
+	assert.NoError(t, err)
+	assert.Equal(t, FileErrorConfig{
+		Missing:          PolicySkip,
+		PermissionDenied: PolicyFail,
+		Changed:          PolicyWarn,
+	}, config.FileErrors)
+
+	config, err = NewConfigFromString(`file_errors: {changed: ignore}`)
+	assert.Error(t, err)
+	assert.Nil(t, config)
+}
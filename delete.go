@@ -0,0 +1,145 @@
+package s3backup
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"time"
+)
+
+// MarkDeleted records a tombstone against every file in this index that no longer
+// exists in the local index. Files at the index paths in 'skipped', or in the
+// directories there, couldn't be read rather than being deleted so they are
+// left as they are. It returns the number of files that were marked.
+func (i *Index) MarkDeleted(local *Index, skipped []string, now time.Time) int {
+	unread := pathSet(skipped)
+
+	count := 0
+	for f, v := range i.Files {
+		if _, found := local.Files[f]; found || v.Deleted() || underAny(f, unread) {
+			continue
+		}
+
+		doLog("Found deleted file %s\n", f)
+		v.DeletedAt = now
+		i.Files[f] = v
+		count++
+	}
+
+	return count
+}
+
+// pathSet makes a set of 'paths' to look up with underAny
+func pathSet(paths []string) map[string]bool {
+	set := map[string]bool{}
+	for _, p := range paths {
+		set[p] = true
+	}
+
+	return set
+}
+
+// underAny is true if 'p' or any of the directories above it is in 'paths'
+func underAny(p string, paths map[string]bool) bool {
+	for ; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		if paths[p] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Current creates a new Index containing only the files that have not been
+// deleted
+func (i *Index) Current() *Index {
+	result := &Index{
+		Files: map[string]Sourcefile{},
+	}
+	for f, v := range i.Files {
+		if !v.Deleted() {
+			result.Add(f, v)
+		}
+	}
+
+	return result
+}
+
+// deleteBatchSize is the most objects that are deleted from the store at once
+const deleteBatchSize = 1000
+
+// PurgeDeleted removes the objects for files that were deleted more than 'grace'
+// ago from the store, then removes them from the index. Objects that are still
+// used by other files in the index are left in place. The objects are deleted
+// in batches of deleteBatchSize and a file is only removed from the index if
+// every batch holding its objects was deleted, so if some batches fail the
+// files that were purged are returned along with the error.
+func PurgeDeleted(index *Index, store ObjectDeleter, grace time.Duration, now time.Time) ([]string, error) {
+	inUse := map[string]bool{}
+	expired := []string{}
+	for f, v := range index.Files {
+		if !v.Deleted() {
+			for _, key := range objectKeys(v) {
+				inUse[key] = true
+			}
+		} else if !v.DeletedAt.Add(grace).After(now) {
+			expired = append(expired, f)
+		}
+	}
+	sort.Strings(expired)
+
+	// each object is deleted for the first file that needs it gone
+	owners := map[string]string{}
+	keys := []string{}
+	for _, f := range expired {
+		for _, key := range objectKeys(index.Files[f]) {
+			if _, found := owners[key]; found || inUse[key] {
+				continue
+			}
+
+			doLog("Deleting %s from %s\n", key, f)
+			owners[key] = f
+			keys = append(keys, key)
+		}
+	}
+
+	failed := map[string]bool{}
+	var deleteErr error
+	for start := 0; start < len(keys); start += deleteBatchSize {
+		end := start + deleteBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		batch := keys[start:end]
+		if err := store.Delete(batch...); err != nil {
+			if deleteErr == nil {
+				deleteErr = fmt.Errorf("unable to delete %d objects starting with %s: %w", len(batch), batch[0], err)
+			}
+			for _, key := range batch {
+				failed[owners[key]] = true
+			}
+		}
+	}
+
+	purged := []string{}
+	for _, f := range expired {
+		if failed[f] {
+			continue
+		}
+
+		delete(index.Files, f)
+		purged = append(purged, f)
+	}
+
+	return purged, deleteErr
+}
+
+// objectKeys lists all of the keys that the contents of a file are stored under
+func objectKeys(src Sourcefile) []string {
+	if len(src.Chunks) == 0 {
+		return []string{src.Key}
+	}
+
+	return src.Chunks
+}
@@ -0,0 +1,198 @@
+package s3backup
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexMarkDeleted(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	earlier := now.Add(-time.Hour)
+	local := &Index{
+		Files: map[string]Sourcefile{
+			"1": Sourcefile{Key: "a", Hash: "321"},
+			"2": Sourcefile{Key: "b", Hash: "123"},
+		},
+	}
+	remote := &Index{
+		Files: map[string]Sourcefile{
+			"1": Sourcefile{Key: "a", Hash: "123"},
+			"3": Sourcefile{Key: "c", Hash: "123"},
+			"4": Sourcefile{Key: "d", Hash: "123", DeletedAt: earlier},
+		},
+	}
+
+	count := remote.MarkDeleted(local, nil, now)
+
+	assert.Equal(t, 1, count)
+	assert.False(t, remote.Files["1"].Deleted())
+	assert.Equal(t, now, remote.Files["3"].DeletedAt)
+	assert.Equal(t, earlier, remote.Files["4"].DeletedAt)
+}
+
+func TestIndexMarkDeleted_Skipped(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	local := &Index{Files: map[string]Sourcefile{}}
+	remote := &Index{
+		Files: map[string]Sourcefile{
+			"a":            Sourcefile{Key: "a", Hash: "1"},
+			"b":            Sourcefile{Key: "b", Hash: "2"},
+			"secret/c":     Sourcefile{Key: "secret/c", Hash: "3"},
+			"secret/d/e":   Sourcefile{Key: "secret/d/e", Hash: "4"},
+			"secretive/f":  Sourcefile{Key: "secretive/f", Hash: "5"},
+			"other/secret": Sourcefile{Key: "other/secret", Hash: "6"},
+		},
+	}
+
+	count := remote.MarkDeleted(local, []string{"b", "secret"}, now)
+
+	assert.Equal(t, 3, count)
+	assert.Equal(t, now, remote.Files["a"].DeletedAt)
+	assert.False(t, remote.Files["b"].Deleted())
+	assert.False(t, remote.Files["secret/c"].Deleted())
+	assert.False(t, remote.Files["secret/d/e"].Deleted())
+	assert.Equal(t, now, remote.Files["secretive/f"].DeletedAt)
+	assert.Equal(t, now, remote.Files["other/secret"].DeletedAt)
+}
+
+func TestIndexCurrent(t *testing.T) {
+	index := &Index{
+		Files: map[string]Sourcefile{
+			"1": Sourcefile{Key: "a", Hash: "123"},
+			"2": Sourcefile{Key: "b", Hash: "123", DeletedAt: time.Now()},
+		},
+	}
+
+	got := index.Current()
+
+	assert.Equal(t, 1, len(got.Files))
+	assert.Contains(t, got.Files, "1")
+}
+
+func TestIndexDifference_RestoresDeleted(t *testing.T) {
+	local := &Index{
+		Files: map[string]Sourcefile{
+			"1": Sourcefile{Key: "a", Hash: "123"},
+		},
+	}
+	remote := &Index{
+		Files: map[string]Sourcefile{
+			"1": Sourcefile{Key: "a", Hash: "123", DeletedAt: time.Now()},
+		},
+	}
+
+	diff := local.Diff(remote)
+
+	assert.Equal(t, 1, len(diff.Files))
+	assert.False(t, diff.Files["1"].Deleted())
+}
+
+func TestPurgeDeleted(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	index := &Index{
+		Files: map[string]Sourcefile{
+			"1": Sourcefile{Key: "a", Hash: "123"},
+			"2": Sourcefile{Key: "b", Hash: "123", DeletedAt: now.Add(-48 * time.Hour)},
+			"3": Sourcefile{Key: "c", Hash: "123", DeletedAt: now.Add(-time.Hour)},
+			"4": Sourcefile{Key: "a", Hash: "123", DeletedAt: now.Add(-48 * time.Hour)},
+			"5": Sourcefile{Key: "e", Hash: "123", DeletedAt: now.Add(-24 * time.Hour)},
+			"6": Sourcefile{Key: "e", Hash: "123", DeletedAt: now.Add(-48 * time.Hour)},
+		},
+	}
+	mock := &mockStore{FailAfter: 99}
+
+	purged, err := PurgeDeleted(index, mock, 24*time.Hour, now)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2", "4", "5", "6"}, purged)
+	assert.Equal(t, []string{"b", "e"}, mock.Deleted)
+	assert.Equal(t, 2, len(index.Files))
+	assert.Contains(t, index.Files, "1")
+	assert.Contains(t, index.Files, "3")
+}
+
+func TestEncode_Deleted(t *testing.T) {
+	i := Index{
+		Files: map[string]Sourcefile{
+			"1/2/3": Sourcefile{
+				Key:       "a/b/c",
+				Hash:      "123",
+				DeletedAt: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+			},
+		},
+	}
+
+	out, _ := i.Encode()
+	assert.Equal(t, `files:
+    1/2/3:
+        key: a/b/c
+        hash: "123"
+        deleted_at: 2020-01-02T03:04:05Z
+`, out)
+
+	got, err := NewIndex(out)
+	assert.NoError(t, err)
+	assert.Equal(t, i.Files["1/2/3"].DeletedAt, got.Files["1/2/3"].DeletedAt)
+}
+
+func TestPurgeDeleted_Chunks(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	index := &Index{
+		Files: map[string]Sourcefile{
+			"1": Sourcefile{Key: "a", Hash: "123", Chunks: []string{"chunks/1", "chunks/2"}},
+			"2": Sourcefile{Key: "b", Hash: "456", Chunks: []string{"chunks/2", "chunks/3"}, DeletedAt: now.Add(-48 * time.Hour)},
+		},
+	}
+	mock := &mockStore{FailAfter: 99}
+
+	purged, err := PurgeDeleted(index, mock, 24*time.Hour, now)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2"}, purged)
+	assert.Equal(t, []string{"chunks/3"}, mock.Deleted)
+}
+
+// batchDeleter records each batch of keys that it is asked to delete, failing
+// the batch numbered 'fail'
+type batchDeleter struct {
+	batches [][]string
+	fail    int
+}
+
+func (d *batchDeleter) Delete(keys ...string) error {
+	d.batches = append(d.batches, keys)
+	if len(d.batches) == d.fail {
+		return errors.New("oops")
+	}
+
+	return nil
+}
+
+func TestPurgeDeleted_Batches(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	index := &Index{Files: map[string]Sourcefile{}}
+	for i := 0; i < 2500; i++ {
+		key := fmt.Sprintf("%04d", i)
+		index.Files[key] = Sourcefile{Key: key, Hash: key, DeletedAt: now.Add(-48 * time.Hour)}
+	}
+
+	store := &batchDeleter{fail: 2}
+	purged, err := PurgeDeleted(index, store, 24*time.Hour, now)
+
+	require.Error(t, err)
+	require.Equal(t, 3, len(store.batches))
+	assert.Equal(t, 1000, len(store.batches[0]))
+	assert.Equal(t, 1000, len(store.batches[1]))
+	assert.Equal(t, 500, len(store.batches[2]))
+
+	assert.Equal(t, 1500, len(purged))
+	assert.Equal(t, 1000, len(index.Files))
+	for _, key := range store.batches[1] {
+		assert.Contains(t, index.Files, key, "files whose objects weren't deleted are kept")
+	}
+}
@@ -0,0 +1,521 @@
+package s3backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	encryptionMagic   = "S3BE"
+	encryptionVersion = 1
+	encryptionKeySize = 32
+	saltSize          = 16
+	objectSaltSize    = 32
+	noncePrefixSize   = 7
+	segmentSize       = 64 * 1024
+	headerSize        = len(encryptionMagic) + 1 + saltSize + objectSaltSize + noncePrefixSize
+)
+
+var (
+	// objectKeyInfo binds the keys derived for each object to their use
+	objectKeyInfo = []byte("s3backup object key")
+	// nameKeyInfo binds the key that objects are named with to its use
+	nameKeyInfo = []byte("s3backup object name key")
+	// nameSalt is the salt used to derive the key that objects are named
+	// with from a passphrase, which must be the same in every backup
+	nameSalt = []byte("s3backup object names")
+)
+
+var (
+	// ErrNotEncrypted is returned when reading data that was not written with
+	// encryption turned on
+	ErrNotEncrypted = errors.New("data is not encrypted")
+)
+
+// EncryptionConfig defines how the contents of files are encrypted before they
+// are put in the store. Only one of Passphrase and KeyFile can be set.
+type EncryptionConfig struct {
+	// Passphrase that the encryption key is derived from
+	Passphrase string `yaml:"passphrase"`
+	// KeyFile is the location of a file containing a 32 byte key, either as
+	// raw bytes or hex encoded
+	KeyFile string `yaml:"key_file"`
+}
+
+// Enabled is true if encryption has been configured
+func (c EncryptionConfig) Enabled() bool {
+	return c.Passphrase != "" || c.KeyFile != ""
+}
+
+// Encryption encrypts and decrypts streams of data using AES-256-GCM. Data is
+// split in to segments that are each authenticated so that it can be streamed,
+// and the final segment is marked so that truncation is detected.
+//
+// Every stream starts with a header holding a salt, a random object salt and
+// a random nonce prefix. When the key comes from a passphrase, the salt is
+// used to derive it. Each stream is encrypted with its own key, derived from
+// that key and the object salt with HKDF, so nonces are never shared between
+// streams however many are written.
+//
+// Objects that are stored by their contents are named by an HMAC-SHA256 of
+// the hash of their contents rather than the hash itself, so that someone who
+// can list the store can't tell whether a file they know is backed up. Its key
+// is derived from the encryption key with HKDF. When the encryption key comes
+// from a passphrase, it is derived with a fixed salt for this so that the
+// names are the same in every backup.
+type Encryption struct {
+	passphrase []byte
+	key        []byte
+	salt       []byte
+	names      []byte
+
+	lock sync.Mutex
+	keys map[string][]byte
+}
+
+// NewEncryption creates the Encryption described by the config
+func NewEncryption(config EncryptionConfig) (*Encryption, error) {
+	if config.Passphrase != "" && config.KeyFile != "" {
+		return nil, errors.New("only one of passphrase and key file can be used for encryption")
+	}
+
+	e := &Encryption{
+		passphrase: []byte(config.Passphrase),
+		salt:       make([]byte, saltSize),
+		keys:       map[string][]byte{},
+	}
+
+	if config.KeyFile != "" {
+		key, err := readKeyFile(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		e.key = key
+	} else if config.Passphrase == "" {
+		return nil, errors.New("a passphrase or key file is needed for encryption")
+	}
+
+	if _, err := rand.Read(e.salt); err != nil {
+		return nil, err
+	}
+
+	master := e.key
+	if master == nil {
+		var err error
+		master, err = scrypt.Key(e.passphrase, nameSalt, 1<<15, 8, 1, encryptionKeySize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	e.names = make([]byte, encryptionKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, master, nil, nameKeyInfo), e.names); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// ObjectName creates the name of an object from 'sum', the SHA-256 hash of
+// its contents, that can only be made with the encryption key
+func (e *Encryption) ObjectName(sum []byte) string {
+	mac := hmac.New(sha256.New, e.names)
+	_, _ = mac.Write(sum)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func readKeyFile(p string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(p))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read key file: %w", err)
+	}
+
+	if len(data) == encryptionKeySize {
+		return data, nil
+	}
+
+	key, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("key file must contain %d bytes, either raw or hex encoded", encryptionKeySize)
+	}
+
+	return key, nil
+}
+
+// masterKey gets the key for a salt, deriving it from the passphrase if it
+// hasn't been used before
+func (e *Encryption) masterKey(salt []byte) ([]byte, error) {
+	if e.key != nil {
+		return e.key, nil
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if key, found := e.keys[string(salt)]; found {
+		return key, nil
+	}
+
+	key, err := scrypt.Key(e.passphrase, salt, 1<<15, 8, 1, encryptionKeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	e.keys[string(salt)] = key
+	return key, nil
+}
+
+// aead gets the cipher for a single stream, using a key derived from the key
+// for 'salt' and the stream's 'objectSalt'
+func (e *Encryption) aead(salt, objectSalt []byte) (cipher.AEAD, error) {
+	master, err := e.masterKey(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, encryptionKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, master, objectSalt, objectKeyInfo), key); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Encrypt returns a reader of the encrypted contents of 'r'
+func (e *Encryption) Encrypt(r io.Reader) (io.Reader, error) {
+	header := make([]byte, 0, headerSize)
+	header = append(header, encryptionMagic...)
+	header = append(header, encryptionVersion)
+	header = append(header, e.salt...)
+
+	random := make([]byte, objectSaltSize+noncePrefixSize)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	header = append(header, random...)
+	objectSalt, prefix := random[:objectSaltSize], random[objectSaltSize:]
+
+	a, err := e.aead(e.salt, objectSalt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptReader{
+		segments: newSegments(a, header, prefix),
+		src:      bufio.NewReaderSize(r, segmentSize),
+		buf:      header,
+	}, nil
+}
+
+// Decrypt returns a reader of the decrypted contents of 'r'. Reading will fail
+// if the data has been tampered with.
+func (e *Encryption) Decrypt(r io.Reader) (io.Reader, error) {
+	header, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := e.segments(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDecryptReader(s, r, -1), nil
+}
+
+// readHeader reads the header from the start of an encrypted stream
+func readHeader(r io.Reader) ([]byte, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNotEncrypted
+		}
+		return nil, err
+	}
+
+	if string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, ErrNotEncrypted
+	}
+	if header[len(encryptionMagic)] != encryptionVersion {
+		return nil, fmt.Errorf("unknown encryption version %d", header[len(encryptionMagic)])
+	}
+
+	return header, nil
+}
+
+// segments creates the segments of the stream that starts with 'header'
+func (e *Encryption) segments(header []byte) (*segments, error) {
+	salt := header[len(encryptionMagic)+1 : len(encryptionMagic)+1+saltSize]
+	objectSalt := header[len(encryptionMagic)+1+saltSize : len(encryptionMagic)+1+saltSize+objectSaltSize]
+	prefix := header[len(encryptionMagic)+1+saltSize+objectSaltSize:]
+
+	a, err := e.aead(salt, objectSalt)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSegments(a, header, prefix), nil
+}
+
+// segments seals and opens the numbered segments of a single stream
+type segments struct {
+	aead    cipher.AEAD
+	header  []byte
+	nonce   []byte
+	counter uint32
+}
+
+func newSegments(a cipher.AEAD, header, prefix []byte) *segments {
+	nonce := make([]byte, a.NonceSize())
+	copy(nonce, prefix)
+
+	return &segments{
+		aead:   a,
+		header: header,
+		nonce:  nonce,
+	}
+}
+
+func (s *segments) next(last bool) ([]byte, error) {
+	if s.counter == ^uint32(0) {
+		return nil, errors.New("too much data to encrypt")
+	}
+
+	binary.BigEndian.PutUint32(s.nonce[noncePrefixSize:], s.counter)
+	s.nonce[len(s.nonce)-1] = 0
+	if last {
+		s.nonce[len(s.nonce)-1] = 1
+	}
+	s.counter++
+
+	return s.nonce, nil
+}
+
+type encryptReader struct {
+	segments *segments
+	src      *bufio.Reader
+	buf      []byte
+	plain    []byte
+	done     bool
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.buf) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+
+		if e.plain == nil {
+			e.plain = make([]byte, segmentSize)
+		}
+
+		n, err := io.ReadFull(e.src, e.plain)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+
+		last := n < segmentSize
+		if !last {
+			if _, err := e.src.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+
+		nonce, err := e.segments.next(last)
+		if err != nil {
+			return 0, err
+		}
+
+		e.buf = e.segments.aead.Seal(e.buf[:0], nonce, e.plain[:n], e.segments.header)
+		e.done = last
+	}
+
+	n := copy(p, e.buf)
+	e.buf = e.buf[n:]
+	return n, nil
+}
+
+type decryptReader struct {
+	segments *segments
+	src      *bufio.Reader
+	buf      []byte
+	sealed   []byte
+	done     bool
+	// lastSegment is the number of the final segment of the stream, or -1 if
+	// it is found by reading to the end
+	lastSegment int64
+}
+
+func newDecryptReader(s *segments, r io.Reader, lastSegment int64) *decryptReader {
+	return &decryptReader{
+		segments:    s,
+		src:         bufio.NewReaderSize(r, segmentSize+s.aead.Overhead()),
+		lastSegment: lastSegment,
+	}
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		if d.sealed == nil {
+			d.sealed = make([]byte, segmentSize+d.segments.aead.Overhead())
+		}
+
+		n, err := io.ReadFull(d.src, d.sealed)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+
+		last := int64(d.segments.counter) == d.lastSegment
+		if d.lastSegment < 0 {
+			last = n < len(d.sealed)
+			if !last {
+				if _, err := d.src.Peek(1); err == io.EOF {
+					last = true
+				}
+			}
+		}
+
+		nonce, err := d.segments.next(last)
+		if err != nil {
+			return 0, err
+		}
+
+		d.buf, err = d.segments.aead.Open(d.buf[:0], nonce, d.sealed[:n], d.segments.header)
+		if err != nil {
+			return 0, fmt.Errorf("unable to decrypt data: %w", err)
+		}
+		d.done = last
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// EncryptedStore encrypts everything that is saved in to a store and decrypts
+// everything that is read back from it
+type EncryptedStore struct {
+	ObjectStore
+	Encryption *Encryption
+}
+
+// GetByKey retrieves and decrypts the data at a certain location in your store
+func (s *EncryptedStore) GetByKey(key string) (io.ReadCloser, error) {
+	r, err := s.ObjectStore.GetByKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	src := &sourceReader{r: r}
+	d, err := s.Encryption.Decrypt(src)
+	if err != nil {
+		_ = r.Close()
+		return nil, fmt.Errorf("unable to read %s: %w", key, src.decodeError(err))
+	}
+
+	return &readCloser{Reader: &decodedReader{r: d, src: src}, close: r.Close}, nil
+}
+
+// GetRange retrieves and decrypts 'length' bytes of the data at a certain
+// location in your store, starting at 'offset'. A negative length reads to the
+// end. Only the segments that hold the range are downloaded.
+func (s *EncryptedStore) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	info, err := s.ObjectStore.Head(key)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := s.ObjectStore.GetRange(key, 0, int64(headerSize))
+	if err != nil {
+		return nil, err
+	}
+	header, err := readHeader(h)
+	_ = h.Close()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", key, err)
+	}
+
+	segs, err := s.Encryption.segments(header)
+	if err != nil {
+		return nil, err
+	}
+
+	overhead := int64(segs.aead.Overhead())
+	sealedSize := int64(segmentSize) + overhead
+	body := info.Size - int64(headerSize)
+	count := (body + sealedSize - 1) / sealedSize
+	size := body - count*overhead
+	if body < overhead || size < 0 {
+		return nil, fmt.Errorf("unable to read %s: %w", key, errors.New("encrypted data is truncated"))
+	}
+
+	end := size
+	if length >= 0 && offset+length < end {
+		end = offset + length
+	}
+	if offset >= end {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	first := offset / segmentSize
+	last := (end - 1) / segmentSize
+	r, err := s.ObjectStore.GetRange(key, int64(headerSize)+first*sealedSize, (last-first+1)*sealedSize)
+	if err != nil {
+		return nil, err
+	}
+
+	segs.counter = uint32(first)
+	d := newDecryptReader(segs, r, count-1)
+	if _, err := io.CopyN(ioutil.Discard, d, offset-first*segmentSize); err != nil {
+		_ = r.Close()
+		return nil, fmt.Errorf("unable to read %s: %w", key, err)
+	}
+
+	return &readCloser{Reader: io.LimitReader(d, end-offset), close: r.Close}, nil
+}
+
+// Save encrypts the data and puts it at a location in your store
+func (s *EncryptedStore) Save(key string, data io.Reader) error {
+	r, err := s.Encryption.Encrypt(data)
+	if err != nil {
+		return err
+	}
+
+	return s.ObjectStore.Save(key, r)
+}
+
+// SaveIfMatch encrypts the data and puts it at a location in your store, as
+// long as the object there hasn't changed
+func (s *EncryptedStore) SaveIfMatch(key string, data io.Reader, etag string) (string, error) {
+	r, err := s.Encryption.Encrypt(data)
+	if err != nil {
+		return "", err
+	}
+
+	return s.ObjectStore.SaveIfMatch(key, r, etag)
+}
@@ -0,0 +1,251 @@
+package s3backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEncryption(t *testing.T) *Encryption {
+	dir, err := ioutil.TempDir("", "s3backup-key")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "key")
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte(hex.EncodeToString(randomData(1, 32))+"\n"), 0600))
+
+	e, err := NewEncryption(EncryptionConfig{KeyFile: keyFile})
+	require.NoError(t, err)
+
+	return e
+}
+
+func encryptAll(t *testing.T, e *Encryption, data []byte) []byte {
+	r, err := e.Encrypt(bytes.NewReader(data))
+	require.NoError(t, err)
+	encrypted, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	return encrypted
+}
+
+func decryptAll(e *Encryption, data []byte) ([]byte, error) {
+	r, err := e.Decrypt(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestEncryption_RoundTrip(t *testing.T) {
+	e := testEncryption(t)
+
+	for _, size := range []int{0, 1, segmentSize - 1, segmentSize, segmentSize + 1, 3*segmentSize + 100} {
+		data := randomData(int64(size), size)
+
+		encrypted := encryptAll(t, e, data)
+		if size > 32 {
+			assert.False(t, bytes.Contains(encrypted, data[:32]), "plaintext found for size %d", size)
+		}
+
+		decrypted, err := decryptAll(e, encrypted)
+		assert.NoError(t, err, "size %d", size)
+		assert.Equal(t, data, decrypted, "size %d", size)
+	}
+}
+
+func TestEncryption_Passphrase(t *testing.T) {
+	e, err := NewEncryption(EncryptionConfig{Passphrase: "secret"})
+	require.NoError(t, err)
+	other, err := NewEncryption(EncryptionConfig{Passphrase: "secret"})
+	require.NoError(t, err)
+	wrong, err := NewEncryption(EncryptionConfig{Passphrase: "wrong"})
+	require.NoError(t, err)
+
+	encrypted := encryptAll(t, e, []byte("some data"))
+
+	decrypted, err := decryptAll(other, encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, "some data", string(decrypted))
+
+	_, err = decryptAll(wrong, encrypted)
+	assert.Error(t, err)
+}
+
+func TestEncryption_DetectsTampering(t *testing.T) {
+	e := testEncryption(t)
+	data := randomData(1, 2*segmentSize+10)
+	encrypted := encryptAll(t, e, data)
+
+	modified := append([]byte{}, encrypted...)
+	modified[headerSize+10] ^= 1
+	_, err := decryptAll(e, modified)
+	assert.Error(t, err)
+
+	truncated := encrypted[:headerSize+2*(segmentSize+16)]
+	_, err = decryptAll(e, truncated)
+	assert.Error(t, err)
+
+	_, err = decryptAll(e, []byte("not encrypted at all, just some text"))
+	assert.Equal(t, ErrNotEncrypted, err)
+}
+
+func TestEncryption_KeyPerStream(t *testing.T) {
+	e := testEncryption(t)
+	first := encryptAll(t, e, []byte("same data"))
+	second := encryptAll(t, e, []byte("same data"))
+
+	a, err := e.segments(first[:headerSize])
+	require.NoError(t, err)
+	b, err := e.segments(second[:headerSize])
+	require.NoError(t, err)
+
+	nonce := make([]byte, a.aead.NonceSize())
+	assert.NotEqual(t,
+		a.aead.Seal(nil, nonce, []byte("same data"), nil),
+		b.aead.Seal(nil, nonce, []byte("same data"), nil),
+		"streams share a key",
+	)
+
+	header := append([]byte{}, first[:headerSize]...)
+	header[len(encryptionMagic)+1+saltSize] ^= 1
+	_, err = decryptAll(e, append(header, first[headerSize:]...))
+	assert.Error(t, err, "the object salt is needed to decrypt")
+}
+
+func TestEncryption_ObjectName(t *testing.T) {
+	e, err := NewEncryption(EncryptionConfig{Passphrase: "secret"})
+	require.NoError(t, err)
+	other, err := NewEncryption(EncryptionConfig{Passphrase: "secret"})
+	require.NoError(t, err)
+	wrong, err := NewEncryption(EncryptionConfig{Passphrase: "wrong"})
+	require.NoError(t, err)
+
+	sum := sha256.Sum256([]byte("some data"))
+	name := e.ObjectName(sum[:])
+	assert.Equal(t, name, other.ObjectName(sum[:]), "names are the same in every backup")
+	assert.NotEqual(t, name, wrong.ObjectName(sum[:]))
+	assert.NotEqual(t, name, testEncryption(t).ObjectName(sum[:]))
+	assert.NotContains(t, name, hex.EncodeToString(sum[:]))
+	assert.Len(t, name, 64)
+
+	key, err := ContentKey("root", hashOf("some data"), e)
+	require.NoError(t, err)
+	assert.Equal(t, "root/data/"+name, key)
+	assert.Equal(t, "root/chunks/"+name, ChunkKey("root", []byte("some data"), e))
+}
+
+func TestUploader_EncryptedChunkNames(t *testing.T) {
+	e := testEncryption(t)
+	data := randomData(5, 16*1024)
+	config := ChunkConfig{Enabled: true, MinFileSize: 1024, AverageSize: 1024}
+	local := &Index{Files: map[string]Sourcefile{
+		"a": Sourcefile{Key: "a", Hash: hashOf(string(data)), Size: int64(len(data))},
+	}}
+
+	mock := &mockStore{FailAfter: 999}
+	u := &Uploader{
+		Store: &EncryptedStore{ObjectStore: mock, Encryption: e},
+		GetFile: func(p string) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		},
+		ParallelLimit: 1,
+		Chunking:      config,
+		Encryption:    e,
+	}
+	updated, err := u.Upload(local, &Index{Files: map[string]Sourcefile{}})
+	require.NoError(t, err)
+
+	chunks := readChunks(t, data, config)
+	require.Equal(t, len(chunks), len(updated.Files["a"].Chunks))
+	for i, c := range chunks {
+		assert.Equal(t, ChunkKey("", c, e), updated.Files["a"].Chunks[i])
+		assert.NotContains(t, mock.Keys, ChunkKey("", c, nil))
+	}
+}
+
+func TestNewEncryption_BadConfig(t *testing.T) {
+	_, err := NewEncryption(EncryptionConfig{})
+	assert.Error(t, err)
+
+	_, err = NewEncryption(EncryptionConfig{Passphrase: "a", KeyFile: "b"})
+	assert.Error(t, err)
+
+	_, err = NewEncryption(EncryptionConfig{KeyFile: "does-not-exist"})
+	assert.Error(t, err)
+}
+
+func TestEncryptedStore(t *testing.T) {
+	mock := &mockStore{FailAfter: 99}
+	store := &EncryptedStore{ObjectStore: mock, Encryption: testEncryption(t)}
+
+	require.NoError(t, store.Save("a", bytes.NewBufferString("file 1")))
+	assert.NotContains(t, mock.Values[0], "file 1")
+
+	r, err := store.GetByKey("a")
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "file 1", string(got))
+
+	require.NoError(t, store.Delete("a"))
+	assert.Equal(t, []string{"a"}, mock.Deleted)
+}
+
+func TestEncryptedStore_GetRange(t *testing.T) {
+	mock := &mockStore{FailAfter: 99}
+	store := &EncryptedStore{ObjectStore: mock, Encryption: testEncryption(t)}
+
+	data := randomData(4, 3*segmentSize+100)
+	require.NoError(t, store.Save("a", bytes.NewReader(data)))
+
+	for _, tc := range []struct {
+		offset, length int64
+	}{
+		{0, 10},
+		{10, segmentSize},
+		{segmentSize - 1, 2},
+		{segmentSize, segmentSize},
+		{2*segmentSize + 50, -1},
+		{3 * segmentSize, 100},
+		{3*segmentSize + 90, 1000},
+		{0, -1},
+	} {
+		r, err := store.GetRange("a", tc.offset, tc.length)
+		require.NoError(t, err)
+		got, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.NoError(t, r.Close())
+
+		end := int64(len(data))
+		if tc.length >= 0 && tc.offset+tc.length < end {
+			end = tc.offset + tc.length
+		}
+		assert.Equal(t, data[tc.offset:end], got, "%d-%d", tc.offset, tc.length)
+	}
+
+	exact := randomData(5, 2*segmentSize)
+	require.NoError(t, store.Save("exact", bytes.NewReader(exact)))
+	r, err := store.GetRange("exact", segmentSize+1, -1)
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, exact[segmentSize+1:], got)
+
+	r, err = store.GetRange("a", int64(len(data)), 10)
+	require.NoError(t, err)
+	got, _ = ioutil.ReadAll(r)
+	assert.Empty(t, got)
+
+	require.NoError(t, mock.Save("plain", bytes.NewBufferString("not encrypted at all, but long enough")))
+	_, err = store.GetRange("plain", 0, 5)
+	assert.True(t, errors.Is(err, ErrNotEncrypted))
+}
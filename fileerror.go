@@ -0,0 +1,196 @@
+package s3backup
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+)
+
+const (
+	// PolicySkip leaves a file out of the backup without saying so
+	PolicySkip = "skip"
+	// PolicyWarn leaves a file out of the backup and lists it once the
+	// backup has finished
+	PolicyWarn = "warn"
+	// PolicyFail stops the backup
+	PolicyFail = "fail"
+)
+
+// ErrFileChanged is returned when a file is changed while it is being
+// uploaded, so what was uploaded doesn't match the hash in the index
+var ErrFileChanged = errors.New("file changed while it was being uploaded")
+
+// FileErrorConfig decides what happens to files that can't be backed up as
+// they were found, because they have been deleted, can't be read or are
+// being changed. Each is one of PolicySkip, PolicyWarn or PolicyFail. Files
+// that are left out of the index are tried again by the next backup.
+type FileErrorConfig struct {
+	// Missing is the policy for files that are deleted after they are found
+	Missing string `yaml:"missing"`
+	// PermissionDenied is the policy for files and directories that can't be
+	// read
+	PermissionDenied string `yaml:"permission_denied"`
+	// Changed is the policy for files that are changed while they are being
+	// uploaded. Files are only checked for changes when this is set.
+	Changed string `yaml:"changed"`
+}
+
+// Validate checks that each of the policies is one that is known
+func (c FileErrorConfig) Validate() error {
+	for _, policy := range []string{c.Missing, c.PermissionDenied, c.Changed} {
+		switch policy {
+		case "", PolicySkip, PolicyWarn, PolicyFail:
+		default:
+			return fmt.Errorf("unknown file error policy %s", policy)
+		}
+	}
+
+	return nil
+}
+
+// policy finds the policy for an error with a file, errors that aren't
+// covered by a policy stop the backup
+func (c FileErrorConfig) policy(err error) string {
+	policy := ""
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		policy = c.Missing
+	case errors.Is(err, os.ErrPermission):
+		policy = c.PermissionDenied
+	case errors.Is(err, ErrFileChanged):
+		policy = c.Changed
+	}
+
+	if policy == "" {
+		return PolicyFail
+	}
+
+	return policy
+}
+
+// handle decides what to do about a problem with the file at 'p', which is at
+// 'indexPath' in the index. It returns nil if the file should be left out and
+// the backup carry on, otherwise it returns the error so that the backup
+// stops.
+func (c FileErrorConfig) handle(p, indexPath string, err error, skipped *SkipLog) error {
+	switch c.policy(err) {
+	case PolicySkip:
+		doLog("Skipping %s: %s\n", p, err)
+		skipped.Add(p, indexPath, err, false)
+		return nil
+	case PolicyWarn:
+		doLog("Skipping %s: %s\n", p, err)
+		skipped.Add(p, indexPath, err, true)
+		return nil
+	}
+
+	return err
+}
+
+// verifyingReader hashes everything that is read through it and, once the
+// end of the file is reached, returns ErrFileChanged in place of io.EOF if the
+// hash isn't 'hash'. Stores read to the end before they commit an object, so
+// a file that changed is never saved.
+type verifyingReader struct {
+	r    io.Reader
+	h    hash.Hash
+	hash string
+	path string
+}
+
+func (v *verifyingReader) Read(b []byte) (int, error) {
+	n, err := v.r.Read(b)
+	v.h.Write(b[:n])
+	if err == io.EOF && encodeHash(v.h) != v.hash {
+		return n, fmt.Errorf("%s: %w", v.path, ErrFileChanged)
+	}
+
+	return n, err
+}
+
+// SkippedFile is a file or directory that was left out of a backup
+type SkippedFile struct {
+	// Path is where the file is on the local disk
+	Path string
+	// IndexPath is where the file, or everything in the directory, is in
+	// the index
+	IndexPath string
+	Err       error
+	// Warn is true if the file should be listed once the backup has finished
+	Warn bool
+}
+
+// SkipLog records the files that are left out of a backup, so that they can
+// be listed once it has finished and aren't taken to have been deleted. It is
+// safe to use from many goroutines, and nothing is recorded if it is nil.
+type SkipLog struct {
+	lock  sync.Mutex
+	files []SkippedFile
+}
+
+// Add records that the file at 'p', which is at 'indexPath' in the index, was
+// left out because of 'err'. It is listed at the end of the backup if 'warn'
+// is set.
+func (l *SkipLog) Add(p, indexPath string, err error, warn bool) {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.files = append(l.files, SkippedFile{Path: p, IndexPath: indexPath, Err: err, Warn: warn})
+}
+
+// Merge records everything that was left out in 'other', which was
+// recorded with index paths relative to 'dir'
+func (l *SkipLog) Merge(other *SkipLog, dir string) {
+	for _, f := range other.all() {
+		l.Add(f.Path, path.Join(dir, f.IndexPath), f.Err, f.Warn)
+	}
+}
+
+// Files lists the files that have been left out with PolicyWarn, in order of
+// path
+func (l *SkipLog) Files() []SkippedFile {
+	files := []SkippedFile{}
+	for _, f := range l.all() {
+		if f.Warn {
+			files = append(files, f)
+		}
+	}
+
+	return files
+}
+
+// IndexPaths lists where in the index every file and directory that has been
+// left out is, whatever its policy
+func (l *SkipLog) IndexPaths() []string {
+	paths := []string{}
+	for _, f := range l.all() {
+		paths = append(paths, f.IndexPath)
+	}
+
+	return paths
+}
+
+func (l *SkipLog) all() []SkippedFile {
+	if l == nil {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	files := append([]SkippedFile{}, l.files...)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+
+	return files
+}
@@ -0,0 +1,123 @@
+package s3backup
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// IndexFilter selects entries from an Index. An entry is selected if it matches
+// any of the globs, directory prefixes or hashes. An empty filter selects
+// everything.
+type IndexFilter struct {
+	// Globs are shell patterns matched against the whole file path, where
+	// '**' matches any number of directories
+	Globs []string
+	// Prefixes are directories that all files below are selected from
+	Prefixes []string
+	// Hashes are the exact hashes of file contents
+	Hashes []string
+}
+
+// Empty is true if the filter has nothing to select on
+func (f IndexFilter) Empty() bool {
+	return len(f.Globs) == 0 && len(f.Prefixes) == 0 && len(f.Hashes) == 0
+}
+
+// Validate checks that all of the globs in the filter are well formed
+func (f IndexFilter) Validate() error {
+	for _, g := range f.Globs {
+		for _, part := range strings.Split(g, "/") {
+			if _, err := path.Match(part, ""); err != nil {
+				return fmt.Errorf("invalid pattern %s: %w", g, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Match returns true if the file at 'p' should be selected
+func (f IndexFilter) Match(p string, src Sourcefile) bool {
+	if f.Empty() {
+		return true
+	}
+
+	p = normalisePath(p)
+	for _, g := range f.Globs {
+		if matchGlob(path.Clean(normalisePath(g)), p) {
+			return true
+		}
+	}
+
+	for _, prefix := range f.Prefixes {
+		prefix = path.Clean(normalisePath(prefix))
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+
+	for _, h := range f.Hashes {
+		if src.Hash == h {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Filter creates a new Index containing only the entries selected by the filter
+func (i *Index) Filter(f IndexFilter) (*Index, error) {
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+
+	result := &Index{
+		Files: map[string]Sourcefile{},
+	}
+	for p, src := range i.Files {
+		if f.Match(p, src) {
+			result.Add(p, src)
+		}
+	}
+
+	return result, nil
+}
+
+// matchGlob reports whether the slash separated name matches the shell pattern.
+// As well as the syntax understood by path.Match, a '**' element will match
+// zero or more directories.
+func matchGlob(pattern, name string) bool {
+	return matchGlobParts(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchGlobParts(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				return true
+			}
+
+			for i := range name {
+				if matchGlobParts(pattern, name[i:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
@@ -0,0 +1,97 @@
+package s3backup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"a/b/c", "a/b/c", true},
+		{"a/*/c", "a/b/c", true},
+		{"a/*", "a/b/c", false},
+		{"a/**", "a/b/c", true},
+		{"a/**", "a", true},
+		{"a/**/c", "a/c", true},
+		{"a/**/c", "a/b/x/c", true},
+		{"a/**/c", "a/b/x/d", false},
+		{"**/*.jpg", "photos/2023/img.jpg", true},
+		{"**/*.jpg", "img.jpg", true},
+		{"**/*.jpg", "img.png", false},
+		{"photos/202?/**", "photos/2023/img.jpg", true},
+		{"photos/202[0-2]/**", "photos/2023/img.jpg", false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.match, matchGlob(tt.pattern, tt.name), "%s matching %s", tt.pattern, tt.name)
+	}
+}
+
+func testFilterIndex() *Index {
+	return &Index{
+		Files: map[string]Sourcefile{
+			"photos/2022/a.jpg":     Sourcefile{Key: "a", Hash: "111"},
+			"photos/2023/b.jpg":     Sourcefile{Key: "b", Hash: "222"},
+			"photos/2023/raw/c.raw": Sourcefile{Key: "c", Hash: "333"},
+			"photos-old/d.jpg":      Sourcefile{Key: "d", Hash: "444"},
+			"docs/e.txt":            Sourcefile{Key: "e", Hash: "555"},
+		},
+	}
+}
+
+func TestIndexFilter_Empty(t *testing.T) {
+	got, err := testFilterIndex().Filter(IndexFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, len(got.Files))
+}
+
+func TestIndexFilter_Glob(t *testing.T) {
+	got, err := testFilterIndex().Filter(IndexFilter{Globs: []string{"photos/2023/**"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(got.Files))
+	assert.Contains(t, got.Files, "photos/2023/b.jpg")
+	assert.Contains(t, got.Files, "photos/2023/raw/c.raw")
+
+	got, err = testFilterIndex().Filter(IndexFilter{Globs: []string{"**/*.jpg"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(got.Files))
+}
+
+func TestIndexFilter_Prefix(t *testing.T) {
+	got, err := testFilterIndex().Filter(IndexFilter{Prefixes: []string{"photos/"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(got.Files))
+	assert.NotContains(t, got.Files, "photos-old/d.jpg")
+
+	got, err = testFilterIndex().Filter(IndexFilter{Prefixes: []string{"docs/e.txt"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(got.Files))
+}
+
+func TestIndexFilter_Hash(t *testing.T) {
+	got, err := testFilterIndex().Filter(IndexFilter{Hashes: []string{"444", "999"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(got.Files))
+	assert.Equal(t, "d", got.Files["photos-old/d.jpg"].Key)
+}
+
+func TestIndexFilter_Combined(t *testing.T) {
+	got, err := testFilterIndex().Filter(IndexFilter{
+		Globs:    []string{"docs/*"},
+		Prefixes: []string{"photos/2022"},
+		Hashes:   []string{"444"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(got.Files))
+}
+
+func TestIndexFilter_BadPattern(t *testing.T) {
+	got, err := testFilterIndex().Filter(IndexFilter{Globs: []string{"photos/[a-"}})
+	assert.Error(t, err)
+	assert.Nil(t, got)
+}
@@ -0,0 +1,264 @@
+package s3backup
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// IgnoreFile is the name of the file in each directory that lists the
+	// files in that directory that should not be backed up
+	IgnoreFile = ".s3backupignore"
+)
+
+// DefaultExcludes are the files that this tool creates itself, which are never
+// backed up unless they are included in the config
+var DefaultExcludes = []string{
+	indexFile,
+	".s3backup.yaml",
+	".s3backup.yaml.tmp",
+	"*" + restoreSuffix,
+}
+
+// IgnoreConfig defines which files are left out of the backup using gitignore
+// style patterns. A pattern without a '/' matches the name of a file or
+// directory at any depth, otherwise it matches the path from the scan root. A
+// pattern ending in '/' only matches directories.
+type IgnoreConfig struct {
+	// Exclude are patterns of files that are not backed up
+	Exclude []string `yaml:"exclude"`
+	// Include are patterns of files that are backed up even though they match
+	// an exclude pattern
+	Include []string `yaml:"include"`
+}
+
+// Validate checks that all of the patterns are well formed
+func (c IgnoreConfig) Validate() error {
+	for _, p := range append(append([]string{}, c.Exclude...), c.Include...) {
+		if _, _, err := parseIgnoreRule(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ignoreRule is a single gitignore style pattern
+type ignoreRule struct {
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// parseIgnoreRule reads a line from an ignore file, returning false if it is
+// blank or a comment
+func parseIgnoreRule(line string) (ignoreRule, bool, error) {
+	r := ignoreRule{}
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return r, false, nil
+	}
+
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	if strings.HasPrefix(line, "/") {
+		r.anchored = true
+		line = strings.TrimLeft(line, "/")
+	}
+
+	if line == "" {
+		return r, false, nil
+	}
+
+	r.anchored = r.anchored || strings.Contains(line, "/")
+	r.pattern = line
+
+	for _, part := range strings.Split(line, "/") {
+		if _, err := path.Match(part, ""); err != nil {
+			return r, true, fmt.Errorf("invalid pattern %s: %w", line, err)
+		}
+	}
+
+	return r, true, nil
+}
+
+// match is true if the slash separated path 'rel', relative to the directory
+// that the rule came from, matches the rule
+func (r ignoreRule) match(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+
+	if r.anchored {
+		return matchGlob(r.pattern, rel)
+	}
+
+	return matchGlob(r.pattern, path.Base(rel))
+}
+
+// Ignorer decides which files are left out of a backup while walking a
+// directory tree. Patterns from the config are checked first and then the
+// patterns from the IgnoreFile in each directory, from the root down, with
+// the last pattern that matches deciding whether a file is ignored.
+type Ignorer struct {
+	rules []ignoreRule
+	dirs  map[string][]ignoreRule
+}
+
+// NewIgnorer creates an Ignorer from the patterns in the config, as well as
+// the DefaultExcludes
+func NewIgnorer(config IgnoreConfig) (*Ignorer, error) {
+	ig := &Ignorer{
+		dirs: map[string][]ignoreRule{},
+	}
+
+	for _, p := range append(append([]string{}, DefaultExcludes...), config.Exclude...) {
+		if err := ig.addRule(p, false); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, p := range config.Include {
+		if err := ig.addRule(p, true); err != nil {
+			return nil, err
+		}
+	}
+
+	return ig, nil
+}
+
+func (ig *Ignorer) addRule(p string, negate bool) error {
+	r, ok, err := parseIgnoreRule(p)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		r.negate = r.negate != negate
+		ig.rules = append(ig.rules, r)
+	}
+
+	return nil
+}
+
+// Walk wraps a WalkFunc so that it is only called for files that are not
+// ignored. Ignored directories are skipped without walking their contents.
+func (ig *Ignorer) Walk(root string, walk filepath.WalkFunc) filepath.WalkFunc {
+	ig.dirs = map[string][]ignoreRule{}
+	root = filepath.Clean(root)
+
+	return func(p string, f os.FileInfo, err error) error {
+		if err != nil {
+			return walk(p, f, err)
+		}
+
+		if filepath.Clean(p) != root && ig.Ignored(root, p, f.IsDir()) {
+			doLog("Ignoring %s", p)
+			if f.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if f.IsDir() {
+			if err := ig.readIgnoreFile(filepath.Clean(p)); err != nil {
+				return err
+			}
+		}
+
+		return walk(p, f, err)
+	}
+}
+
+// Ignored is true if the path 'p' below 'root' should not be backed up. Only
+// the IgnoreFiles of directories that have already been walked are used.
+func (ig *Ignorer) Ignored(root, p string, isDir bool) bool {
+	root, p = filepath.Clean(root), filepath.Clean(p)
+
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	ignored := ig.check(ig.rules, filepath.ToSlash(rel), isDir, false)
+
+	dirs := []string{}
+	for d := filepath.Dir(p); ; d = filepath.Dir(d) {
+		dirs = append(dirs, d)
+		if d == root || d == filepath.Dir(d) {
+			break
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rules, found := ig.dirs[dirs[i]]
+		if !found {
+			continue
+		}
+
+		rel, err := filepath.Rel(dirs[i], p)
+		if err != nil {
+			continue
+		}
+		ignored = ig.check(rules, filepath.ToSlash(rel), isDir, ignored)
+	}
+
+	return ignored
+}
+
+func (ig *Ignorer) check(rules []ignoreRule, rel string, isDir, ignored bool) bool {
+	for _, r := range rules {
+		if r.match(rel, isDir) {
+			ignored = !r.negate
+		}
+	}
+
+	return ignored
+}
+
+// readIgnoreFile loads the patterns from the IgnoreFile in a directory, if
+// there is one
+func (ig *Ignorer) readIgnoreFile(dir string) error {
+	f, err := os.Open(filepath.Join(dir, IgnoreFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("unable to read ignore file: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	rules := []ignoreRule{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		r, ok, err := parseIgnoreRule(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("unable to read %s: %w", filepath.Join(dir, IgnoreFile), err)
+		}
+
+		if ok {
+			rules = append(rules, r)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("unable to read ignore file: %w", err)
+	}
+
+	ig.dirs[dir] = rules
+	return nil
+}
@@ -0,0 +1,166 @@
+package s3backup
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIgnoreRule(t *testing.T) {
+	tests := []struct {
+		line string
+		ok   bool
+		rule ignoreRule
+	}{
+		{line: "", ok: false},
+		{line: "# comment", ok: false},
+		{line: "*.swp", ok: true, rule: ignoreRule{pattern: "*.swp"}},
+		{line: "!keep.swp", ok: true, rule: ignoreRule{pattern: "keep.swp", negate: true}},
+		{line: "node_modules/", ok: true, rule: ignoreRule{pattern: "node_modules", dirOnly: true}},
+		{line: "/build", ok: true, rule: ignoreRule{pattern: "build", anchored: true}},
+		{line: "docs/**/*.tmp", ok: true, rule: ignoreRule{pattern: "docs/**/*.tmp", anchored: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			rule, ok, err := parseIgnoreRule(tt.line)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.ok, ok)
+			if ok {
+				assert.Equal(t, tt.rule, rule)
+			}
+		})
+	}
+
+	_, _, err := parseIgnoreRule("[a-")
+	assert.Error(t, err)
+}
+
+func TestIgnorer_Ignored(t *testing.T) {
+	ig, err := NewIgnorer(IgnoreConfig{
+		Exclude: []string{"*.swp", "node_modules/", "/build", "docs/**/*.tmp"},
+		Include: []string{"keep.swp"},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{path: "root/a.txt", ignored: false},
+		{path: "root/dir/a.swp", ignored: true},
+		{path: "root/dir/keep.swp", ignored: false},
+		{path: "root/web/node_modules", isDir: true, ignored: true},
+		{path: "root/node_modules", isDir: false, ignored: false},
+		{path: "root/build", isDir: true, ignored: true},
+		{path: "root/src/build", isDir: true, ignored: false},
+		{path: "root/docs/a/b/c.tmp", ignored: true},
+		{path: "root/.s3backup.yaml", ignored: true},
+		{path: "root/.index.yaml", ignored: true},
+		{path: "root/photo.jpg" + restoreSuffix, ignored: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.ignored, ig.Ignored("root", filepath.FromSlash(tt.path), tt.isDir))
+		})
+	}
+}
+
+func TestScanner_Ignore(t *testing.T) {
+	root := createTestTree(t, map[string]string{
+		"a.txt":                      "a",
+		".DS_Store":                  "junk",
+		".s3backup.yaml":             "files: {}",
+		"web/index.html":             "html",
+		"web/node_modules/lib/x.js":  "js",
+		"web/" + IgnoreFile:          "*.log\n!keep.log\n/dist/\n",
+		"web/debug.log":              "log",
+		"web/keep.log":               "log",
+		"web/dist/app.js":            "js",
+		"web/src/dist/app.js":        "js",
+		"other/debug.log":            "log",
+		"photos/" + IgnoreFile:       "# nothing\n\n",
+		"photos/2020/beach.jpg":      "jpg",
+		"photos/2020/beach.jpg.swp":  "swp",
+		"photos/2020/" + IgnoreFile:  "!*.swp\n",
+		"photos/2021/party.jpg.swp~": "swp",
+	})
+	defer os.RemoveAll(root)
+
+	ig, err := NewIgnorer(IgnoreConfig{Exclude: []string{".DS_Store", "node_modules/", "*.swp"}})
+	require.NoError(t, err)
+
+	visited := []string{}
+	s := &Scanner{
+		Walker: func(bucketRoot, dir string, index *Index) filepath.WalkFunc {
+			walk := FilePathWalker(bucketRoot, dir, index)
+			return func(p string, f os.FileInfo, err error) error {
+				visited = append(visited, p)
+				return walk(p, f, err)
+			}
+		},
+		Hasher:  FileHasher,
+		Workers: 2,
+		Ignore:  ig,
+	}
+	index, err := s.Scan("", root)
+	require.NoError(t, err)
+
+	found := []string{}
+	for p := range index.Files {
+		found = append(found, p)
+	}
+	sort.Strings(found)
+
+	assert.Equal(t, []string{
+		"a.txt",
+		"other/debug.log",
+		"photos/.s3backupignore",
+		"photos/2020/.s3backupignore",
+		"photos/2020/beach.jpg",
+		"photos/2020/beach.jpg.swp",
+		"photos/2021/party.jpg.swp~",
+		"web/.s3backupignore",
+		"web/index.html",
+		"web/keep.log",
+		"web/src/dist/app.js",
+	}, found)
+
+	for _, p := range visited {
+		assert.NotContains(t, p, "node_modules", "ignored directories are not walked")
+	}
+}
+
+func TestScanner_BadIgnoreFile(t *testing.T) {
+	root := createTestTree(t, map[string]string{
+		"a.txt":    "a",
+		IgnoreFile: "[a-\n",
+	})
+	defer os.RemoveAll(root)
+
+	ig, err := NewIgnorer(IgnoreConfig{})
+	require.NoError(t, err)
+
+	s := &Scanner{Walker: FilePathWalker, Hasher: FileHasher, Workers: 1, Ignore: ig}
+	_, err = s.Scan("", root)
+
+	assert.Error(t, err)
+}
+
+func TestIgnorer_UnreadableIgnoreFile(t *testing.T) {
+	root := createTestTree(t, map[string]string{})
+	defer os.RemoveAll(root)
+	require.NoError(t, os.Mkdir(filepath.Join(root, IgnoreFile), 0755))
+
+	ig, err := NewIgnorer(IgnoreConfig{})
+	require.NoError(t, err)
+
+	err = ig.readIgnoreFile(root)
+	assert.Error(t, err)
+}
@@ -1,17 +1,22 @@
 package s3backup
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"hash"
 	"io"
-	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/dnnrly/s3backup/storage"
 	"golang.org/x/sync/errgroup"
 	"gopkg.in/yaml.v3"
 )
@@ -31,11 +36,45 @@ type Sourcefile struct {
 	Key string `yaml:"key"`
 	// Hash is the hashed value of the file contents
 	Hash string `yaml:"hash"`
+	// Size is the size of the file contents in bytes
+	Size int64 `yaml:"size,omitempty"`
+	// Chunks are the keys of the pieces that the file contents have been split
+	// in to, in order. Each key is made from the hash of the chunk contents. If
+	// there are no chunks then the file contents are stored at Key.
+	Chunks []string `yaml:"chunks,omitempty"`
+	// Codec is how the file contents were compressed when they were stored
+	Codec string `yaml:"codec,omitempty"`
+	// DeletedAt is when the file was found to be deleted locally
+	DeletedAt time.Time `yaml:"deleted_at,omitempty"`
+	// Path is where the file was found on the local disk, it is not saved in
+	// the index
+	Path string `yaml:"-"`
 }
 
+// Deleted is true if the file has been deleted locally
+func (s Sourcefile) Deleted() bool {
+	return !s.DeletedAt.IsZero()
+}
+
+// localPath is where the file at index path 'p' can be read from the local disk
+func (s Sourcefile) localPath(p string) string {
+	if s.Path != "" {
+		return s.Path
+	}
+
+	return p
+}
+
+// IndexVersion is the version of the index format that is written
+const IndexVersion = 1
+
 // Index holds all of the metadata for files backed up
 type Index struct {
-	// Files maps the local file location to its metadata
+	// Version of the index format, indexes written before versions were
+	// added have version 0
+	Version int `yaml:"version,omitempty"`
+	// Files maps the location of each file relative to the directory that it
+	// was backed up from to its metadata
 	Files map[string]Sourcefile `yaml:"files"`
 }
 
@@ -53,7 +92,8 @@ func NewIndex(buf string) (*Index, error) {
 // CopyIndex creates an Index from Yaml
 func CopyIndex(from *Index) *Index {
 	to := &Index{
-		Files: map[string]Sourcefile{},
+		Version: from.Version,
+		Files:   map[string]Sourcefile{},
 	}
 	for k, v := range from.Files {
 		to.Add(k, v)
@@ -99,18 +139,42 @@ func (i *Index) GetNextN(n int) *Index {
 	return result
 }
 
+// Sample picks n entries at random from the index, using rnd as the source of
+// randomness
+func (i *Index) Sample(n int, rnd *rand.Rand) *Index {
+	result := &Index{
+		Files: map[string]Sourcefile{},
+	}
+
+	paths := make([]string, 0, len(i.Files))
+	for f := range i.Files {
+		paths = append(paths, f)
+	}
+	sort.Strings(paths)
+
+	if n > len(paths) {
+		n = len(paths)
+	}
+
+	for _, p := range rnd.Perm(len(paths))[:n] {
+		result.Add(paths[p], i.Files[paths[p]])
+	}
+
+	return result
+}
+
 // Diff finds all entries in this Index that do not exist or are different from
 // the remote entry.
 func (local *Index) Diff(remote *Index) *Index {
 	diff := &Index{Files: map[string]Sourcefile{}}
 
 	for f, v := range local.Files {
-		if _, found := remote.Files[f]; !found {
-			log.Printf("Found missing file %s\n", f)
+		if r, found := remote.Files[f]; !found || r.Deleted() {
+			doLog("Found missing file %s\n", f)
 			diff.Files[f] = v
 		} else {
 			if v.Hash != remote.Files[f].Hash {
-				log.Printf("Found updated file %s\n", f)
+				doLog("Found updated file %s\n", f)
 				diff.Files[f] = v
 			}
 		}
@@ -122,33 +186,55 @@ func (local *Index) Diff(remote *Index) *Index {
 // PathHasher is a function that will hash the file at 'path' location
 type PathHasher func(path string) (string, error)
 
-// PathWalker is a function that can walk a directory tree and populate the Index
-// that is passed in
-type PathWalker func(root string, index *Index, hasher PathHasher) filepath.WalkFunc
+// PathWalker is a function that can walk the directory tree at 'dir' and
+// populate the Index that is passed in. The files are hashed once the walk has
+// finished.
+type PathWalker func(bucketRoot, dir string, index *Index) filepath.WalkFunc
 
 // FilePathWalker is a PathWalker that accesses files on the disk when walking a
-// directory tree
-func FilePathWalker(root string, index *Index, hasher PathHasher) filepath.WalkFunc {
-	return func(path string, f os.FileInfo, err error) error {
+// directory tree. Files are added to the index by their path relative to 'dir'
+// and their keys are made from the same path.
+func FilePathWalker(bucketRoot, dir string, index *Index) filepath.WalkFunc {
+	return func(p string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
 		if !f.IsDir() {
-			doLog("Add in file to index: %s", path)
-			key := normalisePath(path)
-			if root != "" {
-				key = fmt.Sprintf("%s/%s", root, key)
-			}
-			hash, errHash := hasher(path)
+			doLog("Add in file to index: %s", p)
+			rel, err := relativePath(dir, p)
 			if err != nil {
-				return errHash
+				return err
+			}
+
+			key := rel
+			if bucketRoot != "" {
+				key = fmt.Sprintf("%s/%s", bucketRoot, key)
 			}
-			index.Files[path] = Sourcefile{
+			index.Files[rel] = Sourcefile{
 				Key:  key,
-				Hash: hash,
+				Size: f.Size(),
+				Path: p,
 			}
 		}
-		return err
+		return nil
 	}
 }
 
+// relativePath finds the slash separated path of 'p' from the directory 'dir'
+func relativePath(dir, p string) (string, error) {
+	rel, err := filepath.Rel(dir, p)
+	if err != nil {
+		return "", fmt.Errorf("unable to find %s in %s: %w", p, dir, err)
+	}
+
+	if rel == "." {
+		rel = filepath.Base(p)
+	}
+
+	return normalisePath(filepath.ToSlash(rel)), nil
+}
+
 func normalisePath(path string) string {
 	parts := strings.Split(path, "\\")
 	return strings.Join(parts, "/")
@@ -156,15 +242,30 @@ func normalisePath(path string) string {
 
 // FileHasher returns a hash of the contents of a file
 func FileHasher(path string) (string, error) {
-	contents, err := ioutil.ReadFile(filepath.Clean(path))
+	f, err := os.Open(filepath.Clean(path))
 	if err != nil {
 		return "", err
 	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	return HashReader(f)
+}
+
+// HashReader returns a hash of everything that can be read from 'r', without
+// holding it all in memory
+func HashReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
 
-	h := sha256.Sum256(contents)
-	hash := base64.StdEncoding.EncodeToString(h[:])
+	return encodeHash(h), nil
+}
 
-	return hash, nil
+func encodeHash(h hash.Hash) string {
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
 }
 
 // NewIndexFromRoot creates a new Index populated from a filesystem directory
@@ -174,16 +275,13 @@ func NewIndexFromRoot(
 	walker PathWalker,
 	hasher PathHasher,
 ) (*Index, error) {
-	i := &Index{
-		Files: map[string]Sourcefile{},
+	s := &Scanner{
+		Walker:  walker,
+		Hasher:  hasher,
+		Workers: DefaultHashWorkers,
 	}
 
-	err := filepath.Walk(path, walker(bucketRoot, i, hasher))
-	if err != nil {
-		return nil, err
-	}
-
-	return i, nil
+	return s.Scan(bucketRoot, path)
 }
 
 func doLog(format string, args ...interface{}) {
@@ -192,138 +290,535 @@ func doLog(format string, args ...interface{}) {
 	}
 }
 
+// ObjectInfo describes an object in a store without its contents
+type ObjectInfo = storage.ObjectInfo
+
 // FileRepository allows you to access files in your remote location
 type FileRepository interface {
-	// GetByKey retrieves the data at a certain location in your store
-	GetByKey(key string) (io.Reader, error)
+	// GetByKey retrieves the data at a certain location in your store. The
+	// data is streamed and the reader must be closed.
+	GetByKey(key string) (io.ReadCloser, error)
+	// GetRange retrieves 'length' bytes of the data at a certain location in
+	// your store, starting at 'offset'. A negative length reads to the end.
+	GetRange(key string, offset, length int64) (io.ReadCloser, error)
 	// Save puts the data at a location in your store
 	Save(key string, data io.Reader) error
+	// List calls 'fn' for every object with a key that starts with 'prefix',
+	// in order of key. The objects are fetched a page at a time so that the
+	// whole listing is never held in memory. Listing stops at the first error
+	// returned by 'fn'.
+	List(prefix string, fn func(ObjectInfo) error) error
+	// Head retrieves the details of the object at a certain location without
+	// its contents. If there is nothing at that location then the error will
+	// match os.ErrNotExist.
+	Head(key string) (ObjectInfo, error)
+	// Copy puts a copy of the object at 'from' at the location 'to', without
+	// downloading it where the store allows
+	Copy(from, to string) error
+	ObjectDeleter
 }
 
-// FileGetter allows you to get the contents of a file
-type FileGetter func(p string) io.ReadCloser
+// FileGetter allows you to get the contents of a file. If the file has gone
+// then the error should match os.ErrNotExist, and if it can't be read it
+// should match os.ErrPermission.
+type FileGetter func(p string) (io.ReadCloser, error)
 
 // IndexStore allows you to persist indexed objects
 type IndexStore interface {
 	// Save an indexed object to the specified location
 	Save(key string, data io.Reader) error
+	// SaveIfMatch saves an object to the specified location only if the
+	// object there still has the ETag 'etag', or if there is no object there
+	// when 'etag' is empty. If the object has changed then the error will
+	// match ErrConflict. It returns the ETag of the saved object.
+	SaveIfMatch(key string, data io.Reader, etag string) (string, error)
 }
 
-// Limiter object for limiting concurrency of go routines
-type Limiter struct {
-	done chan bool
-	jobs chan int
+// ObjectDeleter allows you to remove objects from your remote location
+type ObjectDeleter interface {
+	// Delete removes the data at each of the locations in your store, in as
+	// few requests as possible. Locations that are already empty are ignored.
+	Delete(keys ...string) error
 }
 
-//parallelLimiter helps you create a channel used to limit parallel file uploads
-func parallelLimiter(parallelLimit int) *Limiter {
-	limiter := &Limiter{
-		done: make(chan bool),
-		jobs: make(chan int, parallelLimit),
-	}
+// ObjectStore is a remote location that objects can be read from, saved to,
+// listed and deleted from
+type ObjectStore interface {
+	FileRepository
+	// SaveIfMatch saves an object to the specified location only if it
+	// hasn't changed, in the same way as IndexStore
+	SaveIfMatch(key string, data io.Reader, etag string) (string, error)
+}
+
+// SaveIndex writes the index to its default location in the store
+func SaveIndex(index *Index, store IndexStore) error {
+	return SaveIndexAs(index, store, indexFile)
+}
 
-	for i := 0; i < parallelLimit; i++ {
-		limiter.jobs <- i
+// SaveIndexAs writes the index to the location 'key' in the store
+func SaveIndexAs(index *Index, store IndexStore, key string) error {
+	r, err := index.Encode()
+	if err != nil {
+		return err
 	}
 
-	return limiter
+	doLog("Uploading index as %s\n", key)
+	return store.Save(key, strings.NewReader(r))
 }
 
-// Makes batches of local files to be uploaded
-func makeBatch(files *Index, batchSize int) [][]string {
-	var chunks [][]string
-	keySlice := make([]string, 0, len(files.Files))
+// Uploader sends the files that are missing from the remote index to the store
+type Uploader struct {
+	// Store is where files and the index are saved
+	Store IndexStore
+	// GetFile opens the local files to be uploaded
+	GetFile FileGetter
+	// ParallelLimit is the most files that will be uploaded at the same time
+	ParallelLimit int
+	// BatchSize is the number of files uploaded between each save of the index
+	BatchSize int
+	// BucketRoot is the location in the store that chunks are saved under
+	BucketRoot string
+	// Chunking controls how large files are split in to chunks
+	Chunking ChunkConfig
+	// Compression controls how files are compressed before they are stored
+	Compression CompressionConfig
+	// IndexKey is the location in the store that the index is saved to, the
+	// default location is used if this is empty
+	IndexKey string
+	// Lock is the lock held on the index. When it is set the index is only
+	// saved while the lock is still held, and to the location it was taken
+	// for rather than IndexKey.
+	Lock *Lock
+	// Remote is the index in the store that is being updated. When it is set
+	// the index is only saved if nobody else has changed it, otherwise their
+	// changes are merged in first. It is saved to its own location rather
+	// than IndexKey.
+	Remote *RemoteIndex
+	// Journal records each file as soon as it has been uploaded. Uploads left
+	// in it by a backup that was stopped are added to the remote index before
+	// anything is uploaded, and it is cleared once they have all been saved.
+	Journal *Journal
+	// Retry controls how uploads that fail for a reason that may not last are
+	// tried again, by opening the local file again and sending it from the
+	// start
+	Retry RetryConfig
+	// ContinueOnError carries on uploading the rest of the files when one
+	// can't be uploaded. The files that failed are left out of the index, so
+	// that the next backup tries them again, and are returned in an
+	// UploadError.
+	ContinueOnError bool
+	// FileErrors decides what happens to files that disappear, can't be read
+	// or are changed after they were scanned. Files that are skipped are left
+	// out of the index. The upload stops if there is no policy for the
+	// problem, or carries on if ContinueOnError is set.
+	FileErrors FileErrorConfig
+	// Skipped records the files that are left out of the index with
+	// PolicyWarn
+	Skipped *SkipLog
+	// Progress is told about the files as they are queued and uploaded
+	Progress Reporter
+	// Encryption names the chunks of files, so that their keys don't give
+	// away their contents. It should be the Encryption used by the store.
+	Encryption *Encryption
+	// Abort is closed to stop the uploads that are in progress, such as when
+	// they take too long to finish after the context is cancelled. The index
+	// is still saved with the files that had finished.
+	Abort <-chan struct{}
+
+	chunks *chunkSet
+}
+
+// FailedUpload is a file that could not be uploaded
+type FailedUpload struct {
+	Path string
+	Err  error
+}
+
+// UploadError is returned when some of the files could not be uploaded but
+// the rest were, and have been saved in the index
+type UploadError struct {
+	// Failed are the files that could not be uploaded, in order of path
+	Failed []FailedUpload
+}
 
-	for key := range files.Files {
-		keySlice = append(keySlice, key)
+func (e *UploadError) Error() string {
+	return fmt.Sprintf(
+		"unable to upload %d files, including %s: %s",
+		len(e.Failed),
+		e.Failed[0].Path,
+		e.Failed[0].Err,
+	)
+}
+
+// lock is the lock held on the index, if there is one
+func (u *Uploader) lock() *Lock {
+	if u.Remote != nil && u.Remote.Lock != nil {
+		return u.Remote.Lock
 	}
 
-	for i := 0; i < len(keySlice); i += batchSize {
-		end := i + batchSize
+	return u.Lock
+}
+
+func (u *Uploader) saveIndex(index *Index) error {
+	switch {
+	case u.Remote != nil:
+		return u.Remote.Save(index)
+	case u.Lock != nil:
+		return u.Lock.SaveIndex(index)
+	case u.IndexKey == "":
+		return SaveIndex(index, u.Store)
+	default:
+		return SaveIndexAs(index, u.Store, u.IndexKey)
+	}
+}
 
-		// necessary check to avoid slicing beyond
-		// slice capacity
-		if end > len(keySlice) {
-			end = len(keySlice)
+// saveFile puts the contents of a single file in the store, compressing it and
+// splitting it in to chunks as configured. What the store reads is counted by
+// 'sent'.
+func (u *Uploader) saveFile(p string, src Sourcefile, r io.Reader, sent *sentCounter) (Sourcefile, error) {
+	src.Chunks = nil
+	src.Codec = u.Compression.CodecFor(p, src.Size)
+	if !u.Chunking.Enabled || src.Size < u.Chunking.MinFileSize {
+		c, err := compress(src.Codec, sent.reader(r))
+		if err != nil {
+			return src, err
 		}
+		defer func() {
+			_ = c.Close()
+		}()
 
-		chunks = append(chunks, keySlice[i:end])
+		return src, u.Store.Save(src.Key, c)
 	}
 
-	return chunks
-}
+	chunks, err := u.saveChunks(src.Codec, r, sent)
+	if err != nil {
+		return src, err
+	}
 
-// This uploads batches given by UploadDifferences. The files in the batch are uploaded in parallel
-func UploadBatch(diffFiles *Index, batchHash []string, toUpload *Index, store IndexStore, limiter *Limiter, batchSize int, getFile FileGetter) error {
+	src.Chunks = chunks
+	return src, nil
+}
 
-	routineGroup := new(errgroup.Group)
+// Upload will upload the files that are missing from the remote index. Files
+// whose contents are already stored under the same key are added to the index
+// without being uploaded again. It returns the remote index updated with the
+// files that have been uploaded.
+func (u *Uploader) Upload(localIndex, remoteIndex *Index) (*Index, error) {
+	return u.UploadContext(context.Background(), localIndex, remoteIndex)
+}
 
-	uploadIndex := func() error {
-		r, _ := toUpload.Encode()
-		doLog("Uploading index as %s\n", indexFile)
-		err := store.Save(indexFile, bytes.NewBufferString(r))
+// UploadContext uploads the files that are missing from the remote index in
+// the same way as Upload. Files are uploaded by a pool of ParallelLimit
+// workers and the index is saved after every BatchSize files, without waiting
+// for the uploads that are still going. Cancelling the context stops any more
+// uploads from starting. The uploads in progress are allowed to finish, unless
+// Abort is closed, and the index is saved, then it is returned along with the
+// context's error.
+//
+// When ContinueOnError is set the index is returned along with an
+// UploadError if some of the files could not be uploaded.
+func (u *Uploader) UploadContext(ctx context.Context, localIndex, remoteIndex *Index) (*Index, error) {
+	replayed := 0
+	if u.Journal != nil {
+		remoteIndex = CopyIndex(remoteIndex)
+		n, err := u.Journal.Replay(remoteIndex)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		return nil
+		if n > 0 {
+			doLog("Found %d files uploaded by an earlier backup in the journal\n", n)
+		}
+		replayed = n
 	}
 
-	go func() {
-		for i := 0; i < batchSize; i++ {
-			<-limiter.done
-			limiter.jobs <- i
+	diff := localIndex.Diff(remoteIndex)
+	toUpload := CopyIndex(remoteIndex)
+	u.chunks = newChunkSet(remoteIndex)
+
+	existing, duplicates := dedupe(diff, remoteIndex)
+	for f, v := range existing {
+		toUpload.Add(f, v)
+	}
+
+	queued := int64(0)
+	for _, v := range diff.Files {
+		queued += v.Size
+	}
+	u.progress().Queued(len(diff.Files), queued)
+
+	uploaded, failed, err := u.uploadAll(ctx, diff, toUpload)
+	if err != nil && ctx.Err() != nil {
+		return u.saveInterrupted(toUpload, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	batchSize := u.batchSize()
+	if uploaded%batchSize != 0 || len(existing) > 0 || len(duplicates) > 0 || replayed > 0 {
+		keys := map[string]Sourcefile{}
+		for _, v := range toUpload.Files {
+			keys[v.Key] = v
+		}
+		for f, v := range duplicates {
+			stored, found := keys[v.Key]
+			if !found {
+				failed = append(failed, FailedUpload{
+					Path: f,
+					Err:  fmt.Errorf("has the same contents as %s, which could not be uploaded", v.Key),
+				})
+				u.progress().Failed(f, failed[len(failed)-1].Err)
+				continue
+			}
+			v.Chunks = stored.Chunks
+			v.Codec = stored.Codec
+			toUpload.Add(f, v)
 		}
-	}()
 
-	for _, fileHash := range batchHash {
-		p, srcFile := fileHash, diffFiles.Files[fileHash] // https://golang.org/doc/faq#closures_and_goroutines
+		if err := u.saveIndex(toUpload); err != nil {
+			return nil, err
+		}
+	}
+
+	if u.Journal != nil {
+		if err := u.Journal.Clear(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(failed) > 0 {
+		sort.Slice(failed, func(i, j int) bool {
+			return failed[i].Path < failed[j].Path
+		})
+		return toUpload, &UploadError{Failed: failed}
+	}
+
+	return toUpload, nil
+}
 
-		<-limiter.jobs
+// saveInterrupted saves the files that were uploaded before the context was
+// cancelled, returning the index along with the error that stopped it
+func (u *Uploader) saveInterrupted(toUpload *Index, err error) (*Index, error) {
+	doLog("Upload interrupted, saving the index of the files uploaded so far\n")
+	if saveErr := u.saveIndex(toUpload); saveErr != nil {
+		return nil, fmt.Errorf("unable to save index after upload was interrupted: %w", saveErr)
+	}
+
+	if u.Journal != nil {
+		if clearErr := u.Journal.Clear(); clearErr != nil {
+			return nil, clearErr
+		}
+	}
+
+	return toUpload, err
+}
+
+// uploaded is a file that has been put in the store by one of the workers
+type uploaded struct {
+	path string
+	src  Sourcefile
+	err  error
+}
+
+// uploadAll puts every file in 'diff' in the store. One goroutine hands out
+// the files to a pool of workers and the results are added to 'toUpload' by
+// the calling goroutine alone, saving the index after every batch. It returns
+// the number of files uploaded and, when ContinueOnError is set, the files
+// that could not be.
+func (u *Uploader) uploadAll(ctx context.Context, diff, toUpload *Index) (int, []FailedUpload, error) {
+	workers := u.ParallelLimit
+	if workers < 1 {
+		workers = 1
+	}
+	batchSize := u.batchSize()
+
+	toSend := make([]string, 0, len(diff.Files))
+	for p := range diff.Files {
+		toSend = append(toSend, p)
+	}
+	sort.Strings(toSend)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	routineGroup, ctx := errgroup.WithContext(ctx)
+	paths := make(chan string)
+	results := make(chan uploaded, workers)
+
+	routineGroup.Go(func() error {
+		defer close(paths)
+		for _, p := range toSend {
+			select {
+			case paths <- p:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+
+	// the lock can be lost between saves, so stop uploading as soon as it is
+	// rather than finding out at the next save
+	stopped := make(chan struct{})
+	if lock := u.lock(); lock != nil {
 		routineGroup.Go(func() error {
-			r := getFile(p)
-			defer func() {
-				_ = r.Close()
-				limiter.done <- true
-			}()
-
-			doLog("Uploading %s as %s\n", p, srcFile.Key)
-			err := store.Save(srcFile.Key, r)
-			if err != nil {
-				return err
+			select {
+			case <-lock.Lost():
+				return lock.Err()
+			case <-stopped:
+				return nil
+			}
+		})
+	}
+
+	running := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		running.Add(1)
+		routineGroup.Go(func() error {
+			defer running.Done()
+			for p := range paths {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+
+				src, err := u.uploadFile(ctx, p, diff.Files[p])
+				if err != nil && u.FileErrors.handle(diff.Files[p].localPath(p), p, err, u.Skipped) == nil {
+					u.progress().Failed(diff.Files[p].localPath(p), err)
+					continue
+				}
+				if err != nil && !u.ContinueOnError {
+					return err
+				}
+
+				// the results are read until every worker has stopped, so
+				// nothing that has been uploaded is lost
+				results <- uploaded{path: p, src: src, err: err}
 			}
-			toUpload.Add(p, srcFile)
 			return nil
 		})
 	}
 
-	if err := routineGroup.Wait(); err == nil {
-		uploadErr := uploadIndex()
-		if uploadErr != nil {
+	go func() {
+		running.Wait()
+		close(stopped)
+		close(results)
+	}()
+
+	count := 0
+	failed := []FailedUpload{}
+	var saveErr error
+	for r := range results {
+		if r.err != nil {
+			doLog("Unable to upload %s: %s\n", r.path, r.err)
+			failed = append(failed, FailedUpload{Path: r.path, Err: r.err})
+			u.progress().Failed(r.path, r.err)
+			continue
+		}
+
+		toUpload.Add(r.path, r.src)
+		u.progress().Uploaded(r.path, r.src.Size)
+		count++
+
+		if count%batchSize == 0 && saveErr == nil {
+			if saveErr = u.saveIndex(toUpload); saveErr != nil {
+				cancel()
+			}
+		}
+	}
+
+	if err := routineGroup.Wait(); err != nil && saveErr == nil {
+		return count, failed, err
+	}
+
+	return count, failed, saveErr
+}
+
+// uploadFile puts a single local file in the store, trying again from the
+// start if it fails for a reason that may not last, until the context is
+// cancelled. When there is a policy
+// for changed files, what is read is checked against the hash found by the
+// scan before the store sees the end of the file, so that a changed file
+// fails the save instead of replacing what is stored.
+func (u *Uploader) uploadFile(ctx context.Context, p string, src Sourcefile) (Sourcefile, error) {
+	var result Sourcefile
+	sent := &sentCounter{reporter: u.progress()}
+	err := u.Retry.Retry(ctx, "uploading "+p, func() error {
+		sent.reset()
+
+		f, err := u.GetFile(src.localPath(p))
+		if err != nil {
 			return err
 		}
-	} else {
+		defer func() {
+			_ = f.Close()
+		}()
+
+		var r io.Reader = f
+		if u.Abort != nil {
+			r = &abortReader{r: r, abort: u.Abort}
+		}
+		if u.FileErrors.Changed != "" {
+			r = &verifyingReader{r: r, h: sha256.New(), hash: src.Hash, path: src.localPath(p)}
+		}
+
+		doLog("Uploading %s as %s\n", p, src.Key)
+		result, err = u.saveFile(p, src, r, sent)
 		return err
+	})
+	if err != nil {
+		return result, err
 	}
 
-	return nil
+	if u.Journal != nil {
+		if err := u.Journal.Record(p, result); err != nil {
+			return result, err
+		}
+	}
 
+	return result, nil
 }
 
-// UploadDifferences will upload the files that are missing from the remote index
-func UploadDifferences(localIndex, remoteIndex *Index, parallelLimit int, batchSize int, store IndexStore, getFile FileGetter) error {
-	diff := localIndex.Diff(remoteIndex)
-	toUpload := CopyIndex(remoteIndex)
-	limiter := parallelLimiter(parallelLimit)
+// errAborted is the error from uploads that are stopped by Uploader.Abort
+var errAborted = fmt.Errorf("upload stopped before it finished: %w", context.Canceled)
 
-	batches := makeBatch(diff, batchSize)
+// abortReader stops reading once 'abort' is closed, so that the store gives
+// up on the upload
+type abortReader struct {
+	r     io.Reader
+	abort <-chan struct{}
+}
 
-	for _, batch := range batches {
-		err := UploadBatch(diff, batch, toUpload, store, limiter, batchSize, getFile)
-		if err != nil {
-			return err
-		}
+func (a *abortReader) Read(b []byte) (int, error) {
+	select {
+	case <-a.abort:
+		return 0, errAborted
+	default:
+	}
+
+	return a.r.Read(b)
+}
+
+func (u *Uploader) progress() Reporter {
+	return reporterOr(u.Progress)
+}
+
+func (u *Uploader) batchSize() int {
+	if u.BatchSize < 1 {
+		return 1
+	}
+
+	return u.BatchSize
+}
 
+// UploadDifferences will upload the files that are missing from the remote index.
+// It returns the remote index updated with the files that have been uploaded.
+func UploadDifferences(localIndex, remoteIndex *Index, parallelLimit int, batchSize int, store IndexStore, getFile FileGetter) (*Index, error) {
+	u := &Uploader{
+		Store:         store,
+		GetFile:       getFile,
+		ParallelLimit: parallelLimit,
+		BatchSize:     batchSize,
 	}
 
-	return nil
+	return u.Upload(localIndex, remoteIndex)
 }
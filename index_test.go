@@ -2,13 +2,24 @@ package s3backup
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"os"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/dnnrly/s3backup/memory"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewIndex(t *testing.T) {
@@ -128,26 +139,156 @@ func TestIndexGetNextN_None(t *testing.T) {
 	assert.Equal(t, 0, len(got.GetNextN(1).Files))
 }
 
+func TestIndexSample(t *testing.T) {
+	index := &Index{
+		Files: map[string]Sourcefile{
+			"1": Sourcefile{Key: "a", Hash: "321"},
+			"2": Sourcefile{Key: "b", Hash: "123"},
+			"3": Sourcefile{Key: "c", Hash: "123"},
+			"4": Sourcefile{Key: "d", Hash: "123"},
+		},
+	}
+
+	got := index.Sample(2, rand.New(rand.NewSource(1)))
+	assert.Equal(t, 2, len(got.Files))
+	for f := range got.Files {
+		assert.Equal(t, index.Files[f], got.Files[f])
+	}
+
+	same := index.Sample(2, rand.New(rand.NewSource(1)))
+	assert.Equal(t, got, same)
+
+	assert.Equal(t, 4, len(index.Sample(10, rand.New(rand.NewSource(1))).Files))
+}
+
 type mockStore struct {
 	Keys      []string
 	Values    []string
+	Deleted   []string
 	FailAfter int
+
+	lock sync.Mutex
 }
 
 func (m *mockStore) Save(key string, data io.Reader) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
 	if len(m.Keys) >= m.FailAfter {
 		return errors.New("oops")
 	}
 
-	m.Keys = append(m.Keys, key)
-
 	buf := new(bytes.Buffer)
-	buf.ReadFrom(data)
+	if _, err := buf.ReadFrom(data); err != nil {
+		return err
+	}
+
+	m.Keys = append(m.Keys, key)
 	m.Values = append(m.Values, buf.String())
 
 	return nil
 }
 
+func (m *mockStore) SaveIfMatch(key string, data io.Reader, etag string) (string, error) {
+	info, err := m.Head(key)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.ETag != etag {
+		return "", fmt.Errorf("%s: %w", key, ErrConflict)
+	}
+
+	b, _ := ioutil.ReadAll(data)
+	if err := m.Save(key, bytes.NewReader(b)); err != nil {
+		return "", err
+	}
+
+	return hashOf(string(b)), nil
+}
+
+func (m *mockStore) Delete(keys ...string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.Deleted = append(m.Deleted, keys...)
+	return nil
+}
+
+func (m *mockStore) List(prefix string, fn func(ObjectInfo) error) error {
+	m.lock.Lock()
+	keys := []string{}
+	for _, k := range m.Keys {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	m.lock.Unlock()
+	sort.Strings(keys)
+
+	for i, k := range keys {
+		if i > 0 && keys[i-1] == k {
+			continue
+		}
+
+		info, err := m.Head(k)
+		if err != nil {
+			return err
+		}
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *mockStore) Head(key string) (ObjectInfo, error) {
+	r, err := m.GetByKey(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	data, _ := ioutil.ReadAll(r)
+	return ObjectInfo{Key: key, Size: int64(len(data)), ETag: hashOf(string(data))}, nil
+}
+
+func (m *mockStore) Copy(from, to string) error {
+	r, err := m.GetByKey(from)
+	if err != nil {
+		return err
+	}
+
+	return m.Save(to, r)
+}
+
+func (m *mockStore) GetByKey(key string) (io.ReadCloser, error) {
+	return m.GetRange(key, 0, -1)
+}
+
+func (m *mockStore) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for i := len(m.Keys) - 1; i >= 0; i-- {
+		if m.Keys[i] == key {
+			data := m.Values[i]
+			if offset > int64(len(data)) {
+				offset = int64(len(data))
+			}
+			data = data[offset:]
+			if length >= 0 && length < int64(len(data)) {
+				data = data[:length]
+			}
+			return ioutil.NopCloser(strings.NewReader(data)), nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s: %w", key, os.ErrNotExist)
+}
+
 func TestUploadDifferences(t *testing.T) {
 	index := &Index{
 		Files: map[string]Sourcefile{
@@ -165,20 +306,26 @@ func TestUploadDifferences(t *testing.T) {
 		},
 	}
 
-	getter := func(p string) io.ReadCloser {
+	getter := func(p string) (io.ReadCloser, error) {
 		s := strings.NewReader("")
 		c := ioutil.NopCloser(s)
-		return c
+		return c, nil
 	}
 
 	mock := &mockStore{
 		Keys:      []string{},
 		FailAfter: 99,
 	}
-	err := UploadDifferences(index, &Index{}, 4, 5, mock, getter)
+	_, err := UploadDifferences(index, &Index{}, 4, 5, mock, getter)
 
 	assert.Equal(t, 11, len(mock.Keys))
-	assert.Equal(t, ".index.yaml", mock.Keys[5])
+	saves := 0
+	for _, k := range mock.Keys {
+		if k == ".index.yaml" {
+			saves++
+		}
+	}
+	assert.Equal(t, 2, saves, "saved after the first 5 files and at the end")
 	assert.Equal(t, ".index.yaml", mock.Keys[10])
 	assert.NoError(t, err)
 }
@@ -198,17 +345,17 @@ func TestUploadDifferences_ObjectSaveFails(t *testing.T) {
 		},
 	}
 
-	getter := func(p string) io.ReadCloser {
+	getter := func(p string) (io.ReadCloser, error) {
 		s := strings.NewReader("")
 		c := ioutil.NopCloser(s)
-		return c
+		return c, nil
 	}
 
 	mock := &mockStore{
 		Keys:      []string{},
 		FailAfter: 5,
 	}
-	err := UploadDifferences(index, &Index{}, 4, 5, mock, getter)
+	_, err := UploadDifferences(index, &Index{}, 4, 5, mock, getter)
 
 	assert.Equal(t, 5, len(mock.Keys))
 	assert.Error(t, err)
@@ -229,19 +376,19 @@ func TestUploadDifferences_IndexSaveFails(t *testing.T) {
 		},
 	}
 
-	getter := func(p string) io.ReadCloser {
+	getter := func(p string) (io.ReadCloser, error) {
 		s := strings.NewReader("")
 		c := ioutil.NopCloser(s)
-		return c
+		return c, nil
 	}
 
 	mock := &mockStore{
 		Keys:      []string{},
-		FailAfter: 5,
+		FailAfter: 4,
 	}
-	err := UploadDifferences(index, &Index{}, 4, 5, mock, getter)
-	assert.Equal(t, 5, len(mock.Keys))
-	assert.NotContains(t, ".index.yaml", mock.Keys)
+	_, err := UploadDifferences(index, &Index{}, 4, 5, mock, getter)
+	assert.Equal(t, 4, len(mock.Keys))
+	assert.NotContains(t, mock.Keys, ".index.yaml")
 	assert.Error(t, err)
 }
 
@@ -249,3 +396,289 @@ func TestNormalisePath(t *testing.T) {
 	assert.Equal(t, "a/b/c", normalisePath("a/b/c"))
 	assert.Equal(t, "a/b/c", normalisePath("a\\b\\c"))
 }
+
+func TestUploader_ReadsFromLocalPath(t *testing.T) {
+	local := &Index{
+		Files: map[string]Sourcefile{
+			"a": Sourcefile{Key: "a", Hash: hashOf("file /src/a"), Path: "/src/a"},
+		},
+	}
+
+	opened := []string{}
+	mock := &mockStore{FailAfter: 99}
+	_, err := UploadDifferences(local, &Index{Files: map[string]Sourcefile{}}, 1, 1, mock, func(p string) (io.ReadCloser, error) {
+		opened = append(opened, p)
+		return ioutil.NopCloser(bytes.NewBufferString("file " + p)), nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/src/a"}, opened)
+	assert.Contains(t, mock.Keys, "a")
+}
+
+// slowStore counts the uploads running at the same time and can hold up saves
+// of the index until it is released
+type slowStore struct {
+	*mockStore
+	running     int32
+	maxRunning  int32
+	uploads     int32
+	holdIndex   chan struct{}
+	indexWaited chan struct{}
+}
+
+func newSlowStore() *slowStore {
+	return &slowStore{
+		mockStore:   &mockStore{FailAfter: 999},
+		holdIndex:   make(chan struct{}),
+		indexWaited: make(chan struct{}, 100),
+	}
+}
+
+func (s *slowStore) Save(key string, data io.Reader) error {
+	if key == indexFile {
+		s.indexWaited <- struct{}{}
+		<-s.holdIndex
+		return s.mockStore.Save(key, data)
+	}
+
+	n := atomic.AddInt32(&s.running, 1)
+	defer atomic.AddInt32(&s.running, -1)
+	for {
+		max := atomic.LoadInt32(&s.maxRunning)
+		if n <= max || atomic.CompareAndSwapInt32(&s.maxRunning, max, n) {
+			break
+		}
+	}
+
+	time.Sleep(time.Millisecond)
+	atomic.AddInt32(&s.uploads, 1)
+	return s.mockStore.Save(key, data)
+}
+
+func uploadTestIndex(n int) *Index {
+	index := &Index{Files: map[string]Sourcefile{}}
+	for i := 0; i < n; i++ {
+		p := fmt.Sprintf("file-%03d", i)
+		index.Add(p, Sourcefile{Key: p, Hash: hashOf(p)})
+	}
+
+	return index
+}
+
+func emptyGetter(p string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader("")), nil
+}
+
+func TestUploader_BoundedWorkers(t *testing.T) {
+	store := newSlowStore()
+	close(store.holdIndex)
+	u := &Uploader{Store: store, GetFile: emptyGetter, ParallelLimit: 3, BatchSize: 7}
+
+	updated, err := u.Upload(uploadTestIndex(40), &Index{Files: map[string]Sourcefile{}})
+
+	require.NoError(t, err)
+	assert.Equal(t, 40, len(updated.Files))
+	assert.Equal(t, int32(40), store.uploads)
+	assert.True(t, store.maxRunning <= 3, "%d uploads at once", store.maxRunning)
+	assert.Equal(t, 6, len(store.indexWaited), "saved after every 7 files and at the end")
+}
+
+func TestUploader_KeepsUploadingWhileSavingIndex(t *testing.T) {
+	store := newSlowStore()
+	u := &Uploader{Store: store, GetFile: emptyGetter, ParallelLimit: 2, BatchSize: 1}
+
+	done := make(chan error)
+	go func() {
+		_, err := u.Upload(uploadTestIndex(4), &Index{Files: map[string]Sourcefile{}})
+		done <- err
+	}()
+
+	<-store.indexWaited
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&store.uploads) == 4
+	}, time.Second, time.Millisecond, "uploads stopped while the index was saved")
+
+	close(store.holdIndex)
+	assert.NoError(t, <-done)
+}
+
+func TestUploader_Cancel(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	store := newSlowStore()
+	close(store.holdIndex)
+	ctx, cancel := context.WithCancel(context.Background())
+	u := &Uploader{
+		Store: store,
+		GetFile: func(p string) (io.ReadCloser, error) {
+			if p == "file-010" {
+				cancel()
+			}
+			return emptyGetter(p)
+		},
+		ParallelLimit: 2,
+		BatchSize:     5,
+	}
+
+	updated, err := u.UploadContext(ctx, uploadTestIndex(100), &Index{Files: map[string]Sourcefile{}})
+
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.True(t, atomic.LoadInt32(&store.uploads) < 20, "%d files uploaded after cancelling", store.uploads)
+
+	require.NotNil(t, updated)
+	assert.Equal(t, int(store.uploads), len(updated.Files), "uploads in progress are finished and kept")
+	assert.Contains(t, updated.Files, "file-010")
+	assert.Equal(t, indexFile, store.Keys[len(store.Keys)-1])
+	saved, err := NewIndex(store.Values[len(store.Values)-1])
+	require.NoError(t, err)
+	assert.Equal(t, updated, saved)
+
+	assertNoLeaks(t, before)
+}
+
+// endlessReader never reaches the end of its data
+type endlessReader struct{}
+
+func (endlessReader) Read(b []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return len(b), nil
+}
+
+func TestUploader_Abort(t *testing.T) {
+	store := memory.NewStore()
+	local := &Index{Files: map[string]Sourcefile{
+		"fast": Sourcefile{Key: "fast", Hash: "1"},
+		"slow": Sourcefile{Key: "slow", Hash: "2"},
+	}}
+
+	started := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	abort := make(chan struct{})
+	u := &Uploader{
+		Store: store,
+		GetFile: func(p string) (io.ReadCloser, error) {
+			if p == "slow" {
+				close(started)
+				return ioutil.NopCloser(endlessReader{}), nil
+			}
+			return ioutil.NopCloser(strings.NewReader("fast")), nil
+		},
+		ParallelLimit: 2,
+		BatchSize:     10,
+		Abort:         abort,
+	}
+
+	go func() {
+		<-started
+		assert.Eventually(t, func() bool {
+			_, err := store.Head("fast")
+			return err == nil
+		}, time.Second, time.Millisecond)
+		cancel()
+		close(abort)
+	}()
+	updated, err := u.UploadContext(ctx, local, &Index{Files: map[string]Sourcefile{}})
+
+	assert.True(t, errors.Is(err, context.Canceled), "%v", err)
+	require.NotNil(t, updated)
+	assert.Equal(t, []string{"fast"}, paths(updated))
+	saved, err := NewIndex(readKey(t, store, indexFile))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"fast"}, paths(saved), "the index is saved with the uploads that finished")
+	_, err = store.Head("slow")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+func TestUploader_SaveIndexFailureStopsUploads(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	store := &mockStore{FailAfter: 5}
+	u := &Uploader{Store: store, GetFile: emptyGetter, ParallelLimit: 1, BatchSize: 5}
+
+	_, err := u.Upload(uploadTestIndex(50), &Index{Files: map[string]Sourcefile{}})
+
+	assert.Error(t, err)
+	assert.Equal(t, 5, len(store.Keys))
+	assertNoLeaks(t, before)
+}
+
+// assertNoLeaks waits for the number of goroutines to go back down to what it
+// was before the test
+func assertNoLeaks(t *testing.T, before int) {
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.True(t, runtime.NumGoroutine() <= before, "%d goroutines leaked", runtime.NumGoroutine()-before)
+}
+
+func TestUploader_FileErrors(t *testing.T) {
+	local := uploadTestIndex(4)
+	getter := func(p string) (io.ReadCloser, error) {
+		switch p {
+		case "file-001":
+			return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+		case "file-002":
+			return ioutil.NopCloser(strings.NewReader("changed")), nil
+		}
+		return ioutil.NopCloser(strings.NewReader(p)), nil
+	}
+	skipped := &SkipLog{}
+	store := &mockStore{FailAfter: 99}
+	u := &Uploader{
+		Store:         store,
+		GetFile:       getter,
+		ParallelLimit: 2,
+		BatchSize:     2,
+		FileErrors:    FileErrorConfig{Missing: PolicyWarn, Changed: PolicyWarn},
+		Skipped:       skipped,
+	}
+	updated, err := u.Upload(local, &Index{Files: map[string]Sourcefile{}})
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"file-000", "file-003"}, paths(updated))
+	files := skipped.Files()
+	require.Equal(t, 2, len(files))
+	assert.True(t, errors.Is(files[0].Err, os.ErrNotExist))
+	assert.True(t, errors.Is(files[1].Err, ErrFileChanged))
+
+	u.FileErrors = FileErrorConfig{}
+	_, err = u.Upload(local, &Index{Files: map[string]Sourcefile{}})
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	u.FileErrors = FileErrorConfig{Missing: PolicySkip}
+	u.Skipped = nil
+	updated, err = u.Upload(local, &Index{Files: map[string]Sourcefile{}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"file-000", "file-002", "file-003"}, paths(updated), "changes aren't looked for without a policy")
+}
+
+func TestUploader_ChangedFileNotStored(t *testing.T) {
+	content := "some content"
+	for _, chunking := range []bool{false, true} {
+		store := memory.NewStore()
+		require.NoError(t, store.Save("a", strings.NewReader("stored before")))
+		local := &Index{Files: map[string]Sourcefile{
+			"a": Sourcefile{Key: "a", Hash: hashOf(content), Size: int64(len(content))},
+			"b": Sourcefile{Key: hashOf(content), Hash: hashOf(content), Size: int64(len(content))},
+		}}
+
+		u := &Uploader{
+			Store: store,
+			GetFile: func(p string) (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader("changed content")), nil
+			},
+			ParallelLimit: 2,
+			Chunking:      ChunkConfig{Enabled: chunking, AverageSize: 1024},
+			FileErrors:    FileErrorConfig{Changed: PolicySkip},
+		}
+		updated, err := u.Upload(local, &Index{Files: map[string]Sourcefile{}})
+
+		require.NoError(t, err)
+		assert.Empty(t, updated.Files)
+		assert.Equal(t, "stored before", readKey(t, store, "a"), "path layout keeps what was there")
+		_, err = store.Head(hashOf(content))
+		assert.True(t, errors.Is(err, os.ErrNotExist), "content layout saves nothing under the hash")
+	}
+}
@@ -0,0 +1,153 @@
+package s3backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dnnrly/s3backup/s3"
+)
+
+// JobConfig defines a named backup of one or more local directories to a
+// location in a bucket
+type JobConfig struct {
+	// Sources are the local directories that are backed up
+	Sources []string `yaml:"sources"`
+	// Backend is the URL of where the files are backed up to, the backend
+	// from the config is used if this is empty
+	Backend string `yaml:"backend"`
+	// Bucket is the S3 bucket that the files are backed up to when there is
+	// no backend URL, the bucket from the S3 config is used if this is empty.
+	// It can't be set when there is a backend URL.
+	Bucket string `yaml:"bucket"`
+	// Prefix is the location in the bucket that all of the objects for this
+	// job are saved under
+	Prefix string `yaml:"prefix"`
+	// Index is the key of the index for this job, the default is an index
+	// file under Prefix
+	Index string `yaml:"index"`
+}
+
+// IndexKey is the location in the bucket that the index for this job is saved
+func (j JobConfig) IndexKey() string {
+	if j.Index != "" {
+		return j.Index
+	}
+
+	if j.Prefix == "" {
+		return indexFile
+	}
+
+	return path.Join(j.Prefix, indexFile)
+}
+
+// JournalFile is the name of the file that the upload journal for this job is
+// kept in. It is made from the store and the index so that every index has a
+// journal of its own.
+func (j JobConfig) JournalFile(config *Config) string {
+	id := strings.Join([]string{j.BackendURL(config), j.S3(config.S3).Bucket, j.IndexKey()}, "\n")
+	sum := sha256.Sum256([]byte(id))
+
+	return hex.EncodeToString(sum[:8]) + ".journal"
+}
+
+// S3 creates the S3 config for this job from the common config
+func (j JobConfig) S3(config s3.Config) s3.Config {
+	if j.Bucket != "" {
+		config.Bucket = j.Bucket
+	}
+
+	return config
+}
+
+// BackendURL finds the URL of where the files for this job are backed up to
+func (j JobConfig) BackendURL(config *Config) string {
+	if j.Backend != "" {
+		return j.Backend
+	}
+
+	return config.Backend
+}
+
+// Validate checks that the job has something to back up
+func (j JobConfig) Validate() error {
+	if len(j.Sources) == 0 {
+		return fmt.Errorf("no sources to back up")
+	}
+
+	if err := ValidateBackend(j.Backend); err != nil {
+		return err
+	}
+
+	names := map[string]bool{}
+	for _, s := range j.Sources {
+		if s == "" {
+			return fmt.Errorf("empty source directory")
+		}
+
+		name := sourceName(s)
+		if names[name] {
+			return fmt.Errorf("more than one source directory is called %s", name)
+		}
+		names[name] = true
+	}
+
+	return nil
+}
+
+// SourcePaths maps each source directory to the path that its files are put
+// under in the index. When there is only one source its files are put at the
+// top of the index, otherwise they are put under the name of the source.
+func (j JobConfig) SourcePaths() map[string]string {
+	paths := map[string]string{}
+	for _, s := range j.Sources {
+		if len(j.Sources) == 1 {
+			paths[s] = ""
+		} else {
+			paths[s] = sourceName(s)
+		}
+	}
+
+	return paths
+}
+
+// sourceName is the name of a source directory, which is found from its
+// absolute path so that directories like '.' and '..' have a real name
+func sourceName(dir string) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+
+	return filepath.Base(dir)
+}
+
+// Job finds the job with the given name
+func (c *Config) Job(name string) (JobConfig, error) {
+	job, found := c.Jobs[name]
+	if !found {
+		return JobConfig{}, fmt.Errorf("unknown job %s", name)
+	}
+
+	return job, nil
+}
+
+// JobNames lists the names of all of the jobs, in order
+func (c *Config) JobNames() []string {
+	names := make([]string, 0, len(c.Jobs))
+	for name := range c.Jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// cleanPrefix removes the slashes around a prefix so that it can be joined
+// to keys
+func cleanPrefix(prefix string) string {
+	return strings.Trim(path.Clean("/"+prefix), "/")
+}
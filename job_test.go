@@ -0,0 +1,94 @@
+package s3backup
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/dnnrly/s3backup/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobConfig_IndexKey(t *testing.T) {
+	assert.Equal(t, ".index.yaml", JobConfig{}.IndexKey())
+	assert.Equal(t, "photos/.index.yaml", JobConfig{Prefix: "photos"}.IndexKey())
+	assert.Equal(t, "indexes/photos.yaml", JobConfig{Prefix: "photos", Index: "indexes/photos.yaml"}.IndexKey())
+}
+
+func TestJobConfig_S3(t *testing.T) {
+	config := s3.Config{Bucket: "default", Region: "eu-west-1"}
+
+	assert.Equal(t, config, JobConfig{}.S3(config))
+	assert.Equal(t, s3.Config{Bucket: "other", Region: "eu-west-1"}, JobConfig{Bucket: "other"}.S3(config))
+}
+
+func TestConfig_Job(t *testing.T) {
+	config := &Config{Jobs: map[string]JobConfig{
+		"photos": JobConfig{Sources: []string{"a"}},
+		"docs":   JobConfig{Sources: []string{"b"}},
+	}}
+
+	job, err := config.Job("photos")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, job.Sources)
+
+	_, err = config.Job("music")
+	assert.Error(t, err)
+
+	assert.Equal(t, []string{"docs", "photos"}, config.JobNames())
+}
+
+func TestUploader_IndexKey(t *testing.T) {
+	local := &Index{
+		Files: map[string]Sourcefile{
+			"1": Sourcefile{Key: "photos/1", Hash: hashOf("file 1")},
+		},
+	}
+
+	mock := &mockStore{FailAfter: 99}
+	u := &Uploader{
+		Store: mock,
+		GetFile: func(p string) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewBufferString("file " + p)), nil
+		},
+		ParallelLimit: 1,
+		BatchSize:     1,
+		IndexKey:      "photos/.index.yaml",
+	}
+
+	_, err := u.Upload(local, &Index{Files: map[string]Sourcefile{}})
+	require.NoError(t, err)
+
+	assert.Contains(t, mock.Keys, "photos/1")
+	assert.Contains(t, mock.Keys, "photos/.index.yaml")
+	assert.NotContains(t, mock.Keys, ".index.yaml")
+}
+
+func TestJobConfig_SourcePaths(t *testing.T) {
+	assert.Equal(t, map[string]string{"/home/me/photos": ""}, JobConfig{Sources: []string{"/home/me/photos"}}.SourcePaths())
+	assert.Equal(t, map[string]string{
+		"/home/me/photos": "photos",
+		"/media/camera/":  "camera",
+	}, JobConfig{Sources: []string{"/home/me/photos", "/media/camera/"}}.SourcePaths())
+}
+
+func TestJobConfig_Validate(t *testing.T) {
+	assert.NoError(t, JobConfig{Sources: []string{"/home/me/photos", "/media/photos-2"}}.Validate())
+	assert.Error(t, JobConfig{}.Validate())
+	assert.Error(t, JobConfig{Sources: []string{""}}.Validate())
+	assert.Error(t, JobConfig{Sources: []string{"/home/me/photos", "/media/photos"}}.Validate())
+}
+
+func TestJobConfig_JournalFile(t *testing.T) {
+	config := &Config{S3: s3.Config{Bucket: "bucket"}}
+	photos := JobConfig{Sources: []string{"/photos"}, Prefix: "photos"}
+	docs := JobConfig{Sources: []string{"/docs"}, Prefix: "docs"}
+
+	assert.Equal(t, photos.JournalFile(config), photos.JournalFile(config))
+	assert.NotEqual(t, photos.JournalFile(config), docs.JournalFile(config))
+	assert.NotEqual(t, photos.JournalFile(config), JobConfig{Prefix: "photos", Bucket: "other"}.JournalFile(config))
+	assert.True(t, strings.HasSuffix(photos.JournalFile(config), ".journal"))
+}
@@ -0,0 +1,117 @@
+package s3backup
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// journalEntry is a single upload recorded in the journal
+type journalEntry struct {
+	Path   string   `json:"path"`
+	Key    string   `json:"key"`
+	Hash   string   `json:"hash"`
+	Size   int64    `json:"size"`
+	Chunks []string `json:"chunks,omitempty"`
+	Codec  string   `json:"codec,omitempty"`
+}
+
+// Journal is a local record of the files that have been uploaded but not yet
+// saved in the remote index. Each upload is appended as soon as it finishes,
+// so if a backup is stopped part of the way through, the next one can add
+// them to the index rather than uploading them again.
+type Journal struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+// OpenJournal opens the journal at 'p', creating it if it doesn't exist
+func OpenJournal(p string) (*Journal, error) {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, fmt.Errorf("unable to create journal: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Clean(p), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open journal: %w", err)
+	}
+
+	return &Journal{file: f}, nil
+}
+
+// Record appends a file that has been uploaded to the journal
+func (j *Journal) Record(p string, src Sourcefile) error {
+	line, err := json.Marshal(journalEntry{
+		Path:   p,
+		Key:    src.Key,
+		Hash:   src.Hash,
+		Size:   src.Size,
+		Chunks: src.Chunks,
+		Codec:  src.Codec,
+	})
+	if err != nil {
+		return err
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	_, err = j.file.Write(append(line, '\n'))
+	return err
+}
+
+// Replay adds every upload recorded in the journal to the index, returning
+// the number of files added. A last entry that was only partly written when
+// the backup stopped is ignored.
+func (j *Journal) Replay(index *Index) (int, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	r := bufio.NewReader(j.file)
+	count := 0
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, fmt.Errorf("unable to read journal: %w", err)
+		}
+
+		entry := journalEntry{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return count, fmt.Errorf("unable to read journal: %w", err)
+		}
+
+		index.Add(entry.Path, Sourcefile{
+			Key:    entry.Key,
+			Hash:   entry.Hash,
+			Size:   entry.Size,
+			Chunks: entry.Chunks,
+			Codec:  entry.Codec,
+		})
+		count++
+	}
+}
+
+// Clear removes everything from the journal, once the uploads in it have
+// been saved in the remote index
+func (j *Journal) Clear() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.file.Truncate(0)
+}
+
+// Close closes the journal file, leaving its contents for the next backup
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
@@ -0,0 +1,128 @@
+package s3backup
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testJournal(t *testing.T) (*Journal, string) {
+	dir, err := ioutil.TempDir("", "s3backup-journal")
+	require.NoError(t, err)
+
+	p := filepath.Join(dir, "cache", "test.journal")
+	j, err := OpenJournal(p)
+	require.NoError(t, err)
+
+	return j, p
+}
+
+func TestJournal(t *testing.T) {
+	j, p := testJournal(t)
+	defer os.RemoveAll(filepath.Dir(filepath.Dir(p)))
+
+	require.NoError(t, j.Record("a", Sourcefile{Key: "root/a", Hash: "1", Size: 10}))
+	require.NoError(t, j.Record("dir/b", Sourcefile{Key: "root/dir/b", Hash: "2", Chunks: []string{"c1", "c2"}, Codec: CodecZstd}))
+	require.NoError(t, j.Close())
+
+	j, err := OpenJournal(p)
+	require.NoError(t, err)
+	defer j.Close()
+
+	index := &Index{Files: map[string]Sourcefile{"c": Sourcefile{Key: "root/c", Hash: "3"}}}
+	n, err := j.Replay(index)
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, n)
+	assert.Equal(t, Sourcefile{Key: "root/a", Hash: "1", Size: 10}, index.Files["a"])
+	assert.Equal(t, Sourcefile{Key: "root/dir/b", Hash: "2", Chunks: []string{"c1", "c2"}, Codec: CodecZstd}, index.Files["dir/b"])
+	assert.Equal(t, "3", index.Files["c"].Hash)
+
+	require.NoError(t, j.Clear())
+	require.NoError(t, j.Record("d", Sourcefile{Key: "root/d", Hash: "4"}))
+	index = &Index{Files: map[string]Sourcefile{}}
+	n, err = j.Replay(index)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{"d"}, paths(index))
+}
+
+func TestJournal_PartialEntry(t *testing.T) {
+	j, p := testJournal(t)
+	defer os.RemoveAll(filepath.Dir(filepath.Dir(p)))
+	defer j.Close()
+
+	require.NoError(t, j.Record("a", Sourcefile{Key: "a", Hash: "1"}))
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"path":"b","key":"b","ha`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	index := &Index{Files: map[string]Sourcefile{}}
+	n, err := j.Replay(index)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{"a"}, paths(index))
+}
+
+func TestUploader_ResumesFromJournal(t *testing.T) {
+	j, p := testJournal(t)
+	defer os.RemoveAll(filepath.Dir(filepath.Dir(p)))
+	defer j.Close()
+
+	local := &Index{Files: map[string]Sourcefile{}}
+	for _, f := range []string{"a", "b", "c", "d", "e", "f"} {
+		local.Add(f, Sourcefile{Key: f, Hash: hashOf("file " + f)})
+	}
+	getFile := func(p string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewBufferString("file " + p)), nil
+	}
+
+	// the backup is stopped after 2 uploads, before the index is saved
+	interrupted := &mockStore{FailAfter: 2}
+	u := &Uploader{Store: interrupted, GetFile: getFile, ParallelLimit: 1, BatchSize: 6, Journal: j}
+	_, err := u.Upload(local, &Index{Files: map[string]Sourcefile{}})
+	require.Error(t, err)
+	require.Equal(t, 2, len(interrupted.Keys))
+
+	store := &mockStore{FailAfter: 99}
+	u = &Uploader{Store: store, GetFile: getFile, ParallelLimit: 1, BatchSize: 6, Journal: j}
+	updated, err := u.Upload(local, &Index{Files: map[string]Sourcefile{}})
+	require.NoError(t, err)
+
+	assert.Equal(t, 6, len(updated.Files))
+	assert.Equal(t, 5, len(store.Keys), "4 files and the index")
+	for _, k := range interrupted.Keys {
+		assert.NotContains(t, store.Keys, k, "%s was uploaded again", k)
+	}
+
+	index := &Index{Files: map[string]Sourcefile{}}
+	n, err := j.Replay(index)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n, "the journal is cleared once the index is saved")
+}
+
+func TestUploader_SavesReplayedJournal(t *testing.T) {
+	j, p := testJournal(t)
+	defer os.RemoveAll(filepath.Dir(filepath.Dir(p)))
+	defer j.Close()
+
+	require.NoError(t, j.Record("a", Sourcefile{Key: "a", Hash: "1"}))
+	local := &Index{Files: map[string]Sourcefile{"a": Sourcefile{Key: "a", Hash: "1"}}}
+
+	store := &mockStore{FailAfter: 99}
+	u := &Uploader{Store: store, ParallelLimit: 1, BatchSize: 1, Journal: j}
+	updated, err := u.Upload(local, &Index{Files: map[string]Sourcefile{}})
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, paths(updated))
+	assert.Equal(t, []string{indexFile}, store.Keys)
+}
@@ -0,0 +1,101 @@
+package s3backup
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+const (
+	// LayoutPath stores each file under a key made from its path
+	LayoutPath = "path"
+	// LayoutContent stores each file under a key made from the hash of its
+	// contents, so that identical files are only stored once
+	LayoutContent = "content"
+
+	contentPrefix = "data"
+)
+
+// ContentKey creates the key that a file with the given hash is stored under
+// when using the content layout. When 'encryption' is set the key is named
+// with it, so that it doesn't give away the hash.
+func ContentKey(bucketRoot, hash string, encryption *Encryption) (string, error) {
+	sum, err := base64.StdEncoding.DecodeString(hash)
+	if err != nil {
+		return "", fmt.Errorf("invalid hash %s: %w", hash, err)
+	}
+
+	key := fmt.Sprintf("%s/%s", contentPrefix, objectName(sum, encryption))
+	if bucketRoot != "" {
+		key = fmt.Sprintf("%s/%s", bucketRoot, key)
+	}
+
+	return key, nil
+}
+
+// UseContentKeys changes the key of every file in the index so that it is
+// stored by the hash of its contents, named with 'encryption' if it is set
+func (i *Index) UseContentKeys(bucketRoot string, encryption *Encryption) error {
+	for f, v := range i.Files {
+		key, err := ContentKey(bucketRoot, v.Hash, encryption)
+		if err != nil {
+			return fmt.Errorf("unable to create key for %s: %w", f, err)
+		}
+
+		v.Key = key
+		i.Files[f] = v
+	}
+
+	return nil
+}
+
+// objectName is the name of an object with contents that have the SHA-256
+// hash 'sum', which is the hash itself unless there is encryption
+func objectName(sum []byte, encryption *Encryption) string {
+	if encryption != nil {
+		return encryption.ObjectName(sum)
+	}
+
+	return hex.EncodeToString(sum)
+}
+
+// dedupe removes files from the diff whose contents do not need to be uploaded
+// because they will be stored under the same key as another file. Files
+// already stored by the remote index are returned as 'existing' and files that
+// share a key with another file in the diff are returned as 'duplicates'.
+func dedupe(diff, remote *Index) (existing, duplicates map[string]Sourcefile) {
+	existing = map[string]Sourcefile{}
+	duplicates = map[string]Sourcefile{}
+
+	stored := map[string]Sourcefile{}
+	for _, v := range remote.Files {
+		stored[v.Key] = v
+	}
+
+	paths := make([]string, 0, len(diff.Files))
+	for f := range diff.Files {
+		paths = append(paths, f)
+	}
+	sort.Strings(paths)
+
+	pending := map[string]string{}
+	for _, f := range paths {
+		v := diff.Files[f]
+		if s, found := stored[v.Key]; found && s.Hash == v.Hash {
+			doLog("Found stored copy of %s as %s\n", f, v.Key)
+			v.Chunks = s.Chunks
+			v.Codec = s.Codec
+			existing[f] = v
+			delete(diff.Files, f)
+		} else if hash, found := pending[v.Key]; found && hash == v.Hash {
+			doLog("Found duplicate of %s as %s\n", f, v.Key)
+			duplicates[f] = v
+			delete(diff.Files, f)
+		} else {
+			pending[v.Key] = v.Hash
+		}
+	}
+
+	return existing, duplicates
+}
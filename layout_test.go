@@ -0,0 +1,103 @@
+package s3backup
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentKey(t *testing.T) {
+	key, err := ContentKey("", hashOf(""), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "data/e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", key)
+
+	key, err = ContentKey("root", hashOf(""), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "root/data/e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", key)
+
+	_, err = ContentKey("", "not base64!", nil)
+	assert.Error(t, err)
+}
+
+func TestIndexUseContentKeys(t *testing.T) {
+	index := &Index{
+		Files: map[string]Sourcefile{
+			"1": Sourcefile{Key: "1", Hash: hashOf("file 1")},
+			"2": Sourcefile{Key: "2", Hash: hashOf("file 1")},
+			"3": Sourcefile{Key: "3", Hash: hashOf("file 3")},
+		},
+	}
+
+	err := index.UseContentKeys("", nil)
+
+	assert.NoError(t, err)
+	assert.Equal(t, index.Files["1"].Key, index.Files["2"].Key)
+	assert.NotEqual(t, index.Files["1"].Key, index.Files["3"].Key)
+	assert.Contains(t, index.Files["3"].Key, "data/")
+}
+
+func TestUploadDifferences_SkipsStoredContent(t *testing.T) {
+	local := &Index{
+		Files: map[string]Sourcefile{
+			"1": Sourcefile{Key: "data/1", Hash: "1"},
+			"2": Sourcefile{Key: "data/1", Hash: "1"},
+			"3": Sourcefile{Key: "data/1", Hash: "1"},
+			"4": Sourcefile{Key: "data/2", Hash: "2"},
+			"5": Sourcefile{Key: "data/3", Hash: "3"},
+		},
+	}
+	remote := &Index{
+		Files: map[string]Sourcefile{
+			"6": Sourcefile{Key: "data/2", Hash: "2"},
+		},
+	}
+
+	getter := func(p string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader(p)), nil
+	}
+
+	mock := &mockStore{
+		Keys:      []string{},
+		FailAfter: 99,
+	}
+	updated, err := UploadDifferences(local, remote, 4, 5, mock, getter)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(mock.Keys))
+	assert.ElementsMatch(t, []string{"data/1", "data/3"}, mock.Keys[:2])
+	assert.Equal(t, []string{".index.yaml"}, mock.Keys[2:])
+	assert.Equal(t, 6, len(updated.Files))
+
+	final, err := NewIndex(mock.Values[2])
+	assert.NoError(t, err)
+	assert.Equal(t, updated, final)
+}
+
+func TestUploadDifferences_PathLayoutUploadsChanges(t *testing.T) {
+	local := &Index{
+		Files: map[string]Sourcefile{
+			"1": Sourcefile{Key: "1", Hash: "new"},
+		},
+	}
+	remote := &Index{
+		Files: map[string]Sourcefile{
+			"1": Sourcefile{Key: "1", Hash: "old"},
+		},
+	}
+
+	getter := func(p string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader(p)), nil
+	}
+
+	mock := &mockStore{
+		Keys:      []string{},
+		FailAfter: 99,
+	}
+	_, err := UploadDifferences(local, remote, 4, 5, mock, getter)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1", ".index.yaml"}, mock.Keys)
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package local
+
+import "os"
+
+// fileInode gets the inode number of a file, which isn't available on this
+// platform so the size and modification time are relied on instead
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,330 @@
+package local
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dnnrly/s3backup/storage"
+)
+
+const (
+	// tempPrefix starts the name of files that are still being saved
+	tempPrefix = ".s3backup-save"
+	// lockPrefix starts the name of the lock files held while a file is
+	// conditionally replaced
+	lockPrefix = ".s3backup-lock-"
+
+	// lockTimeout is how long to wait for another process to release a lock
+	lockTimeout = 30 * time.Second
+	// lockPoll is how often a lock that is held is tried again
+	lockPoll = 10 * time.Millisecond
+	// staleLock is the age of a lock file that must have been left by a
+	// process that stopped, replacing a file takes far less
+	staleLock = time.Minute
+)
+
+// Store allows you to access your files in a directory on a local disk, such
+// as a NAS mount or a USB disk
+type Store struct {
+	root string
+	// lock stops conditional saves from racing with each other
+	lock sync.Mutex
+}
+
+// NewStore creates a new Store that keeps everything below the directory
+// 'root', creating it if needed
+func NewStore(root string) (*Store, error) {
+	if root == "" {
+		return nil, fmt.Errorf("no directory given for local store")
+	}
+
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create local store: %w", err)
+	}
+
+	return &Store{root: root}, nil
+}
+
+// GetByKey retrieves the data at a certain location in your directory. If
+// there is nothing at that location then the error will match os.ErrNotExist.
+func (s *Store) GetByKey(key string) (io.ReadCloser, error) {
+	return os.Open(s.path(key))
+}
+
+// GetRange retrieves 'length' bytes of the data at a certain location in your
+// directory, starting at 'offset'. A negative length reads to the end.
+func (s *Store) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	if length < 0 {
+		return f, nil
+	}
+
+	return &limitedFile{Reader: io.LimitReader(f, length), file: f}, nil
+}
+
+// limitedFile reads part of a file
+type limitedFile struct {
+	io.Reader
+	file *os.File
+}
+
+func (l *limitedFile) Close() error {
+	return l.file.Close()
+}
+
+// Save puts the data at a location in your directory. The data is written to
+// a temporary file first so that a failed save never leaves a partial file.
+func (s *Store) Save(key string, data io.Reader) error {
+	_, err := s.save(key, data, nil)
+	return err
+}
+
+// SaveIfMatch puts the data at a location in your directory, as long as the
+// file there still has the ETag 'etag'. An empty ETag means that there must
+// not be a file there. If the file has changed then the error will match
+// storage.ErrConflict. It returns the ETag of the saved file.
+//
+// Directories can't replace a file only if it hasn't changed, so the check is
+// made just before the new file is moved in to place while holding a lock
+// file next to it. Every process that saves with SaveIfMatch takes the same
+// lock, so none of them can save in between the check and the move.
+func (s *Store) SaveIfMatch(key string, data io.Reader, etag string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.save(key, data, func() error {
+		current, err := s.Head(key)
+		if errors.Is(err, os.ErrNotExist) {
+			if etag != "" {
+				return fmt.Errorf("%s: %w", key, storage.ErrConflict)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if current.ETag != etag {
+			return fmt.Errorf("%s: %w", key, storage.ErrConflict)
+		}
+		return nil
+	})
+}
+
+// save writes the data to a temporary file and moves it in to place, returning
+// its ETag. When 'check' is set the file is locked while it is called and
+// while the new file is moved in to place, as long as it doesn't return an
+// error.
+func (s *Store) save(key string, data io.Reader, check func() error) (string, error) {
+	p := s.path(key)
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(p), tempPrefix)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+
+	_, err = io.Copy(f, data)
+	closeErr := f.Close()
+	if err != nil {
+		return "", err
+	}
+	if closeErr != nil {
+		return "", closeErr
+	}
+
+	// moving the file keeps its inode and modification time, so this is
+	// the ETag that it will have
+	info, err := os.Stat(f.Name())
+	if err != nil {
+		return "", err
+	}
+
+	if check != nil {
+		unlock, err := lockFile(p)
+		if err != nil {
+			return "", err
+		}
+		defer unlock()
+
+		if err := check(); err != nil {
+			return "", err
+		}
+	}
+
+	if err := os.Rename(f.Name(), p); err != nil {
+		return "", err
+	}
+
+	return objectInfo(key, info).ETag, nil
+}
+
+// lockFile takes an exclusive lock on the file at 'p', shared with every other
+// process using the directory, by creating a lock file next to it. A lock file
+// older than staleLock is removed. It returns a function that releases the
+// lock.
+func lockFile(p string) (func(), error) {
+	name := filepath.Join(filepath.Dir(p), lockPrefix+filepath.Base(p))
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_ = f.Close()
+			return func() {
+				_ = os.Remove(name)
+			}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > staleLock {
+			_ = os.Remove(name)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, &storage.TemporaryError{Err: fmt.Errorf("timed out waiting for lock %s", name)}
+		}
+		time.Sleep(lockPoll)
+	}
+}
+
+// List calls 'fn' for every object in your directory with a key that starts
+// with 'prefix', in order of key
+func (s *Store) List(prefix string, fn func(storage.ObjectInfo) error) error {
+	dir := s.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = s.path(prefix[:i])
+	}
+
+	objects := []storage.ObjectInfo{}
+	err := filepath.Walk(dir, func(p string, f os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == dir {
+				return nil
+			}
+			return err
+		}
+
+		if f.IsDir() || strings.HasPrefix(f.Name(), tempPrefix) || strings.HasPrefix(f.Name(), lockPrefix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		objects = append(objects, objectInfo(key, f))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	for _, o := range objects {
+		if err := fn(o); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Head retrieves the details of the object at a certain location in your
+// directory. If there is nothing at that location then the error will match
+// os.ErrNotExist. Files have no user metadata.
+func (s *Store) Head(key string) (storage.ObjectInfo, error) {
+	p := s.path(key)
+	f, err := os.Stat(p)
+	if err != nil {
+		return storage.ObjectInfo{}, err
+	}
+
+	if f.IsDir() {
+		return storage.ObjectInfo{}, fmt.Errorf("%s: %w", key, os.ErrNotExist)
+	}
+
+	info := objectInfo(key, f)
+	info.Metadata = map[string]string{}
+	return info, nil
+}
+
+// objectInfo describes the file for 'key' in the directory. The ETag is made
+// from the size, modification time and inode of the file, so that it can be
+// found without reading the file. Every save writes a new file and moves it
+// in to place, so the inode changes even if the size and time don't.
+func objectInfo(key string, f os.FileInfo) storage.ObjectInfo {
+	return storage.ObjectInfo{
+		Key:          key,
+		Size:         f.Size(),
+		ETag:         fmt.Sprintf("%x-%x-%x", f.Size(), f.ModTime().UnixNano(), fileInode(f)),
+		LastModified: f.ModTime(),
+	}
+}
+
+// Copy puts a copy of the object at 'from' at the location 'to'
+func (s *Store) Copy(from, to string) error {
+	f, err := os.Open(s.path(from))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	return s.Save(to, f)
+}
+
+// Delete removes the data at each of the locations in your directory
+func (s *Store) Delete(keys ...string) error {
+	for _, key := range keys {
+		err := os.Remove(s.path(key))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// path finds the location of a key on the disk, making sure that it is
+// inside the directory of the store
+func (s *Store) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+key)))
+}
@@ -0,0 +1,369 @@
+package s3backup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// DefaultLockTTL is how long a lock lasts without being renewed when no
+	// TTL has been configured
+	DefaultLockTTL = 10 * time.Minute
+
+	lockSuffix = ".lock"
+)
+
+var (
+	// ErrLocked is returned when another backup holds the lock on an index
+	ErrLocked = errors.New("index is locked by another backup")
+	// ErrLockLost is returned when a lock has expired or been taken by
+	// another backup while it was meant to be held
+	ErrLockLost = errors.New("lock on the index is no longer held")
+)
+
+// LockConfig controls the lock that stops backups running at the same time
+// from overwriting each other's index
+type LockConfig struct {
+	// TTL is how long a lock lasts if the backup holding it stops without
+	// releasing it. Locks are renewed well before this while a backup runs.
+	TTL time.Duration `yaml:"ttl"`
+	// Disabled turns locking off, so that backups running at the same time
+	// rely on the index only being saved if it hasn't changed since it was
+	// read
+	Disabled bool `yaml:"disabled"`
+}
+
+// Lease is the record of who holds the lock on an index and until when
+type Lease struct {
+	Owner    string    `yaml:"owner"`
+	Hostname string    `yaml:"hostname"`
+	PID      int       `yaml:"pid"`
+	Acquired time.Time `yaml:"acquired"`
+	Expires  time.Time `yaml:"expires"`
+}
+
+// Expired returns true if the lease is no longer valid at the time 'now'
+func (l *Lease) Expired(now time.Time) bool {
+	return !now.Before(l.Expires)
+}
+
+func (l *Lease) String() string {
+	return fmt.Sprintf("%s (pid %d) since %s until %s",
+		l.Hostname, l.PID, l.Acquired.Format(time.RFC3339), l.Expires.Format(time.RFC3339))
+}
+
+// LockKey is the location in the store of the lock for the index at
+// 'indexKey'
+func LockKey(indexKey string) string {
+	return indexKey + lockSuffix
+}
+
+// ReadLease gets the lease on the index at 'indexKey'. If the index isn't
+// locked then the error will match os.ErrNotExist.
+func ReadLease(store FileRepository, indexKey string) (*Lease, error) {
+	r, err := store.GetByKey(LockKey(indexKey))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	lease := &Lease{}
+	if err := yaml.Unmarshal(data, lease); err != nil {
+		return nil, fmt.Errorf("unable to read lock %s: %w", LockKey(indexKey), err)
+	}
+
+	return lease, nil
+}
+
+// readLease gets the lease on the index at 'indexKey' along with its ETag, so
+// that it can only be replaced if it hasn't changed. The ETag is read first
+// so that a lease written in between is never replaced.
+func readLease(store ObjectStore, indexKey string) (*Lease, string, error) {
+	info, err := store.Head(LockKey(indexKey))
+	if err != nil {
+		return nil, "", err
+	}
+
+	lease, err := ReadLease(store, indexKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return lease, info.ETag, nil
+}
+
+// BreakLock removes the lock on the index at 'indexKey', whoever holds it
+func BreakLock(store FileRepository, indexKey string) error {
+	return store.Delete(LockKey(indexKey))
+}
+
+// Lock is a lease on an index in the store. While it is held it is renewed
+// in the background so that it only expires if the backup holding it stops
+// without releasing it. The lease is only ever written if it hasn't changed
+// since it was last read or written, so two backups can't both hold it.
+type Lock struct {
+	store    ObjectStore
+	indexKey string
+	ttl      time.Duration
+
+	lock  sync.Mutex
+	lease Lease
+	etag  string
+	err   error
+	lost  chan struct{}
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// AcquireLock takes the lock on the index at 'indexKey'. A lock held by
+// another backup that has expired is taken over, otherwise the error will
+// match ErrLocked.
+func AcquireLock(store ObjectStore, indexKey string, ttl time.Duration) (*Lock, error) {
+	if ttl <= 0 {
+		ttl = DefaultLockTTL
+	}
+
+	existing, etag, err := readLease(store, indexKey)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	now := time.Now()
+	if existing != nil {
+		if !existing.Expired(now) {
+			return nil, fmt.Errorf("%w: held by %s", ErrLocked, existing)
+		}
+		doLog("Taking over expired lock held by %s\n", existing)
+	}
+
+	owner, err := newOwner()
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+
+	l := &Lock{
+		store:    store,
+		indexKey: indexKey,
+		ttl:      ttl,
+		lease: Lease{
+			Owner:    owner,
+			Hostname: hostname,
+			PID:      os.Getpid(),
+			Acquired: now,
+			Expires:  now.Add(ttl),
+		},
+		lost: make(chan struct{}),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	l.etag, err = l.write(l.lease, etag)
+	if errors.Is(err, ErrConflict) {
+		return nil, fmt.Errorf("%w: another backup took it at the same time", ErrLocked)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	go l.renew()
+	doLog("Locked %s\n", indexKey)
+
+	return l, nil
+}
+
+func newOwner() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// write saves the lease as long as the one in the store still has the ETag
+// 'etag', or there isn't one if it is empty. It returns the ETag of the lease
+// that was written.
+func (l *Lock) write(lease Lease, etag string) (string, error) {
+	data, err := yaml.Marshal(&lease)
+	if err != nil {
+		return "", err
+	}
+
+	return l.store.SaveIfMatch(LockKey(l.indexKey), bytes.NewReader(data), etag)
+}
+
+// renew extends the lease every third of its TTL until the lock is released
+// or lost. Failures are tried again sooner, until the lease expires.
+func (l *Lock) renew() {
+	defer close(l.done)
+
+	timer := time.NewTimer(l.ttl / 3)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-timer.C:
+		}
+
+		err := l.extend()
+		if errors.Is(err, ErrLockLost) {
+			doLog("Stopped renewing lock on %s: %s\n", l.indexKey, err)
+			return
+		}
+
+		if err != nil {
+			doLog("Unable to renew lock on %s, trying again: %s\n", l.indexKey, err)
+			timer.Reset(l.ttl / 12)
+			continue
+		}
+		timer.Reset(l.ttl / 3)
+	}
+}
+
+// extend writes the lease with a new expiry time, as long as it is still the
+// one that was last written
+func (l *Lock) extend() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.err != nil {
+		return l.err
+	}
+	if l.lease.Expired(time.Now()) {
+		return l.lose(fmt.Errorf("%w: expired at %s", ErrLockLost, l.lease.Expires.Format(time.RFC3339)))
+	}
+
+	lease := l.lease
+	lease.Expires = time.Now().Add(l.ttl)
+	etag, err := l.write(lease, l.etag)
+	if errors.Is(err, ErrConflict) {
+		// a write that failed may still have been saved, which leaves the
+		// lease as ours but with an ETag that isn't known
+		current, currentETag, readErr := readLease(l.store, l.indexKey)
+		switch {
+		case errors.Is(readErr, os.ErrNotExist):
+			return l.lose(fmt.Errorf("%w: lock has been removed", ErrLockLost))
+		case readErr != nil:
+			return readErr
+		case current.Owner != l.lease.Owner:
+			return l.lose(fmt.Errorf("%w: taken by %s", ErrLockLost, current))
+		}
+
+		l.lease = *current
+		l.etag = currentETag
+		return fmt.Errorf("lease on %s changed, renewing it again: %w", l.indexKey, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	l.lease = lease
+	l.etag = etag
+	return nil
+}
+
+// Lost is closed once the lock is found to have been lost, after which Err
+// says why
+func (l *Lock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Err is the reason that the lock was lost, or nil if it is still held as
+// far as is known
+func (l *Lock) Err() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.err
+}
+
+// lose records that the lock is no longer held. It must be called with the
+// lock held.
+func (l *Lock) lose(err error) error {
+	if l.err == nil {
+		l.err = err
+		close(l.lost)
+	}
+
+	return l.err
+}
+
+// Check makes sure that the lock is still held, reading the lease from the
+// store. The error will match ErrLockLost if it has expired or been taken
+// by another backup.
+func (l *Lock) Check() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.err != nil {
+		return l.err
+	}
+
+	current, err := ReadLease(l.store, l.indexKey)
+	if errors.Is(err, os.ErrNotExist) {
+		return l.lose(fmt.Errorf("%w: lock has been removed", ErrLockLost))
+	}
+	if err != nil {
+		return err
+	}
+
+	if current.Owner != l.lease.Owner {
+		return l.lose(fmt.Errorf("%w: taken by %s", ErrLockLost, current))
+	}
+	if l.lease.Expired(time.Now()) {
+		return l.lose(fmt.Errorf("%w: expired at %s", ErrLockLost, l.lease.Expires.Format(time.RFC3339)))
+	}
+
+	return nil
+}
+
+// SaveIndex writes the index to the store, as long as the lock is still held
+func (l *Lock) SaveIndex(index *Index) error {
+	if err := l.Check(); err != nil {
+		return fmt.Errorf("not saving index %s: %w", l.indexKey, err)
+	}
+
+	return SaveIndexAs(index, l.store, l.indexKey)
+}
+
+// Release stops renewing the lock and removes it from the store, unless it
+// has been taken by another backup
+func (l *Lock) Release() error {
+	select {
+	case <-l.stop:
+		return nil
+	default:
+		close(l.stop)
+	}
+	<-l.done
+
+	if err := l.Check(); err != nil {
+		if errors.Is(err, ErrLockLost) {
+			return nil
+		}
+		return err
+	}
+
+	doLog("Unlocked %s\n", l.indexKey)
+	return BreakLock(l.store, l.indexKey)
+}
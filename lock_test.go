@@ -0,0 +1,327 @@
+package s3backup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dnnrly/s3backup/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func saveLease(t *testing.T, store FileRepository, indexKey string, lease Lease) {
+	data, err := yaml.Marshal(&lease)
+	require.NoError(t, err)
+	require.NoError(t, store.Save(LockKey(indexKey), bytes.NewReader(data)))
+}
+
+func TestAcquireLock(t *testing.T) {
+	store := memory.NewStore()
+
+	lock, err := AcquireLock(store, "photos/.index.yaml", time.Minute)
+	require.NoError(t, err)
+
+	lease, err := ReadLease(store, "photos/.index.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, os.Getpid(), lease.PID)
+	assert.NotEmpty(t, lease.Owner)
+	assert.False(t, lease.Expired(time.Now()))
+	assert.True(t, lease.Expired(time.Now().Add(time.Minute)))
+
+	_, err = AcquireLock(store, "photos/.index.yaml", time.Minute)
+	assert.True(t, errors.Is(err, ErrLocked))
+
+	other, err := AcquireLock(store, "docs/.index.yaml", time.Minute)
+	require.NoError(t, err)
+	assert.NoError(t, other.Release())
+
+	assert.NoError(t, lock.Check())
+	assert.NoError(t, lock.Release())
+	assert.NoError(t, lock.Release())
+
+	_, err = ReadLease(store, "photos/.index.yaml")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	lock, err = AcquireLock(store, "photos/.index.yaml", time.Minute)
+	require.NoError(t, err)
+	assert.NoError(t, lock.Release())
+}
+
+func TestAcquireLock_TakesOverExpired(t *testing.T) {
+	store := memory.NewStore()
+	saveLease(t, store, ".index.yaml", Lease{
+		Owner:    "crashed",
+		Hostname: "other-host",
+		Acquired: time.Now().Add(-time.Hour),
+		Expires:  time.Now().Add(-time.Minute),
+	})
+
+	lock, err := AcquireLock(store, ".index.yaml", time.Minute)
+	require.NoError(t, err)
+	defer lock.Release()
+
+	lease, err := ReadLease(store, ".index.yaml")
+	require.NoError(t, err)
+	assert.NotEqual(t, "crashed", lease.Owner)
+}
+
+func TestLock_Renews(t *testing.T) {
+	store := memory.NewStore()
+
+	lock, err := AcquireLock(store, ".index.yaml", 60*time.Millisecond)
+	require.NoError(t, err)
+	defer lock.Release()
+
+	first, err := ReadLease(store, ".index.yaml")
+	require.NoError(t, err)
+
+	time.Sleep(150 * time.Millisecond)
+
+	renewed, err := ReadLease(store, ".index.yaml")
+	require.NoError(t, err)
+	assert.True(t, renewed.Expires.After(first.Expires))
+	assert.Equal(t, first.Owner, renewed.Owner)
+	assert.NoError(t, lock.Check())
+}
+
+func TestLock_SaveIndexRefusedWhenLost(t *testing.T) {
+	store := memory.NewStore()
+	index := &Index{Files: map[string]Sourcefile{"a": Sourcefile{Key: "a", Hash: "1"}}}
+
+	lock, err := AcquireLock(store, ".index.yaml", time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, lock.SaveIndex(index))
+	_, err = store.Head(".index.yaml")
+	require.NoError(t, err)
+
+	require.NoError(t, BreakLock(store, ".index.yaml"))
+	thief, err := AcquireLock(store, ".index.yaml", time.Minute)
+	require.NoError(t, err)
+	defer thief.Release()
+
+	require.NoError(t, store.Delete(".index.yaml"))
+	err = lock.SaveIndex(index)
+	assert.True(t, errors.Is(err, ErrLockLost))
+	_, err = store.Head(".index.yaml")
+	assert.True(t, errors.Is(err, os.ErrNotExist), "index must not be written without the lock")
+
+	assert.NoError(t, lock.Release())
+	assert.NoError(t, thief.Check(), "releasing a lost lock leaves the new holder alone")
+}
+
+func TestUploader_SavesIndexWithLock(t *testing.T) {
+	store := memory.NewStore()
+	local := &Index{Files: map[string]Sourcefile{"a": Sourcefile{Key: "a", Hash: "1"}}}
+
+	lock, err := AcquireLock(store, "jobs/.index.yaml", time.Minute)
+	require.NoError(t, err)
+
+	u := &Uploader{
+		Store: store,
+		GetFile: func(p string) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewBufferString("file " + p)), nil
+		},
+		ParallelLimit: 1,
+		BatchSize:     1,
+		Lock:          lock,
+	}
+	_, err = u.Upload(local, &Index{Files: map[string]Sourcefile{}})
+	require.NoError(t, err)
+	_, err = store.Head("jobs/.index.yaml")
+	assert.NoError(t, err)
+
+	require.NoError(t, BreakLock(store, "jobs/.index.yaml"))
+	local.Add("b", Sourcefile{Key: "b", Hash: "2"})
+
+	_, err = u.Upload(local, &Index{Files: map[string]Sourcefile{}})
+	assert.True(t, errors.Is(err, ErrLockLost))
+}
+
+func TestLock_RenewSurvivesTransientErrors(t *testing.T) {
+	store := newFlakyStore(errors.New("oops"), map[string]int{})
+
+	lock, err := AcquireLock(store, ".index.yaml", 120*time.Millisecond)
+	require.NoError(t, err)
+	defer lock.Release()
+
+	store.lock.Lock()
+	store.failures[LockKey(".index.yaml")] = 2
+	store.lock.Unlock()
+
+	time.Sleep(200 * time.Millisecond)
+
+	assert.NoError(t, lock.Check())
+	select {
+	case <-lock.Lost():
+		t.Fatal("lock was lost because of errors that didn't last")
+	default:
+	}
+}
+
+func TestLock_Lost(t *testing.T) {
+	store := memory.NewStore()
+
+	lock, err := AcquireLock(store, ".index.yaml", 60*time.Millisecond)
+	require.NoError(t, err)
+	defer lock.Release()
+	assert.NoError(t, lock.Err())
+
+	require.NoError(t, BreakLock(store, ".index.yaml"))
+
+	select {
+	case <-lock.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("losing the lock wasn't noticed")
+	}
+	assert.True(t, errors.Is(lock.Err(), ErrLockLost))
+}
+
+func TestUploader_StopsWhenLockLost(t *testing.T) {
+	store := memory.NewStore()
+	local := uploadTestIndex(50)
+
+	lock, err := AcquireLock(store, ".index.yaml", 60*time.Millisecond)
+	require.NoError(t, err)
+	defer lock.Release()
+
+	u := &Uploader{
+		Store: store,
+		GetFile: func(p string) (io.ReadCloser, error) {
+			time.Sleep(10 * time.Millisecond)
+			return ioutil.NopCloser(bytes.NewBufferString(p)), nil
+		},
+		ParallelLimit: 1,
+		BatchSize:     100,
+		Lock:          lock,
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = BreakLock(store, ".index.yaml")
+	}()
+	_, err = u.Upload(local, &Index{Files: map[string]Sourcefile{}})
+
+	assert.True(t, errors.Is(err, ErrLockLost), "%v", err)
+	_, err = store.Head("file-049")
+	assert.True(t, errors.Is(err, os.ErrNotExist), "uploads carried on after the lock was lost")
+	_, err = store.Head(".index.yaml")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+// raceStore holds back the first 'racers' looks at the lease until they have
+// all been made, so that every racer sees the same lease before any of them
+// writes theirs
+type raceStore struct {
+	ObjectStore
+	key     string
+	racers  int
+	lock    sync.Mutex
+	looks   int
+	release chan struct{}
+}
+
+func (s *raceStore) wait(key string) {
+	if key != s.key {
+		return
+	}
+
+	s.lock.Lock()
+	s.looks++
+	wait := s.looks <= s.racers
+	if s.looks == s.racers {
+		close(s.release)
+	}
+	s.lock.Unlock()
+
+	if wait {
+		<-s.release
+	}
+}
+
+func (s *raceStore) Head(key string) (ObjectInfo, error) {
+	info, err := s.ObjectStore.Head(key)
+	s.wait(key)
+	return info, err
+}
+
+func (s *raceStore) GetByKey(key string) (io.ReadCloser, error) {
+	r, err := s.ObjectStore.GetByKey(key)
+	s.wait(key)
+	return r, err
+}
+
+func TestAcquireLock_OnlyOneWins(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		lease *Lease
+	}{
+		{name: "no lease"},
+		{name: "expired lease", lease: &Lease{Owner: "crashed", Expires: time.Now().Add(-time.Minute)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			const racers = 4
+			store := &raceStore{
+				ObjectStore: memory.NewStore(),
+				key:         LockKey(".index.yaml"),
+				racers:      racers,
+				release:     make(chan struct{}),
+			}
+			if tc.lease != nil {
+				saveLease(t, store.ObjectStore, ".index.yaml", *tc.lease)
+			}
+
+			locks := make(chan *Lock, racers)
+			wg := sync.WaitGroup{}
+			for i := 0; i < racers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					lock, err := AcquireLock(store, ".index.yaml", time.Minute)
+					if err == nil {
+						locks <- lock
+						return
+					}
+					assert.True(t, errors.Is(err, ErrLocked), "%v", err)
+				}()
+			}
+			wg.Wait()
+			close(locks)
+
+			held := 0
+			for lock := range locks {
+				held++
+				assert.NoError(t, lock.Check())
+				assert.NoError(t, lock.Release())
+			}
+			assert.Equal(t, 1, held)
+		})
+	}
+}
+
+func TestLock_RenewAfterUnknownWrite(t *testing.T) {
+	store := memory.NewStore()
+
+	lock, err := AcquireLock(store, ".index.yaml", time.Minute)
+	require.NoError(t, err)
+	defer lock.Release()
+
+	// a renewal that timed out but was saved anyway
+	lease, err := ReadLease(store, ".index.yaml")
+	require.NoError(t, err)
+	lease.Expires = lease.Expires.Add(time.Second)
+	saveLease(t, store, ".index.yaml", *lease)
+
+	assert.Error(t, lock.extend())
+	assert.NoError(t, lock.Err())
+	assert.NoError(t, lock.extend())
+
+	saveLease(t, store, ".index.yaml", Lease{Owner: "thief", Expires: time.Now().Add(time.Minute)})
+	assert.True(t, errors.Is(lock.extend(), ErrLockLost))
+}
@@ -0,0 +1,202 @@
+package memory
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dnnrly/s3backup/storage"
+)
+
+// Store keeps your files in memory, which is useful for tests and for trying
+// things out without changing any real storage
+type Store struct {
+	lock    sync.Mutex
+	objects map[string]object
+}
+
+type object struct {
+	data     []byte
+	etag     string
+	modified time.Time
+}
+
+// NewStore creates a new, empty Store
+func NewStore() *Store {
+	return &Store{
+		objects: map[string]object{},
+	}
+}
+
+// GetByKey retrieves the data at a certain location in memory. If there is
+// nothing at that location then the error will match os.ErrNotExist.
+func (s *Store) GetByKey(key string) (io.ReadCloser, error) {
+	return s.GetRange(key, 0, -1)
+}
+
+// GetRange retrieves 'length' bytes of the data at a certain location in
+// memory, starting at 'offset'. A negative length reads to the end.
+func (s *Store) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	o, found := s.objects[key]
+	if !found {
+		return nil, fmt.Errorf("%s: %w", key, os.ErrNotExist)
+	}
+	if offset < 0 {
+		return nil, fmt.Errorf("%s: negative offset %d", key, offset)
+	}
+
+	data := o.data
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	data = data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Save puts the data at a location in memory
+func (s *Store) Save(key string, data io.Reader) error {
+	_, err := s.save(key, data, func(object, bool) bool { return true })
+	return err
+}
+
+// SaveIfMatch puts the data at a location in memory, as long as the object
+// there still has the ETag 'etag'. An empty ETag means that there must not be
+// an object there. If the object has changed then the error will match
+// storage.ErrConflict. It returns the ETag of the saved object.
+func (s *Store) SaveIfMatch(key string, data io.Reader, etag string) (string, error) {
+	return s.save(key, data, func(o object, found bool) bool {
+		if !found {
+			return etag == ""
+		}
+		return o.etag == etag
+	})
+}
+
+// save puts the data at a location in memory if 'ok' agrees, given the object
+// that is there now
+func (s *Store) save(key string, data io.Reader, ok func(object, bool) bool) (string, error) {
+	b, err := ioutil.ReadAll(data)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	current, found := s.objects[key]
+	if !ok(current, found) {
+		return "", fmt.Errorf("%s: %w", key, storage.ErrConflict)
+	}
+
+	o := object{
+		data:     b,
+		etag:     hex.EncodeToString(sum[:]),
+		modified: time.Now(),
+	}
+	s.objects[key] = o
+	return o.etag, nil
+}
+
+// List calls 'fn' for every object in memory with a key that starts with
+// 'prefix', in order of key
+func (s *Store) List(prefix string, fn func(storage.ObjectInfo) error) error {
+	s.lock.Lock()
+	objects := []storage.ObjectInfo{}
+	for k, o := range s.objects {
+		if strings.HasPrefix(k, prefix) {
+			objects = append(objects, o.info(k))
+		}
+	}
+	s.lock.Unlock()
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	for _, o := range objects {
+		if err := fn(o); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Head retrieves the details of the object at a certain location in memory.
+// If there is nothing at that location then the error will match
+// os.ErrNotExist. Memory objects have no user metadata.
+func (s *Store) Head(key string) (storage.ObjectInfo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	o, found := s.objects[key]
+	if !found {
+		return storage.ObjectInfo{}, fmt.Errorf("%s: %w", key, os.ErrNotExist)
+	}
+
+	info := o.info(key)
+	info.Metadata = map[string]string{}
+	return info, nil
+}
+
+// Copy puts a copy of the object at 'from' at the location 'to'
+func (s *Store) Copy(from, to string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	o, found := s.objects[from]
+	if !found {
+		return fmt.Errorf("%s: %w", from, os.ErrNotExist)
+	}
+
+	o.modified = time.Now()
+	s.objects[to] = o
+	return nil
+}
+
+// Delete removes the data at each of the locations in memory
+func (s *Store) Delete(keys ...string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, k := range keys {
+		delete(s.objects, k)
+	}
+	return nil
+}
+
+// Keys lists everything that has been saved, in order
+func (s *Store) Keys() []string {
+	keys := []string{}
+	_ = s.List("", func(o storage.ObjectInfo) error {
+		keys = append(keys, o.Key)
+		return nil
+	})
+
+	return keys
+}
+
+func (o object) info(key string) storage.ObjectInfo {
+	return storage.ObjectInfo{
+		Key:          key,
+		Size:         int64(len(o.data)),
+		ETag:         o.etag,
+		LastModified: o.modified,
+	}
+}
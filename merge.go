@@ -0,0 +1,49 @@
+package s3backup
+
+// Merge combines the changes made to this index since it was copied from
+// 'base' with 'other', a newer version of 'base' that has been changed by
+// someone else. Files added or changed in this index replace those in
+// 'other'. Files removed from this index are only removed from the result if
+// they haven't been changed in 'other'.
+func (i *Index) Merge(base, other *Index) *Index {
+	result := CopyIndex(other)
+	if i.Version > result.Version {
+		result.Version = i.Version
+	}
+
+	for f, v := range i.Files {
+		if b, found := base.Files[f]; found && b.same(v) {
+			continue
+		}
+		result.Add(f, v)
+	}
+
+	for f, b := range base.Files {
+		if _, found := i.Files[f]; found {
+			continue
+		}
+		if o, found := result.Files[f]; found && o.same(b) {
+			delete(result.Files, f)
+		}
+	}
+
+	return result
+}
+
+// same returns true if both describe the same stored contents, ignoring where
+// the file was found locally
+func (s Sourcefile) same(other Sourcefile) bool {
+	if s.Key != other.Key || s.Hash != other.Hash || s.Size != other.Size || s.Codec != other.Codec {
+		return false
+	}
+	if !s.DeletedAt.Equal(other.DeletedAt) || len(s.Chunks) != len(other.Chunks) {
+		return false
+	}
+	for n := range s.Chunks {
+		if s.Chunks[n] != other.Chunks[n] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,78 @@
+package s3backup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndex_Merge(t *testing.T) {
+	base := &Index{
+		Version: 1,
+		Files: map[string]Sourcefile{
+			"unchanged":                   Sourcefile{Key: "unchanged", Hash: "1"},
+			"changed-ours":                Sourcefile{Key: "changed-ours", Hash: "1"},
+			"changed-theirs":              Sourcefile{Key: "changed-theirs", Hash: "1"},
+			"changed-both":                Sourcefile{Key: "changed-both", Hash: "1"},
+			"removed-ours":                Sourcefile{Key: "removed-ours", Hash: "1"},
+			"removed-theirs":              Sourcefile{Key: "removed-theirs", Hash: "1"},
+			"removed-ours-changed-theirs": Sourcefile{Key: "removed-ours-changed-theirs", Hash: "1"},
+		},
+	}
+
+	ours := CopyIndex(base)
+	ours.Add("changed-ours", Sourcefile{Key: "changed-ours", Hash: "ours"})
+	ours.Add("changed-both", Sourcefile{Key: "changed-both", Hash: "ours"})
+	ours.Add("added-ours", Sourcefile{Key: "added-ours", Hash: "ours"})
+	ours.Add("unchanged", Sourcefile{Key: "unchanged", Hash: "1", Path: "/local/unchanged"})
+	delete(ours.Files, "removed-ours")
+	delete(ours.Files, "removed-ours-changed-theirs")
+
+	theirs := CopyIndex(base)
+	theirs.Add("changed-theirs", Sourcefile{Key: "changed-theirs", Hash: "theirs"})
+	theirs.Add("changed-both", Sourcefile{Key: "changed-both", Hash: "theirs"})
+	theirs.Add("added-theirs", Sourcefile{Key: "added-theirs", Hash: "theirs"})
+	theirs.Add("removed-ours-changed-theirs", Sourcefile{Key: "removed-ours-changed-theirs", Hash: "theirs"})
+	delete(theirs.Files, "removed-theirs")
+
+	merged := ours.Merge(base, theirs)
+
+	assert.Equal(t, map[string]string{
+		"unchanged":                   "1",
+		"changed-ours":                "ours",
+		"changed-theirs":              "theirs",
+		"changed-both":                "ours",
+		"added-ours":                  "ours",
+		"added-theirs":                "theirs",
+		"removed-ours-changed-theirs": "theirs",
+	}, hashes(merged))
+	assert.Equal(t, 1, merged.Version)
+	assert.Contains(t, base.Files, "removed-ours", "inputs are not changed")
+}
+
+func TestIndex_MergeTombstones(t *testing.T) {
+	now := time.Now()
+	base := &Index{Files: map[string]Sourcefile{
+		"a": Sourcefile{Key: "a", Hash: "1"},
+	}}
+
+	ours := CopyIndex(base)
+	ours.MarkDeleted(&Index{Files: map[string]Sourcefile{}}, nil, now)
+	theirs := CopyIndex(base)
+	theirs.Add("b", Sourcefile{Key: "b", Hash: "2"})
+
+	merged := ours.Merge(base, theirs)
+
+	assert.True(t, merged.Files["a"].Deleted())
+	assert.False(t, merged.Files["b"].Deleted())
+}
+
+func hashes(index *Index) map[string]string {
+	result := map[string]string{}
+	for f, v := range index.Files {
+		result[f] = v.Hash
+	}
+
+	return result
+}
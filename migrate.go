@@ -0,0 +1,99 @@
+package s3backup
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// migrateRoot is a directory that was backed up, as an absolute path with
+// forward slashes, and the path that its files are put under in the index
+type migrateRoot struct {
+	dir string
+	to  string
+}
+
+// Migrate rewrites an index written before IndexVersion 1, when files were
+// indexed by their path from the working directory rather than from the
+// directory that was backed up. 'sources' maps each directory that was backed
+// up to the path that its files are put under in the index. Relative paths,
+// in the index and in 'sources', are taken to be relative to 'wd'. The keys of
+// the files don't change so nothing needs to be uploaded again. It returns the
+// number of files that were moved.
+//
+// The index is only given the current version once its paths have been
+// rewritten. If it has files but none of them are in 'sources', which happens
+// when the backup is run from somewhere else, it is left alone and an error is
+// returned, as otherwise every file would look to have been deleted.
+func (i *Index) Migrate(sources map[string]string, wd string) (int, error) {
+	if i.Version >= IndexVersion {
+		return 0, nil
+	}
+
+	roots := []migrateRoot{}
+	for dir, to := range sources {
+		roots = append(roots, migrateRoot{dir: absolutePath(wd, dir), to: to})
+	}
+
+	// When sources are inside each other, the innermost one that holds a file
+	// is the one that it came from
+	sort.Slice(roots, func(a, b int) bool {
+		if len(roots[a].dir) != len(roots[b].dir) {
+			return len(roots[a].dir) > len(roots[b].dir)
+		}
+		return roots[a].dir < roots[b].dir
+	})
+
+	moved := 0
+	files := map[string]Sourcefile{}
+	for f, v := range i.Files {
+		rel, to, found := migratePath(roots, absolutePath(wd, f))
+		if !found {
+			files[f] = v
+			continue
+		}
+
+		moved++
+		files[path.Join(to, rel)] = v
+	}
+
+	if moved == 0 && len(i.Files) > 0 {
+		dirs := []string{}
+		for _, root := range roots {
+			dirs = append(dirs, root.dir)
+		}
+		return 0, fmt.Errorf("none of the %d files in the index are in %s", len(i.Files), strings.Join(dirs, ", "))
+	}
+
+	i.Files = files
+	i.Version = IndexVersion
+
+	return moved, nil
+}
+
+// absolutePath cleans 'p', makes it absolute from 'wd' if it is relative and
+// uses forward slashes
+func absolutePath(wd, p string) string {
+	p = filepath.FromSlash(normalisePath(p))
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(wd, p)
+	}
+
+	return filepath.ToSlash(filepath.Clean(p))
+}
+
+// migratePath finds the root that the old path 'p' was found in, along with
+// its path relative to that root. The roots must be in the order that they
+// should be tried.
+func migratePath(roots []migrateRoot, p string) (string, string, bool) {
+	for _, root := range roots {
+		prefix := strings.TrimSuffix(root.dir, "/") + "/"
+		if strings.HasPrefix(p, prefix) {
+			return strings.TrimPrefix(p, prefix), root.to, true
+		}
+	}
+
+	return "", "", false
+}
@@ -0,0 +1,150 @@
+package s3backup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndex_Migrate(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources map[string]string
+		files   []string
+		want    []string
+		moved   int
+	}{
+		{
+			name:    "working directory",
+			sources: map[string]string{".": ""},
+			files:   []string{"a", "dir/b", "/abs/c", "../d", "/work/e"},
+			want:    []string{"../d", "/abs/c", "a", "dir/b", "e"},
+			moved:   3,
+		},
+		{
+			name:    "absolute root",
+			sources: map[string]string{"/home/me/photos/": ""},
+			files:   []string{"/home/me/photos/a.jpg", "/home/me/photos/2020/b.jpg", "/home/me/other"},
+			want:    []string{"/home/me/other", "2020/b.jpg", "a.jpg"},
+			moved:   2,
+		},
+		{
+			name:    "relative root",
+			sources: map[string]string{"./photos": ""},
+			files:   []string{"photos/a.jpg", "other/b.jpg"},
+			want:    []string{"a.jpg", "other/b.jpg"},
+			moved:   1,
+		},
+		{
+			name:    "parent root",
+			sources: map[string]string{"../photos": ""},
+			files:   []string{"../photos/a.jpg"},
+			want:    []string{"a.jpg"},
+			moved:   1,
+		},
+		{
+			name:    "several sources",
+			sources: map[string]string{"/home/me/photos": "photos", "/media/camera": "camera"},
+			files:   []string{"/home/me/photos/a.jpg", "/media/camera/a.jpg"},
+			want:    []string{"camera/a.jpg", "photos/a.jpg"},
+			moved:   2,
+		},
+		{
+			name:    "overlapping sources",
+			sources: map[string]string{"/home/me": "home", "/home/me/photos": "photos", "/home/me/photos/raw/": "raw"},
+			files:   []string{"/home/me/a.txt", "/home/me/photos/b.jpg", "/home/me/photos/raw/c.cr2", "/home/me/photos-old/d.jpg"},
+			want:    []string{"home/a.txt", "home/photos-old/d.jpg", "photos/b.jpg", "raw/c.cr2"},
+			moved:   4,
+		},
+		{
+			name:    "relative source, absolute paths",
+			sources: map[string]string{"photos": ""},
+			files:   []string{"/work/photos/a.jpg", "/elsewhere/photos/b.jpg"},
+			want:    []string{"/elsewhere/photos/b.jpg", "a.jpg"},
+			moved:   1,
+		},
+		{
+			name:    "absolute source, relative paths",
+			sources: map[string]string{"/work/photos": ""},
+			files:   []string{"photos/a.jpg", "./photos/b.jpg", "other/c.jpg"},
+			want:    []string{"a.jpg", "b.jpg", "other/c.jpg"},
+			moved:   2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index := &Index{Files: map[string]Sourcefile{}}
+			for _, f := range tt.files {
+				index.Files[f] = Sourcefile{Key: f, Hash: hashOf(f)}
+			}
+
+			moved, err := index.Migrate(tt.sources, "/work")
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.moved, moved)
+			assert.Equal(t, tt.want, paths(index))
+			assert.Equal(t, IndexVersion, index.Version)
+		})
+	}
+}
+
+func TestIndex_MigrateKeepsKeys(t *testing.T) {
+	index := &Index{Files: map[string]Sourcefile{
+		"photos/a.jpg": Sourcefile{Key: "photos/a.jpg", Hash: hashOf("a")},
+	}}
+
+	_, err := index.Migrate(map[string]string{"photos": ""}, "/work")
+
+	require.NoError(t, err)
+	assert.Equal(t, Sourcefile{Key: "photos/a.jpg", Hash: hashOf("a")}, index.Files["a.jpg"])
+}
+
+func TestIndex_MigrateCurrentVersion(t *testing.T) {
+	index := &Index{
+		Version: IndexVersion,
+		Files: map[string]Sourcefile{
+			"photos/a.jpg": Sourcefile{Key: "photos/a.jpg"},
+		},
+	}
+
+	moved, err := index.Migrate(map[string]string{"photos": ""}, "/work")
+
+	require.NoError(t, err)
+	assert.Equal(t, 0, moved)
+	assert.Contains(t, index.Files, "photos/a.jpg")
+}
+
+func TestIndex_MigrateNoneInSources(t *testing.T) {
+	index := &Index{Files: map[string]Sourcefile{
+		"/home/me/photos/a.jpg": Sourcefile{Key: "/home/me/photos/a.jpg"},
+		"../other/b.jpg":        Sourcefile{Key: "../other/b.jpg"},
+	}}
+
+	_, err := index.Migrate(map[string]string{".": ""}, "/elsewhere")
+
+	assert.Error(t, err)
+	assert.Equal(t, 0, index.Version)
+	assert.Equal(t, []string{"../other/b.jpg", "/home/me/photos/a.jpg"}, paths(index))
+}
+
+func TestIndex_MigrateEmpty(t *testing.T) {
+	index := &Index{Files: map[string]Sourcefile{}}
+
+	moved, err := index.Migrate(map[string]string{".": ""}, "/work")
+
+	require.NoError(t, err)
+	assert.Equal(t, 0, moved)
+	assert.Equal(t, IndexVersion, index.Version)
+}
+
+func TestIndex_MigrateOverlappingIsStable(t *testing.T) {
+	sources := map[string]string{"/a": "outer", "/a/b": "inner", "/a/b/c": "innermost"}
+	for i := 0; i < 50; i++ {
+		index := &Index{Files: map[string]Sourcefile{"/a/b/c/d": Sourcefile{Key: "d"}}}
+		_, err := index.Migrate(sources, "/")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"innermost/d"}, paths(index))
+	}
+}
@@ -0,0 +1,161 @@
+package s3backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// PlanEntry is a single file that is part of a Plan
+type PlanEntry struct {
+	Path string `json:"path"`
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// PlanGroup is a category of files in a Plan
+type PlanGroup struct {
+	Count int         `json:"count"`
+	Bytes int64       `json:"bytes"`
+	Files []PlanEntry `json:"files"`
+}
+
+func (g *PlanGroup) add(p string, src Sourcefile) {
+	g.Count++
+	g.Bytes += src.Size
+	g.Files = append(g.Files, PlanEntry{Path: p, Key: src.Key, Size: src.Size})
+}
+
+func (g *PlanGroup) sort() {
+	sort.Slice(g.Files, func(i, j int) bool {
+		return g.Files[i].Path < g.Files[j].Path
+	})
+}
+
+// Plan describes what the next backup would do to bring the remote index up
+// to date with the local one
+type Plan struct {
+	// New files are not in the remote index
+	New PlanGroup `json:"new"`
+	// Modified files are in the remote index with a different hash
+	Modified PlanGroup `json:"modified"`
+	// Unchanged files are in the remote index with the same hash
+	Unchanged PlanGroup `json:"unchanged"`
+	// Deleted files are in the remote index but have been removed locally since
+	// the last backup
+	Deleted PlanGroup `json:"deleted"`
+	// Skipped files are in the remote index but couldn't be read locally, so
+	// they are left as they are
+	Skipped PlanGroup `json:"skipped"`
+}
+
+// NewPlan compares the local and remote indexes to work out what needs to be
+// done to back up the local files. Files at the index paths in 'skipped', or
+// in the directories there, were left out of the local index because they
+// couldn't be read so they are listed as skipped rather than deleted.
+func NewPlan(local, remote *Index, skipped []string) *Plan {
+	plan := &Plan{
+		New:       PlanGroup{Files: []PlanEntry{}},
+		Modified:  PlanGroup{Files: []PlanEntry{}},
+		Unchanged: PlanGroup{Files: []PlanEntry{}},
+		Deleted:   PlanGroup{Files: []PlanEntry{}},
+		Skipped:   PlanGroup{Files: []PlanEntry{}},
+	}
+
+	for f, v := range local.Files {
+		r, found := remote.Files[f]
+		switch {
+		case !found || r.Deleted():
+			plan.New.add(f, v)
+		case r.Hash != v.Hash:
+			plan.Modified.add(f, v)
+		default:
+			plan.Unchanged.add(f, v)
+		}
+	}
+
+	unread := pathSet(skipped)
+	for f, v := range remote.Files {
+		if _, found := local.Files[f]; found || v.Deleted() {
+			continue
+		}
+
+		if underAny(f, unread) {
+			plan.Skipped.add(f, v)
+		} else {
+			plan.Deleted.add(f, v)
+		}
+	}
+
+	plan.New.sort()
+	plan.Modified.sort()
+	plan.Unchanged.sort()
+	plan.Deleted.sort()
+	plan.Skipped.sort()
+
+	return plan
+}
+
+// WriteJSON writes the plan as JSON
+func (p *Plan) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+// WriteText writes the plan in a human readable form, listing every file that
+// would change followed by a summary of each category
+func (p *Plan) WriteText(w io.Writer) error {
+	changes := []struct {
+		marker string
+		group  *PlanGroup
+	}{
+		{"+", &p.New},
+		{"~", &p.Modified},
+		{"-", &p.Deleted},
+		{"!", &p.Skipped},
+	}
+	for _, c := range changes {
+		for _, f := range c.group.Files {
+			if _, err := fmt.Fprintf(w, "%s %s\n", c.marker, f.Path); err != nil {
+				return err
+			}
+		}
+	}
+
+	summary := []struct {
+		name  string
+		group *PlanGroup
+	}{
+		{"New", &p.New},
+		{"Modified", &p.Modified},
+		{"Unchanged", &p.Unchanged},
+		{"Deleted locally", &p.Deleted},
+		{"Skipped", &p.Skipped},
+	}
+	for _, s := range summary {
+		_, err := fmt.Fprintf(w, "%-16s %6d files %10s\n", s.name+":", s.group.Count, FormatBytes(s.group.Bytes))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FormatBytes formats a number of bytes in a human readable form
+func FormatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,78 @@
+package s3backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testPlan() *Plan {
+	local := &Index{
+		Files: map[string]Sourcefile{
+			"1": Sourcefile{Key: "a", Hash: "321", Size: 10},
+			"2": Sourcefile{Key: "b", Hash: "123", Size: 20},
+			"3": Sourcefile{Key: "c", Hash: "123", Size: 30},
+			"4": Sourcefile{Key: "d", Hash: "123", Size: 40},
+		},
+	}
+	remote := &Index{
+		Files: map[string]Sourcefile{
+			"1":     Sourcefile{Key: "a", Hash: "123", Size: 5},
+			"2":     Sourcefile{Key: "b", Hash: "123", Size: 20},
+			"4":     Sourcefile{Key: "d", Hash: "123", Size: 40},
+			"5":     Sourcefile{Key: "e", Hash: "123", Size: 50},
+			"dir/6": Sourcefile{Key: "f", Hash: "123", Size: 60},
+		},
+	}
+
+	return NewPlan(local, remote, []string{"dir"})
+}
+
+func TestNewPlan(t *testing.T) {
+	plan := testPlan()
+
+	assert.Equal(t, PlanGroup{Count: 1, Bytes: 30, Files: []PlanEntry{{Path: "3", Key: "c", Size: 30}}}, plan.New)
+	assert.Equal(t, PlanGroup{Count: 1, Bytes: 10, Files: []PlanEntry{{Path: "1", Key: "a", Size: 10}}}, plan.Modified)
+	assert.Equal(t, 2, plan.Unchanged.Count)
+	assert.Equal(t, int64(60), plan.Unchanged.Bytes)
+	assert.Equal(t, []PlanEntry{{Path: "2", Key: "b", Size: 20}, {Path: "4", Key: "d", Size: 40}}, plan.Unchanged.Files)
+	assert.Equal(t, PlanGroup{Count: 1, Bytes: 50, Files: []PlanEntry{{Path: "5", Key: "e", Size: 50}}}, plan.Deleted)
+	assert.Equal(t, PlanGroup{Count: 1, Bytes: 60, Files: []PlanEntry{{Path: "dir/6", Key: "f", Size: 60}}}, plan.Skipped)
+}
+
+func TestPlanWriteText(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := testPlan().WriteText(buf)
+
+	assert.NoError(t, err)
+	assert.Equal(t, `+ 3
+~ 1
+- 5
+! dir/6
+New:                  1 files       30 B
+Modified:             1 files       10 B
+Unchanged:            2 files       60 B
+Deleted locally:      1 files       50 B
+Skipped:              1 files       60 B
+`, buf.String())
+}
+
+func TestPlanWriteJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := testPlan().WriteJSON(buf)
+	assert.NoError(t, err)
+
+	got := &Plan{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), got))
+	assert.Equal(t, testPlan(), got)
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "0 B", FormatBytes(0))
+	assert.Equal(t, "1023 B", FormatBytes(1023))
+	assert.Equal(t, "1.0 KiB", FormatBytes(1024))
+	assert.Equal(t, "1.5 MiB", FormatBytes(1024*1024*3/2))
+	assert.Equal(t, "2.0 GiB", FormatBytes(2*1024*1024*1024))
+}
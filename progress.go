@@ -0,0 +1,243 @@
+package s3backup
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// throughputWindow is how far back the uploads are looked at to find the
+// current throughput
+const throughputWindow = 10 * time.Second
+
+// Reporter is told how a backup is getting on as files are scanned, hashed
+// and uploaded. Its methods are called from many goroutines at once.
+type Reporter interface {
+	// Scanned is called for each file that is found
+	Scanned(p string, size int64)
+	// Hashed is called once the hash of a file is known
+	Hashed(p string, size int64)
+	// Queued is called once the files that need uploading are known. It is
+	// also called with no files and a negative size for data that turns out
+	// not to need sending, such as chunks that are already stored.
+	Queued(files int, size int64)
+	// Sent is called as the contents of files are read by the store. It is
+	// called with a negative count when an upload starts again, taking off
+	// what was sent by the attempt that failed.
+	Sent(n int64)
+	// Uploaded is called once a file is in the store
+	Uploaded(p string, size int64)
+	// Failed is called for a file that is left out of the backup
+	Failed(p string, err error)
+}
+
+// noReporter is used when nothing wants to know about progress
+type noReporter struct{}
+
+func (noReporter) Scanned(p string, size int64)  {}
+func (noReporter) Hashed(p string, size int64)   {}
+func (noReporter) Queued(files int, size int64)  {}
+func (noReporter) Sent(n int64)                  {}
+func (noReporter) Uploaded(p string, size int64) {}
+func (noReporter) Failed(p string, err error)    {}
+
+// reporterOr returns 'r', or a Reporter that does nothing if it is nil
+func reporterOr(r Reporter) Reporter {
+	if r == nil {
+		return noReporter{}
+	}
+
+	return r
+}
+
+// ProgressStats is how far a backup has got at a moment in time
+type ProgressStats struct {
+	FilesScanned  int
+	BytesScanned  int64
+	FilesHashed   int
+	BytesHashed   int64
+	FilesQueued   int
+	BytesQueued   int64
+	BytesSent     int64
+	FilesUploaded int
+	BytesUploaded int64
+	FilesFailed   int
+	// Throughput is the number of bytes sent each second recently
+	Throughput float64
+	// ETA is how long the rest of the uploads should take at the current
+	// throughput, or zero if that isn't known yet
+	ETA time.Duration
+}
+
+// String describes the progress on one line, leaving out the stages that
+// haven't started
+func (s ProgressStats) String() string {
+	parts := []string{
+		fmt.Sprintf("scanned %d files (%s)", s.FilesScanned, FormatBytes(s.BytesScanned)),
+		fmt.Sprintf("hashed %d", s.FilesHashed),
+	}
+
+	if s.FilesQueued > 0 {
+		parts = append(parts, fmt.Sprintf(
+			"uploaded %d/%d files (%s/%s)",
+			s.FilesUploaded, s.FilesQueued, FormatBytes(s.BytesUploaded), FormatBytes(s.BytesQueued),
+		))
+	}
+
+	if s.FilesFailed > 0 {
+		parts = append(parts, fmt.Sprintf("%d failed", s.FilesFailed))
+	}
+
+	if s.Throughput > 0 {
+		parts = append(parts, fmt.Sprintf("%s/s", FormatBytes(int64(s.Throughput))))
+	}
+
+	if s.ETA > 0 {
+		parts = append(parts, fmt.Sprintf("ETA %s", s.ETA.Round(time.Second)))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// progressSample is the number of bytes sent at a moment in time
+type progressSample struct {
+	at   time.Time
+	sent int64
+}
+
+// Progress is a Reporter that counts the files and bytes at each stage of a
+// backup, so that they can be shown while it runs
+type Progress struct {
+	lock    sync.Mutex
+	stats   ProgressStats
+	samples []progressSample
+}
+
+// NewProgress creates a Progress with nothing counted
+func NewProgress() *Progress {
+	return &Progress{}
+}
+
+// Scanned counts a file that has been found
+func (p *Progress) Scanned(path string, size int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.stats.FilesScanned++
+	p.stats.BytesScanned += size
+}
+
+// Hashed counts a file that has been hashed
+func (p *Progress) Hashed(path string, size int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.stats.FilesHashed++
+	p.stats.BytesHashed += size
+}
+
+// Queued adds to the files that are to be uploaded
+func (p *Progress) Queued(files int, size int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.stats.FilesQueued += files
+	p.stats.BytesQueued += size
+}
+
+// Sent counts bytes that have been read by the store
+func (p *Progress) Sent(n int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.stats.BytesSent += n
+}
+
+// Uploaded counts a file that is in the store
+func (p *Progress) Uploaded(path string, size int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.stats.FilesUploaded++
+	p.stats.BytesUploaded += size
+}
+
+// Failed counts a file that has been left out of the backup
+func (p *Progress) Failed(path string, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.stats.FilesFailed++
+}
+
+// Stats finds how far the backup has got at the time 'now'. The throughput
+// is worked out from the bytes sent since the earliest call to Stats within
+// the last throughputWindow, so it needs to be called regularly.
+func (p *Progress) Stats(now time.Time) ProgressStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.samples = append(p.samples, progressSample{at: now, sent: p.stats.BytesSent})
+	for len(p.samples) > 2 && now.Sub(p.samples[1].at) >= throughputWindow {
+		p.samples = p.samples[1:]
+	}
+
+	stats := p.stats
+	first := p.samples[0]
+	if elapsed := now.Sub(first.at); elapsed > 0 {
+		stats.Throughput = float64(stats.BytesSent-first.sent) / elapsed.Seconds()
+	}
+
+	remaining := stats.BytesQueued - stats.BytesSent
+	if stats.Throughput > 0 && remaining > 0 {
+		stats.ETA = time.Duration(float64(remaining) / stats.Throughput * float64(time.Second))
+	}
+
+	return stats
+}
+
+// sentCounter counts what has been sent to the store for one file, so that it
+// can be taken off again if the upload has to start again
+type sentCounter struct {
+	reporter Reporter
+	sent     int64
+}
+
+// reader tells the Reporter about everything that is read from 'r'. It
+// should wrap the data just before it is given to the store, so that only
+// what the store reads is counted.
+func (s *sentCounter) reader(r io.Reader) io.Reader {
+	return &countingReader{r: r, counter: s}
+}
+
+// skipped takes data that doesn't need to be sent off what is queued
+func (s *sentCounter) skipped(n int64) {
+	s.reporter.Queued(0, -n)
+}
+
+// reset takes everything counted so far back off, before an upload starts
+// again
+func (s *sentCounter) reset() {
+	if sent := atomic.SwapInt64(&s.sent, 0); sent != 0 {
+		s.reporter.Sent(-sent)
+	}
+}
+
+// countingReader counts everything that is read through it
+type countingReader struct {
+	r       io.Reader
+	counter *sentCounter
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if n > 0 {
+		atomic.AddInt64(&c.counter.sent, int64(n))
+		c.counter.reporter.Sent(int64(n))
+	}
+
+	return n, err
+}
@@ -0,0 +1,169 @@
+package s3backup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dnnrly/s3backup/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgress_Stats(t *testing.T) {
+	p := NewProgress()
+	start := time.Now()
+
+	p.Scanned("a", 1000)
+	p.Scanned("b", 3000)
+	p.Hashed("a", 1000)
+	stats := p.Stats(start)
+	assert.Equal(t, 2, stats.FilesScanned)
+	assert.Equal(t, int64(4000), stats.BytesScanned)
+	assert.Equal(t, 1, stats.FilesHashed)
+	assert.Equal(t, int64(1000), stats.BytesHashed)
+	assert.Equal(t, 0.0, stats.Throughput)
+	assert.Equal(t, time.Duration(0), stats.ETA)
+
+	p.Queued(2, 4000)
+	p.Sent(1000)
+	p.Uploaded("a", 1000)
+	p.Failed("c", errors.New("oops"))
+	stats = p.Stats(start.Add(2 * time.Second))
+	assert.Equal(t, 2, stats.FilesQueued)
+	assert.Equal(t, 1, stats.FilesUploaded)
+	assert.Equal(t, int64(1000), stats.BytesUploaded)
+	assert.Equal(t, 1, stats.FilesFailed)
+	assert.Equal(t, 500.0, stats.Throughput)
+	assert.Equal(t, 6*time.Second, stats.ETA)
+
+	p.Sent(1000)
+	stats = p.Stats(start.Add(time.Minute))
+	assert.Equal(t, 1000.0/58, stats.Throughput, "only the last %s is used", throughputWindow)
+}
+
+func TestProgressStats_String(t *testing.T) {
+	assert.Equal(t, "scanned 2 files (2.0 KiB), hashed 1", ProgressStats{
+		FilesScanned: 2,
+		BytesScanned: 2048,
+		FilesHashed:  1,
+	}.String())
+
+	assert.Equal(t, "scanned 3 files (3.0 MiB), hashed 3, uploaded 1/2 files (1.0 MiB/2.0 MiB), 1 failed, 512.0 KiB/s, ETA 2s", ProgressStats{
+		FilesScanned:  3,
+		BytesScanned:  3 << 20,
+		FilesHashed:   3,
+		FilesQueued:   2,
+		BytesQueued:   2 << 20,
+		FilesUploaded: 1,
+		BytesUploaded: 1 << 20,
+		FilesFailed:   1,
+		Throughput:    512 << 10,
+		ETA:           2 * time.Second,
+	}.String())
+}
+
+func TestScanner_ReportsProgress(t *testing.T) {
+	root := createTestTree(t, map[string]string{
+		"a":     "file a",
+		"dir/b": "file bb",
+	})
+	defer os.RemoveAll(root)
+
+	p := NewProgress()
+	s := &Scanner{Walker: FilePathWalker, Hasher: FileHasher, Workers: 2, Progress: p}
+	_, err := s.Scan("", root)
+	require.NoError(t, err)
+
+	stats := p.Stats(time.Now())
+	assert.Equal(t, 2, stats.FilesScanned)
+	assert.Equal(t, int64(13), stats.BytesScanned)
+	assert.Equal(t, 2, stats.FilesHashed)
+	assert.Equal(t, int64(13), stats.BytesHashed)
+}
+
+func TestUploader_ReportsProgress(t *testing.T) {
+	local := &Index{Files: map[string]Sourcefile{
+		"a":    Sourcefile{Key: "a", Hash: "1", Size: 6},
+		"b":    Sourcefile{Key: "b", Hash: "2", Size: 7},
+		"gone": Sourcefile{Key: "gone", Hash: "3", Size: 100},
+	}}
+	getter := func(p string) (io.ReadCloser, error) {
+		if p == "gone" {
+			return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+		}
+		return ioutil.NopCloser(strings.NewReader(strings.Repeat(p, int(local.Files[p].Size)))), nil
+	}
+
+	p := NewProgress()
+	u := &Uploader{
+		Store:         &mockStore{FailAfter: 99},
+		GetFile:       getter,
+		ParallelLimit: 2,
+		FileErrors:    FileErrorConfig{Missing: PolicySkip},
+		Progress:      p,
+	}
+	_, err := u.Upload(local, &Index{Files: map[string]Sourcefile{}})
+	require.NoError(t, err)
+
+	stats := p.Stats(time.Now())
+	assert.Equal(t, 3, stats.FilesQueued)
+	assert.Equal(t, int64(113), stats.BytesQueued)
+	assert.Equal(t, int64(13), stats.BytesSent)
+	assert.Equal(t, 2, stats.FilesUploaded)
+	assert.Equal(t, int64(13), stats.BytesUploaded)
+	assert.Equal(t, 1, stats.FilesFailed)
+}
+
+func TestUploader_ProgressCountsRetriesOnce(t *testing.T) {
+	local := &Index{Files: map[string]Sourcefile{
+		"a": Sourcefile{Key: "a", Hash: hashOf("file a"), Size: 6},
+	}}
+
+	p := NewProgress()
+	u := &Uploader{
+		Store: newFlakyStore(&storage.TemporaryError{Err: errServer}, map[string]int{"a": 2}),
+		GetFile: func(p string) (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("file a")), nil
+		},
+		ParallelLimit: 1,
+		Retry:         fastRetry(3),
+		Progress:      p,
+	}
+	_, err := u.Upload(local, &Index{Files: map[string]Sourcefile{}})
+	require.NoError(t, err)
+
+	stats := p.Stats(time.Now())
+	assert.Equal(t, int64(6), stats.BytesSent)
+	assert.Equal(t, int64(6), stats.BytesQueued)
+}
+
+func TestUploader_ProgressLeavesOutStoredChunks(t *testing.T) {
+	data := randomData(3, 16*1024)
+	local := &Index{Files: map[string]Sourcefile{
+		"a": Sourcefile{Key: "a", Hash: hashOf(string(data)), Size: int64(len(data))},
+		"b": Sourcefile{Key: "b", Hash: hashOf(string(data)), Size: int64(len(data))},
+	}}
+
+	p := NewProgress()
+	u := &Uploader{
+		Store: &mockStore{FailAfter: 999},
+		GetFile: func(p string) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		},
+		ParallelLimit: 1,
+		Chunking:      ChunkConfig{Enabled: true, MinFileSize: 1024, AverageSize: 1024},
+		Progress:      p,
+	}
+	_, err := u.Upload(local, &Index{Files: map[string]Sourcefile{}})
+	require.NoError(t, err)
+
+	stats := p.Stats(time.Now())
+	assert.Equal(t, int64(len(data)), stats.BytesSent, "chunks are only sent once")
+	assert.Equal(t, int64(len(data)), stats.BytesQueued, "chunks that were already stored aren't waited for")
+}
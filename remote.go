@@ -0,0 +1,131 @@
+package s3backup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dnnrly/s3backup/storage"
+)
+
+// DefaultIndexRetries is how many times saving an index is tried again after
+// finding that someone else has changed it
+const DefaultIndexRetries = 5
+
+// ErrConflict is returned when an object in the store has been changed by
+// someone else since it was read
+var ErrConflict = storage.ErrConflict
+
+// RemoteIndex is an index in the store along with the version of it that was
+// last read or written. The index is only saved if nobody else has changed it
+// since then. When they have, the changes made since it was read are merged in
+// to their version and the save is tried again.
+type RemoteIndex struct {
+	// Lock is the lock held on the index. When it is set the index is only
+	// saved while the lock is still held.
+	Lock *Lock
+	// Retries is how many times the index is read, merged and saved again
+	// after a conflict before giving up
+	Retries int
+
+	store ObjectStore
+	key   string
+	etag  string
+	base  *Index
+}
+
+// NewRemoteIndex creates a RemoteIndex for the index at 'key' in the store
+func NewRemoteIndex(store ObjectStore, key string) *RemoteIndex {
+	return &RemoteIndex{
+		Retries: DefaultIndexRetries,
+		store:   store,
+		key:     key,
+	}
+}
+
+// Read gets the index from the store, remembering the version that was read.
+// An empty index is returned if there isn't one in the store yet.
+func (r *RemoteIndex) Read() (*Index, error) {
+	// The ETag is read first so that if the index changes before it is
+	// downloaded, the next save finds a conflict rather than losing changes
+	info, err := r.store.Head(r.key)
+	if errors.Is(err, os.ErrNotExist) {
+		doLog("Remote index %s does not exist, using empty index\n", r.key)
+		r.etag = ""
+		r.base = &Index{
+			Version: IndexVersion,
+			Files:   map[string]Sourcefile{},
+		}
+		return CopyIndex(r.base), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := r.store.GetByKey(r.key)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+
+	buf := &bytes.Buffer{}
+	if _, err := buf.ReadFrom(reader); err != nil {
+		return nil, fmt.Errorf("unable to read index %s: %w", r.key, err)
+	}
+
+	index, err := NewIndex(buf.String())
+	if err != nil {
+		return nil, err
+	}
+
+	r.etag = info.ETag
+	r.base = CopyIndex(index)
+	return index, nil
+}
+
+// Save writes the index to the store as long as nobody else has changed it
+// since it was read. If they have then it is read again and the changes made
+// to 'index' are merged in to it, updating 'index' with the result.
+func (r *RemoteIndex) Save(index *Index) error {
+	if r.base == nil {
+		return fmt.Errorf("index %s must be read before it is saved", r.key)
+	}
+
+	for attempt := 0; ; attempt++ {
+		if r.Lock != nil {
+			if err := r.Lock.Check(); err != nil {
+				return fmt.Errorf("not saving index %s: %w", r.key, err)
+			}
+		}
+
+		data, err := index.Encode()
+		if err != nil {
+			return err
+		}
+
+		doLog("Uploading index as %s\n", r.key)
+		etag, err := r.store.SaveIfMatch(r.key, strings.NewReader(data), r.etag)
+		if err == nil {
+			r.etag = etag
+			r.base = CopyIndex(index)
+			return nil
+		}
+		if !errors.Is(err, ErrConflict) || attempt >= r.Retries {
+			return err
+		}
+
+		doLog("Index %s has been changed by someone else, merging\n", r.key)
+		base := r.base
+		theirs, err := r.Read()
+		if err != nil {
+			return err
+		}
+
+		merged := index.Merge(base, theirs)
+		index.Version, index.Files = merged.Version, merged.Files
+	}
+}
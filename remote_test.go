@@ -0,0 +1,116 @@
+package s3backup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/dnnrly/s3backup/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteIndex_ReadMissing(t *testing.T) {
+	remote := NewRemoteIndex(memory.NewStore(), ".index.yaml")
+
+	index, err := remote.Read()
+
+	require.NoError(t, err)
+	assert.Empty(t, index.Files)
+	assert.Equal(t, IndexVersion, index.Version)
+}
+
+func TestRemoteIndex_Save(t *testing.T) {
+	store := memory.NewStore()
+	remote := NewRemoteIndex(store, ".index.yaml")
+	index, err := remote.Read()
+	require.NoError(t, err)
+
+	index.Add("a", Sourcefile{Key: "a", Hash: "1"})
+	require.NoError(t, remote.Save(index))
+	index.Add("b", Sourcefile{Key: "b", Hash: "2"})
+	require.NoError(t, remote.Save(index))
+
+	saved, err := NewRemoteIndex(store, ".index.yaml").Read()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "1", "b": "2"}, hashes(saved))
+
+	assert.Error(t, NewRemoteIndex(store, ".index.yaml").Save(index), "must be read first")
+}
+
+func TestRemoteIndex_MergesConflicts(t *testing.T) {
+	store := memory.NewStore()
+	first := NewRemoteIndex(store, ".index.yaml")
+	second := NewRemoteIndex(store, ".index.yaml")
+
+	ours, err := first.Read()
+	require.NoError(t, err)
+	theirs, err := second.Read()
+	require.NoError(t, err)
+
+	theirs.Add("theirs", Sourcefile{Key: "theirs", Hash: "2"})
+	require.NoError(t, second.Save(theirs))
+
+	ours.Add("ours", Sourcefile{Key: "ours", Hash: "1"})
+	require.NoError(t, first.Save(ours))
+
+	expected := map[string]string{"ours": "1", "theirs": "2"}
+	assert.Equal(t, expected, hashes(ours), "the index is updated with the merge")
+
+	saved, err := NewRemoteIndex(store, ".index.yaml").Read()
+	require.NoError(t, err)
+	assert.Equal(t, expected, hashes(saved))
+
+	theirs.Add("later", Sourcefile{Key: "later", Hash: "3"})
+	require.NoError(t, second.Save(theirs))
+	saved, err = NewRemoteIndex(store, ".index.yaml").Read()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"ours": "1", "theirs": "2", "later": "3"}, hashes(saved))
+}
+
+// conflictingStore changes the index every time it is about to be saved
+type conflictingStore struct {
+	*mockStore
+	saves int
+}
+
+func (c *conflictingStore) SaveIfMatch(key string, data io.Reader, etag string) (string, error) {
+	c.saves++
+	other := fmt.Sprintf("files: {other: {key: other, hash: %d}}", c.saves)
+	if err := c.mockStore.Save(key, bytes.NewBufferString(other)); err != nil {
+		return "", err
+	}
+
+	return c.mockStore.SaveIfMatch(key, data, etag)
+}
+
+func TestRemoteIndex_GivesUp(t *testing.T) {
+	store := &conflictingStore{mockStore: &mockStore{FailAfter: 99}}
+	remote := NewRemoteIndex(store, ".index.yaml")
+	remote.Retries = 2
+	index, err := remote.Read()
+	require.NoError(t, err)
+
+	err = remote.Save(index)
+
+	assert.True(t, errors.Is(err, ErrConflict))
+	assert.Equal(t, 3, store.saves)
+}
+
+func TestRemoteIndex_RequiresLock(t *testing.T) {
+	store := memory.NewStore()
+	lock, err := AcquireLock(store, ".index.yaml", time.Minute)
+	require.NoError(t, err)
+
+	remote := NewRemoteIndex(store, ".index.yaml")
+	remote.Lock = lock
+	index, err := remote.Read()
+	require.NoError(t, err)
+	require.NoError(t, remote.Save(index))
+
+	require.NoError(t, lock.Release())
+	assert.True(t, errors.Is(remote.Save(index), ErrLockLost))
+}
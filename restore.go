@@ -0,0 +1,90 @@
+package s3backup
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	restoreSuffix = ".s3backup-restore"
+)
+
+// RestoreFiles downloads every file in the index from the repository and writes
+// it to its original relative path below the target directory. Each file is
+// checked against the hash in the index before it is moved in to place.
+func RestoreFiles(index *Index, repo FileRepository, target string, parallelLimit int) error {
+	routineGroup := new(errgroup.Group)
+	limiter := make(chan struct{}, parallelLimit)
+
+	for p, src := range index.Files {
+		p, src := p, src // https://golang.org/doc/faq#closures_and_goroutines
+
+		limiter <- struct{}{}
+		routineGroup.Go(func() error {
+			defer func() {
+				<-limiter
+			}()
+
+			return restoreFile(repo, target, p, src)
+		})
+	}
+
+	return routineGroup.Wait()
+}
+
+func restoreFile(repo FileRepository, target, p string, src Sourcefile) error {
+	dest := restorePath(target, p)
+	doLog("Restoring %s to %s\n", src.Key, dest)
+
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return fmt.Errorf("unable to create directory for %s: %w", p, err)
+	}
+
+	r, err := openObject(repo, src)
+	if err != nil {
+		return fmt.Errorf("unable to download %s: %w", src.Key, err)
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	tmp := dest + restoreSuffix
+	f, err := os.Create(filepath.Clean(tmp))
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %w", tmp, err)
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), r)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("unable to write %s: %w", dest, err)
+	}
+
+	hash := encodeHash(h)
+	if hash != src.Hash {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("contents of %s do not match the index, expected hash %s but got %s", src.Key, src.Hash, hash)
+	}
+
+	return os.Rename(tmp, dest)
+}
+
+// restorePath works out where a file from the index should be written below
+// the target directory, making sure that it can't escape it
+func restorePath(target, p string) string {
+	p = filepath.FromSlash(normalisePath(p))
+	p = filepath.Clean(string(filepath.Separator) + p)
+
+	return filepath.Join(target, p)
+}
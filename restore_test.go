@@ -0,0 +1,97 @@
+package s3backup
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func hashOf(contents string) string {
+	h := sha256.Sum256([]byte(contents))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func TestRestoreFiles(t *testing.T) {
+	target, err := ioutil.TempDir("", "s3backup-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(target)
+
+	mock := &mockStore{
+		Keys:      []string{"a", "b", "c"},
+		Values:    []string{"file 1", "file 2", "file 3"},
+		FailAfter: 99,
+	}
+	index := &Index{
+		Files: map[string]Sourcefile{
+			"1":         Sourcefile{Key: "a", Hash: hashOf("file 1")},
+			"dir/2":     Sourcefile{Key: "b", Hash: hashOf("file 2")},
+			"dir/sub/3": Sourcefile{Key: "c", Hash: hashOf("file 3")},
+		},
+	}
+
+	err = RestoreFiles(index, mock, target, 2)
+	assert.NoError(t, err)
+
+	for p, expected := range map[string]string{
+		"1":         "file 1",
+		"dir/2":     "file 2",
+		"dir/sub/3": "file 3",
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(target, p))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(got))
+	}
+}
+
+func TestRestoreFiles_HashMismatch(t *testing.T) {
+	target, err := ioutil.TempDir("", "s3backup-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(target)
+
+	mock := &mockStore{
+		Keys:      []string{"a"},
+		Values:    []string{"corrupted"},
+		FailAfter: 99,
+	}
+	index := &Index{
+		Files: map[string]Sourcefile{
+			"1": Sourcefile{Key: "a", Hash: hashOf("file 1")},
+		},
+	}
+
+	err = RestoreFiles(index, mock, target, 2)
+	assert.Error(t, err)
+
+	_, err = os.Stat(filepath.Join(target, "1"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(target, "1"+restoreSuffix))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRestoreFiles_MissingObject(t *testing.T) {
+	target, err := ioutil.TempDir("", "s3backup-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(target)
+
+	index := &Index{
+		Files: map[string]Sourcefile{
+			"1": Sourcefile{Key: "a", Hash: hashOf("file 1")},
+		},
+	}
+
+	err = RestoreFiles(index, &mockStore{FailAfter: 99}, target, 2)
+	assert.Error(t, err)
+}
+
+func TestRestorePath(t *testing.T) {
+	assert.Equal(t, filepath.Join("out", "a", "b"), restorePath("out", "a/b"))
+	assert.Equal(t, filepath.Join("out", "a", "b"), restorePath("out", "/a/b"))
+	assert.Equal(t, filepath.Join("out", "a", "b"), restorePath("out", "a\\b"))
+	assert.Equal(t, filepath.Join("out", "b"), restorePath("out", "../../b"))
+}
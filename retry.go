@@ -0,0 +1,288 @@
+package s3backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"time"
+
+	"github.com/dnnrly/s3backup/storage"
+)
+
+const (
+	// DefaultRetryAttempts is how many times an operation on the store is
+	// tried when no number has been configured
+	DefaultRetryAttempts = 5
+	// DefaultRetryBackoff is how long to wait before the first retry when no
+	// backoff has been configured
+	DefaultRetryBackoff = 200 * time.Millisecond
+	// DefaultRetryMaxBackoff is the longest wait between retries when no
+	// maximum has been configured
+	DefaultRetryMaxBackoff = 30 * time.Second
+	// DefaultRetryJitter is the fraction of each wait that is random when no
+	// jitter has been configured
+	DefaultRetryJitter = 0.5
+)
+
+// RetryConfig controls how operations on the store are tried again when they
+// fail for a reason that may not last, such as a server error, being told to
+// slow down or a network timeout
+type RetryConfig struct {
+	// Attempts is the most times that an operation is tried, 1 means that it
+	// is never tried again
+	Attempts int `yaml:"attempts"`
+	// Backoff is how long to wait before the first retry, the wait doubles
+	// for every retry after that
+	Backoff time.Duration `yaml:"backoff"`
+	// MaxBackoff is the longest wait between retries
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	// Jitter is the fraction of each wait, between 0 and 1, that is chosen at
+	// random so that many retries don't all happen at the same moment
+	Jitter float64 `yaml:"jitter"`
+}
+
+// Validate checks that the retry config makes sense
+func (c RetryConfig) Validate() error {
+	if c.Attempts < 0 {
+		return fmt.Errorf("retry attempts must not be negative")
+	}
+
+	if c.Backoff < 0 || c.MaxBackoff < 0 {
+		return fmt.Errorf("retry backoff must not be negative")
+	}
+
+	if c.Jitter < 0 || c.Jitter > 1 {
+		return fmt.Errorf("retry jitter must be between 0 and 1")
+	}
+
+	return nil
+}
+
+// Retry calls 'fn' until it succeeds, it fails with an error that isn't
+// temporary or it has been called Attempts times. If it is still failing
+// after all of the attempts then the error says so and is no longer
+// temporary, so that it isn't retried again further up. If the context is
+// cancelled while waiting to try again then the context's error is returned.
+func (c RetryConfig) Retry(ctx context.Context, op string, fn func() error) error {
+	attempts := c.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !storage.Temporary(err) {
+			return err
+		}
+
+		if attempt >= attempts {
+			if attempts == 1 {
+				return err
+			}
+			return &retryError{attempts: attempts, err: err}
+		}
+
+		wait := c.backoff(attempt)
+		doLog("Failed %s, trying again in %s: %s\n", op, wait, err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff is how long to wait after the failure of attempt number 'attempt'
+func (c RetryConfig) backoff(attempt int) time.Duration {
+	wait := c.Backoff
+	for i := 1; i < attempt && (c.MaxBackoff <= 0 || wait < c.MaxBackoff); i++ {
+		wait *= 2
+	}
+
+	if c.MaxBackoff > 0 && wait > c.MaxBackoff {
+		wait = c.MaxBackoff
+	}
+
+	if c.Jitter > 0 && wait > 0 {
+		wait -= time.Duration(rand.Int63n(int64(float64(wait)*c.Jitter) + 1))
+	}
+
+	return wait
+}
+
+// retryError is a temporary error that was still happening after every
+// attempt had been made
+type retryError struct {
+	attempts int
+	err      error
+}
+
+func (e *retryError) Error() string {
+	return fmt.Sprintf("gave up after %d attempts: %s", e.attempts, e.err)
+}
+
+func (e *retryError) Unwrap() error {
+	return e.err
+}
+
+// Temporary is false because the error has already been retried
+func (e *retryError) Temporary() bool {
+	return false
+}
+
+// RetryStore tries operations on a store again when they fail for a reason
+// that may not last. Data that is saved can only be sent again if it can be
+// rewound, so saves of streams are tried once and are left to be retried by
+// whoever can open the stream again.
+//
+// Operations aren't given a context, so they are always retried. This means
+// that the index saved after a backup is interrupted still gets every
+// attempt.
+type RetryStore struct {
+	ObjectStore
+	Retry RetryConfig
+}
+
+// GetByKey retrieves the data at a certain location in your store, retrying
+// if it can't be opened
+func (s *RetryStore) GetByKey(key string) (io.ReadCloser, error) {
+	var r io.ReadCloser
+	err := s.Retry.Retry(context.Background(), "reading "+key, func() error {
+		var err error
+		r, err = s.ObjectStore.GetByKey(key)
+		return err
+	})
+
+	return r, err
+}
+
+// GetRange retrieves part of the data at a certain location in your store,
+// retrying if it can't be opened
+func (s *RetryStore) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	var r io.ReadCloser
+	err := s.Retry.Retry(context.Background(), "reading "+key, func() error {
+		var err error
+		r, err = s.ObjectStore.GetRange(key, offset, length)
+		return err
+	})
+
+	return r, err
+}
+
+// Save puts the data at a location in your store, retrying if the data can
+// be rewound
+func (s *RetryStore) Save(key string, data io.Reader) error {
+	rewind := rewinder(data)
+	if rewind == nil {
+		return s.ObjectStore.Save(key, data)
+	}
+
+	return s.Retry.Retry(context.Background(), "saving "+key, func() error {
+		if err := rewind(); err != nil {
+			return err
+		}
+		return s.ObjectStore.Save(key, data)
+	})
+}
+
+// SaveIfMatch saves an object only if it hasn't changed, retrying if the
+// data can be rewound
+func (s *RetryStore) SaveIfMatch(key string, data io.Reader, etag string) (string, error) {
+	rewind := rewinder(data)
+	if rewind == nil {
+		return s.ObjectStore.SaveIfMatch(key, data, etag)
+	}
+
+	var saved string
+	err := s.Retry.Retry(context.Background(), "saving "+key, func() error {
+		if err := rewind(); err != nil {
+			return err
+		}
+		var err error
+		saved, err = s.ObjectStore.SaveIfMatch(key, data, etag)
+		return err
+	})
+
+	return saved, err
+}
+
+// List calls 'fn' for every object with a key that starts with 'prefix'. The
+// listing is only tried again if it fails before any objects have been
+// passed to 'fn', so that none of them are seen twice.
+func (s *RetryStore) List(prefix string, fn func(ObjectInfo) error) error {
+	var failed error
+	err := s.Retry.Retry(context.Background(), "listing "+prefix, func() error {
+		listed := false
+		err := s.ObjectStore.List(prefix, func(info ObjectInfo) error {
+			listed = true
+			return fn(info)
+		})
+		if err != nil && listed {
+			failed = err
+			return nil
+		}
+
+		return err
+	})
+	if failed != nil {
+		return failed
+	}
+
+	return err
+}
+
+// Head retrieves the details of the object at a certain location, retrying
+// if they can't be read
+func (s *RetryStore) Head(key string) (ObjectInfo, error) {
+	var info ObjectInfo
+	err := s.Retry.Retry(context.Background(), "reading "+key, func() error {
+		var err error
+		info, err = s.ObjectStore.Head(key)
+		return err
+	})
+
+	return info, err
+}
+
+// Copy puts a copy of the object at 'from' at the location 'to', retrying if
+// it fails
+func (s *RetryStore) Copy(from, to string) error {
+	return s.Retry.Retry(context.Background(), "copying "+from, func() error {
+		return s.ObjectStore.Copy(from, to)
+	})
+}
+
+// Delete removes the data at each of the locations in your store, retrying
+// if it fails
+func (s *RetryStore) Delete(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	return s.Retry.Retry(context.Background(), "deleting "+keys[0], func() error {
+		return s.ObjectStore.Delete(keys...)
+	})
+}
+
+// rewinder returns a function that puts 'data' back to where it is now so
+// that it can be sent again, or nil if it can't be rewound
+func rewinder(data io.Reader) func() error {
+	s, ok := data.(io.Seeker)
+	if !ok {
+		return nil
+	}
+
+	start, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil
+	}
+
+	return func() error {
+		_, err := s.Seek(start, io.SeekStart)
+		return err
+	}
+}
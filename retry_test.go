@@ -0,0 +1,296 @@
+package s3backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dnnrly/s3backup/memory"
+	"github.com/dnnrly/s3backup/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errServer = errors.New("503 Service Unavailable")
+
+// flakyStore fails operations on keys a set number of times before passing
+// them on to the store underneath
+type flakyStore struct {
+	ObjectStore
+	lock     sync.Mutex
+	failures map[string]int
+	err      error
+	calls    map[string]int
+}
+
+func newFlakyStore(err error, failures map[string]int) *flakyStore {
+	return &flakyStore{
+		ObjectStore: memory.NewStore(),
+		failures:    failures,
+		err:         err,
+		calls:       map[string]int{},
+	}
+}
+
+func (s *flakyStore) fail(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.calls[key]++
+	if s.failures[key] == 0 {
+		return nil
+	}
+	if s.failures[key] > 0 {
+		s.failures[key]--
+	}
+
+	return s.err
+}
+
+func (s *flakyStore) Save(key string, data io.Reader) error {
+	if err := s.fail(key); err != nil {
+		_, _ = ioutil.ReadAll(data)
+		return err
+	}
+
+	return s.ObjectStore.Save(key, data)
+}
+
+func (s *flakyStore) SaveIfMatch(key string, data io.Reader, etag string) (string, error) {
+	if err := s.fail(key); err != nil {
+		_, _ = ioutil.ReadAll(data)
+		return "", err
+	}
+
+	return s.ObjectStore.SaveIfMatch(key, data, etag)
+}
+
+func (s *flakyStore) GetByKey(key string) (io.ReadCloser, error) {
+	if err := s.fail(key); err != nil {
+		return nil, err
+	}
+
+	return s.ObjectStore.GetByKey(key)
+}
+
+func fastRetry(attempts int) RetryConfig {
+	return RetryConfig{Attempts: attempts, Backoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string { return "i/o timeout" }
+func (timeoutError) Timeout() bool { return true }
+
+func TestTemporary(t *testing.T) {
+	tests := []struct {
+		err       error
+		temporary bool
+	}{
+		{nil, false},
+		{errServer, false},
+		{&storage.TemporaryError{Err: errServer}, true},
+		{fmt.Errorf("saving: %w", &storage.TemporaryError{Err: errServer}), true},
+		{&storage.TemporaryError{Err: os.ErrNotExist}, false},
+		{&storage.TemporaryError{Err: storage.ErrConflict}, false},
+		{&net.OpError{Op: "read", Err: timeoutError{}}, true},
+		{fmt.Errorf("reading: %w", timeoutError{}), true},
+		{&retryError{attempts: 3, err: &storage.TemporaryError{Err: errServer}}, false},
+	}
+
+	for i, tt := range tests {
+		assert.Equal(t, tt.temporary, storage.Temporary(tt.err), "test %d: %v", i, tt.err)
+	}
+}
+
+func TestRetryConfig_Retry(t *testing.T) {
+	temporary := &storage.TemporaryError{Err: errServer}
+
+	calls := 0
+	err := fastRetry(3).Retry(context.Background(), "testing", func() error {
+		calls++
+		if calls < 3 {
+			return temporary
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = fastRetry(3).Retry(context.Background(), "testing", func() error {
+		calls++
+		return temporary
+	})
+	assert.Equal(t, 3, calls)
+	assert.True(t, errors.Is(err, errServer))
+	assert.False(t, storage.Temporary(err), "errors that have been retried aren't retried again")
+	assert.Contains(t, err.Error(), "gave up after 3 attempts")
+
+	calls = 0
+	err = fastRetry(3).Retry(context.Background(), "testing", func() error {
+		calls++
+		return errServer
+	})
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, errServer, err)
+
+	calls = 0
+	err = RetryConfig{}.Retry(context.Background(), "testing", func() error {
+		calls++
+		return temporary
+	})
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, temporary, err)
+}
+
+func TestRetryConfig_RetryCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	err := RetryConfig{Attempts: 5, Backoff: time.Minute}.Retry(ctx, "testing", func() error {
+		calls++
+		return &storage.TemporaryError{Err: errServer}
+	})
+
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 1, calls)
+	assert.True(t, time.Since(start) < 10*time.Second, "waited for the backoff after being cancelled")
+}
+
+func TestRetryConfig_Backoff(t *testing.T) {
+	c := RetryConfig{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	assert.Equal(t, 100*time.Millisecond, c.backoff(1))
+	assert.Equal(t, 200*time.Millisecond, c.backoff(2))
+	assert.Equal(t, 800*time.Millisecond, c.backoff(4))
+	assert.Equal(t, time.Second, c.backoff(5))
+	assert.Equal(t, time.Second, c.backoff(100))
+
+	c.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		wait := c.backoff(2)
+		assert.True(t, wait >= 100*time.Millisecond && wait <= 200*time.Millisecond, "%s", wait)
+	}
+}
+
+func TestRetryConfig_Validate(t *testing.T) {
+	assert.NoError(t, RetryConfig{}.Validate())
+	assert.NoError(t, RetryConfig{Attempts: 3, Backoff: time.Second, Jitter: 1}.Validate())
+	assert.Error(t, RetryConfig{Attempts: -1}.Validate())
+	assert.Error(t, RetryConfig{MaxBackoff: -time.Second}.Validate())
+	assert.Error(t, RetryConfig{Jitter: 1.5}.Validate())
+}
+
+func TestRetryStore(t *testing.T) {
+	flaky := newFlakyStore(&storage.TemporaryError{Err: errServer}, map[string]int{"a": 2, "b": 2})
+	store := &RetryStore{ObjectStore: flaky, Retry: fastRetry(3)}
+
+	require.NoError(t, store.Save("a", strings.NewReader("contents of a")))
+	assert.Equal(t, 3, flaky.calls["a"])
+	assert.Equal(t, "contents of a", readKey(t, store, "a"))
+
+	err := store.Save("b", ioutil.NopCloser(strings.NewReader("contents of b")))
+	assert.True(t, errors.Is(err, errServer), "streams that can't be rewound are only tried once")
+	assert.Equal(t, 1, flaky.calls["b"])
+
+	flaky.failures["a"] = 1
+	flaky.calls["a"] = 0
+	assert.Equal(t, "contents of a", readKey(t, store, "a"))
+	assert.Equal(t, 2, flaky.calls["a"])
+
+	_, err = store.GetByKey("missing")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	assert.Equal(t, 1, flaky.calls["missing"])
+}
+
+func TestUploader_RetriesFailedUploads(t *testing.T) {
+	store := newFlakyStore(&storage.TemporaryError{Err: errServer}, map[string]int{"file-002": 2})
+	u := &Uploader{Store: store, GetFile: emptyGetter, ParallelLimit: 2, BatchSize: 2, Retry: fastRetry(3)}
+
+	updated, err := u.Upload(uploadTestIndex(5), &Index{Files: map[string]Sourcefile{}})
+
+	require.NoError(t, err)
+	assert.Equal(t, 5, len(updated.Files))
+	assert.Equal(t, 3, store.calls["file-002"])
+}
+
+func TestUploader_ContinueOnError(t *testing.T) {
+	store := newFlakyStore(errServer, map[string]int{"file-001": -1, "file-003": -1})
+	u := &Uploader{
+		Store:           store,
+		GetFile:         emptyGetter,
+		ParallelLimit:   2,
+		BatchSize:       2,
+		Retry:           fastRetry(3),
+		ContinueOnError: true,
+	}
+
+	updated, err := u.UploadContext(context.Background(), uploadTestIndex(6), &Index{Files: map[string]Sourcefile{}})
+
+	failed := &UploadError{}
+	require.True(t, errors.As(err, &failed), "%v", err)
+	assert.Equal(t, []string{"file-001", "file-003"}, []string{failed.Failed[0].Path, failed.Failed[1].Path})
+	assert.Equal(t, errServer, failed.Failed[0].Err)
+	assert.Equal(t, 1, store.calls["file-001"], "errors that won't go away aren't retried")
+	assert.Contains(t, err.Error(), "unable to upload 2 files, including file-001")
+
+	require.NotNil(t, updated)
+	assert.Equal(t, 4, len(updated.Files))
+	assert.NotContains(t, updated.Files, "file-001")
+	assert.NotContains(t, updated.Files, "file-003")
+
+	saved, err := store.GetByKey(indexFile)
+	require.NoError(t, err)
+	defer saved.Close()
+	data, err := ioutil.ReadAll(saved)
+	require.NoError(t, err)
+	index, err := NewIndex(string(data))
+	require.NoError(t, err)
+	assert.Equal(t, updated.Files, index.Files, "the files that were uploaded are saved")
+
+	u.ContinueOnError = false
+	_, err = u.Upload(uploadTestIndex(6), &Index{Files: map[string]Sourcefile{}})
+	assert.Equal(t, errServer, err)
+}
+
+func TestUploader_ContinueOnErrorSkipsDuplicates(t *testing.T) {
+	store := newFlakyStore(errServer, map[string]int{"shared": -1})
+	local := &Index{Files: map[string]Sourcefile{
+		"a": Sourcefile{Key: "shared", Hash: "same"},
+		"b": Sourcefile{Key: "shared", Hash: "same"},
+		"c": Sourcefile{Key: "c", Hash: "other"},
+	}}
+	u := &Uploader{Store: store, GetFile: emptyGetter, ParallelLimit: 1, ContinueOnError: true}
+
+	updated, err := u.Upload(local, &Index{Files: map[string]Sourcefile{}})
+
+	failed := &UploadError{}
+	require.True(t, errors.As(err, &failed), "%v", err)
+	require.Equal(t, 2, len(failed.Failed))
+	assert.Equal(t, "a", failed.Failed[0].Path)
+	assert.Equal(t, "b", failed.Failed[1].Path)
+	assert.Equal(t, []string{"c"}, paths(updated))
+}
+
+func readKey(t *testing.T, store FileRepository, key string) string {
+	r, err := store.GetByKey(key)
+	require.NoError(t, err)
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	return string(data)
+}
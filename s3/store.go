@@ -2,13 +2,35 @@ package s3
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/dnnrly/s3backup/storage"
+)
+
+const (
+	// DefaultDownloadPartSize is the size of each part of a large object that
+	// is downloaded when no other size has been configured
+	DefaultDownloadPartSize = 16 * 1024 * 1024
+	// DefaultDownloadConcurrency is the number of parts of a large object
+	// that are downloaded at the same time when no other number has been
+	// configured
+	DefaultDownloadConcurrency = 5
+
+	// maxDeleteBatch is the most objects that S3 will delete in one request
+	maxDeleteBatch = 1000
 )
 
 // Config is configuration related to storage in S3
@@ -16,6 +38,15 @@ type Config struct {
 	Endpoint string `yaml:"endpoint"`
 	Bucket   string `yaml:"bucket"`
 	Region   string `yaml:"region"`
+	// Prefix is put in front of every key, so that everything is stored
+	// below this location in the bucket
+	Prefix string `yaml:"prefix"`
+	// DownloadPartSize is the size in bytes of each part of an object that is
+	// downloaded on its own, objects larger than this are downloaded in parts
+	DownloadPartSize int64 `yaml:"download_part_size"`
+	// DownloadConcurrency is the most parts of an object that are downloaded
+	// at the same time
+	DownloadConcurrency int `yaml:"download_concurrency"`
 
 	ID    string `yaml:"id"`
 	Key   string `yaml:"key"`
@@ -24,8 +55,11 @@ type Config struct {
 
 // Store allows you to access your files in an S3 bucket
 type Store struct {
-	sess   *session.Session
-	bucket string
+	sess        *session.Session
+	bucket      string
+	prefix      string
+	partSize    int64
+	concurrency int
 }
 
 // NewStore creates a new Store for you
@@ -51,31 +85,131 @@ func NewStore(config Config) (*Store, error) {
 	}
 
 	store := &Store{
-		sess:   sess,
-		bucket: config.Bucket,
+		sess:        sess,
+		bucket:      config.Bucket,
+		prefix:      strings.Trim(config.Prefix, "/"),
+		partSize:    config.DownloadPartSize,
+		concurrency: config.DownloadConcurrency,
+	}
+
+	if store.partSize <= 0 {
+		store.partSize = DefaultDownloadPartSize
+	}
+
+	if store.concurrency <= 0 {
+		store.concurrency = DefaultDownloadConcurrency
 	}
 
 	return store, nil
 }
 
-// GetByKey retrieves the data at a certain location in your bucket
-func (s *Store) GetByKey(key string) (io.Reader, error) {
-	results, err := s3.New(s.sess).GetObject(&s3.GetObjectInput{
+// GetByKey retrieves the data at a certain location in your bucket. If there
+// is nothing at that location then the error will match os.ErrNotExist. The
+// data is streamed from the bucket, with large objects downloaded in several
+// parts at the same time.
+//
+// Only the first part is asked for at first, which also gives the size of
+// the object. If there is more then the rest of the parts are fetched with
+// no more than the configured concurrency at once.
+func (s *Store) GetByKey(key string) (io.ReadCloser, error) {
+	result, err := s3.New(s.sess).GetObject(&s3.GetObjectInput{
 		Bucket: aws.String(s.bucket),
-		Key:    aws.String(key),
+		Key:    aws.String(s.key(key)),
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", s.partSize-1)),
 	})
+	if invalidRange(err) {
+		// only an empty object has no first byte
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
 	if err != nil {
-		return nil, err
+		return nil, translateError(key, err)
 	}
-	defer func() {
-		_ = results.Body.Close()
-	}()
 
-	buf := bytes.NewBuffer(nil)
-	if _, err := io.Copy(buf, results.Body); err != nil {
+	size, ranged := objectSize(result.ContentRange)
+	if !ranged || size <= s.partSize {
+		return result.Body, nil
+	}
+
+	first := make([]byte, aws.Int64Value(result.ContentLength))
+	_, err = io.ReadFull(result.Body, first)
+	_ = result.Body.Close()
+	if err != nil {
 		return nil, err
 	}
-	return buf, nil
+
+	etag := result.ETag
+	return storage.NewParallelReader(first, size, s.partSize, s.concurrency, func(offset, length int64) ([]byte, error) {
+		r, err := s.getRange(key, offset, length, etag)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = r.Close()
+		}()
+
+		data := make([]byte, length)
+		_, err = io.ReadFull(r, data)
+		return data, err
+	}), nil
+}
+
+// invalidRange returns true if S3 refused to return a range of an object
+// because the object doesn't have any bytes in it
+func invalidRange(err error) bool {
+	if aerr, ok := err.(awserr.RequestFailure); ok {
+		return aerr.Code() == "InvalidRange" || aerr.StatusCode() == 416
+	}
+
+	return false
+}
+
+// objectSize finds the size of a whole object from the Content-Range of part
+// of it, such as "bytes 0-99/1000". It returns false if the header is missing,
+// which means that the whole object was returned.
+func objectSize(contentRange *string) (int64, bool) {
+	r := aws.StringValue(contentRange)
+	i := strings.LastIndex(r, "/")
+	if i < 0 {
+		return 0, false
+	}
+
+	size, err := strconv.ParseInt(r[i+1:], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return size, true
+}
+
+// GetRange retrieves 'length' bytes of the data at a certain location in your
+// bucket, starting at 'offset'. A negative length reads to the end.
+func (s *Store) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	return s.getRange(key, offset, length, nil)
+}
+
+// getRange reads part of an object, failing if the object no longer has the
+// ETag given
+func (s *Store) getRange(key string, offset, length int64, etag *string) (io.ReadCloser, error) {
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		byteRange = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	}
+
+	result, err := s3.New(s.sess).GetObject(&s3.GetObjectInput{
+		Bucket:  aws.String(s.bucket),
+		Key:     aws.String(s.key(key)),
+		Range:   aws.String(byteRange),
+		IfMatch: etag,
+	})
+	if err != nil {
+		return nil, translateError(key, err)
+	}
+
+	return result.Body, nil
 }
 
 // Save puts the data at a location in your bucket
@@ -84,10 +218,201 @@ func (s *Store) Save(key string, data io.Reader) error {
 
 	_, err := uploader.Upload(&s3manager.UploadInput{
 		Bucket: aws.String(s.bucket),
-		Key:    aws.String(key),
+		Key:    aws.String(s.key(key)),
 		Body:   data,
 	})
 
+	return translateError(key, err)
+}
+
+// SaveIfMatch puts the data at a location in your bucket, as long as the
+// object there still has the ETag 'etag'. An empty ETag means that there must
+// not be an object there. If the object has changed then the error will match
+// storage.ErrConflict. It returns the ETag of the saved object.
+//
+// The data is sent in a single request, so this is only meant for small
+// objects like the index.
+func (s *Store) SaveIfMatch(key string, data io.Reader, etag string) (string, error) {
+	body, err := ioutil.ReadAll(data)
+	if err != nil {
+		return "", err
+	}
+
+	req, result := s3.New(s.sess).PutObjectRequest(&s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+		Body:   bytes.NewReader(body),
+	})
+	req.Handlers.Build.PushBack(func(r *request.Request) {
+		if etag == "" {
+			r.HTTPRequest.Header.Set("If-None-Match", "*")
+		} else {
+			r.HTTPRequest.Header.Set("If-Match", strconv.Quote(etag))
+		}
+	})
+
+	if err := req.Send(); err != nil {
+		return "", translateError(key, err)
+	}
+
+	return strings.Trim(aws.StringValue(result.ETag), "\""), nil
+}
+
+// translateError converts errors from S3 in to their equivalent standard errors
+func translateError(key string, err error) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return fmt.Errorf("%s: %w", key, os.ErrNotExist)
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return fmt.Errorf("%s: %w", key, storage.ErrConflict)
+		}
+
+		if retryable(aerr) {
+			return &storage.TemporaryError{Err: err}
+		}
+	}
+
 	return err
+}
+
+// retryable returns true if an error from S3 is one that may not happen if
+// the request is made again, such as a server error or being told to slow
+// down
+func retryable(err awserr.Error) bool {
+	switch err.Code() {
+	case "SlowDown", "InternalError", "ServiceUnavailable", "RequestTimeout":
+		return true
+	}
+
+	if rerr, ok := err.(awserr.RequestFailure); ok && rerr.StatusCode() >= 500 {
+		return true
+	}
+
+	return request.IsErrorThrottle(err) || request.IsErrorRetryable(err)
+}
+
+// List calls 'fn' for every object in your bucket with a key that starts with
+// 'prefix', in order of key. Objects are fetched a page at a time.
+func (s *Store) List(prefix string, fn func(storage.ObjectInfo) error) error {
+	var fnErr error
+	err := s3.New(s.sess).ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.key(prefix)),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, o := range page.Contents {
+			fnErr = fn(storage.ObjectInfo{
+				Key:          s.trimKey(aws.StringValue(o.Key)),
+				Size:         aws.Int64Value(o.Size),
+				ETag:         strings.Trim(aws.StringValue(o.ETag), "\""),
+				LastModified: aws.TimeValue(o.LastModified),
+			})
+			if fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return translateError(prefix, err)
+	}
+
+	return fnErr
+}
+
+// Head retrieves the details of the object at a certain location in your
+// bucket. If there is nothing at that location then the error will match
+// os.ErrNotExist.
+func (s *Store) Head(key string) (storage.ObjectInfo, error) {
+	result, err := s3.New(s.sess).HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	if err != nil {
+		return storage.ObjectInfo{}, translateError(key, err)
+	}
+
+	return storage.ObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(result.ContentLength),
+		ETag:         strings.Trim(aws.StringValue(result.ETag), "\""),
+		LastModified: aws.TimeValue(result.LastModified),
+		Metadata:     aws.StringValueMap(result.Metadata),
+	}, nil
+}
+
+// Copy puts a copy of the object at 'from' at the location 'to' without
+// downloading it. S3 only allows objects up to 5GB to be copied like this.
+func (s *Store) Copy(from, to string) error {
+	source := []string{}
+	for _, part := range strings.Split(s.bucket+"/"+s.key(from), "/") {
+		source = append(source, url.PathEscape(part))
+	}
+
+	_, err := s3.New(s.sess).CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String(s.bucket),
+		Key:        aws.String(s.key(to)),
+		CopySource: aws.String(strings.Join(source, "/")),
+	})
+
+	return translateError(from, err)
+}
+
+// Delete removes the data at each of the locations in your bucket, deleting
+// up to 1000 objects in each request
+func (s *Store) Delete(keys ...string) error {
+	client := s3.New(s.sess)
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > maxDeleteBatch {
+			batch = keys[:maxDeleteBatch]
+		}
+		keys = keys[len(batch):]
+
+		objects := make([]*s3.ObjectIdentifier, 0, len(batch))
+		for _, k := range batch {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(s.key(k))})
+		}
+
+		result, err := client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &s3.Delete{
+				Objects: objects,
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return translateError(batch[0], err)
+		}
+
+		if len(result.Errors) > 0 {
+			e := result.Errors[0]
+			return fmt.Errorf(
+				"unable to delete %d objects, including %s: %s",
+				len(result.Errors),
+				s.trimKey(aws.StringValue(e.Key)),
+				aws.StringValue(e.Message),
+			)
+		}
+	}
+
+	return nil
+}
+
+// key finds the location in the bucket of a key
+func (s *Store) key(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+
+	return s.prefix + "/" + key
+}
+
+// trimKey finds the key of a location in the bucket
+func (s *Store) trimKey(key string) string {
+	if s.prefix == "" {
+		return key
+	}
 
+	return strings.TrimPrefix(key, s.prefix+"/")
 }
@@ -0,0 +1,220 @@
+package s3backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+var (
+	// DefaultHashWorkers is the number of files hashed at the same time when
+	// no other value has been configured
+	DefaultHashWorkers = runtime.NumCPU()
+)
+
+// Scanner creates an Index from the files in a directory tree. The tree is
+// walked first and then the files found are hashed by a pool of workers.
+type Scanner struct {
+	// Walker finds the files to put in the index
+	Walker PathWalker
+	// Hasher creates the hash of each file
+	Hasher PathHasher
+	// Workers is the number of files that are hashed at the same time
+	Workers int
+	// Cache holds the hashes from the last scan, files that haven't changed
+	// since then are not hashed again. The cache is updated with the results
+	// of this scan. Nothing is cached if this is nil.
+	Cache *Cache
+	// Ignore decides which files are left out of the index. Every file is
+	// included if this is nil.
+	Ignore *Ignorer
+	// FileErrors decides what happens to files that disappear or can't be
+	// read while they are being scanned. The scan stops if there is no
+	// policy for the problem.
+	FileErrors FileErrorConfig
+	// Skipped records the files that are left out of the index with
+	// PolicyWarn
+	Skipped *SkipLog
+	// Progress is told about each file as it is found and hashed
+	Progress Reporter
+}
+
+// Scan creates a new Index populated from a filesystem directory
+func (s *Scanner) Scan(bucketRoot, path string) (*Index, error) {
+	return s.ScanContext(context.Background(), bucketRoot, path)
+}
+
+// ScanContext creates a new Index in the same way as Scan. Cancelling the
+// context stops the scan once the files being hashed are finished, returning
+// the context's error.
+func (s *Scanner) ScanContext(ctx context.Context, bucketRoot, path string) (*Index, error) {
+	i := &Index{
+		Version: IndexVersion,
+		Files:   map[string]Sourcefile{},
+	}
+
+	walk := s.reportScanned(s.Walker(bucketRoot, path, i))
+	if s.Ignore != nil {
+		walk = s.Ignore.Walk(path, walk)
+	}
+	walk = s.handleErrors(path, walk)
+
+	err := filepath.Walk(path, func(p string, f os.FileInfo, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return walk(p, f, err)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.hashAll(ctx, i)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Cache != nil {
+		s.Cache.Prune(i)
+	}
+
+	return i, nil
+}
+
+// reportScanned wraps a WalkFunc so that Progress is told about each file
+// that it accepts
+func (s *Scanner) reportScanned(walk filepath.WalkFunc) filepath.WalkFunc {
+	progress := reporterOr(s.Progress)
+
+	return func(p string, f os.FileInfo, err error) error {
+		if err := walk(p, f, err); err != nil {
+			return err
+		}
+
+		if f != nil && !f.IsDir() {
+			progress.Scanned(p, f.Size())
+		}
+		return nil
+	}
+}
+
+// handleErrors wraps a WalkFunc so that files and directories below 'root'
+// that can't be read are dealt with by the policies in FileErrors
+func (s *Scanner) handleErrors(root string, walk filepath.WalkFunc) filepath.WalkFunc {
+	root = filepath.Clean(root)
+
+	return func(p string, f os.FileInfo, err error) error {
+		if err != nil && filepath.Clean(p) != root {
+			rel, relErr := relativePath(root, p)
+			if relErr != nil {
+				return err
+			}
+			return s.FileErrors.handle(p, rel, err, s.Skipped)
+		}
+
+		return walk(p, f, err)
+	}
+}
+
+// hashAll fills in the hash of every file in the index. Files that can't be
+// hashed are left out of it if their policy allows.
+func (s *Scanner) hashAll(ctx context.Context, i *Index) error {
+	workers := s.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	toHash := make([]string, 0, len(i.Files))
+	for p := range i.Files {
+		toHash = append(toHash, p)
+	}
+
+	routineGroup, ctx := errgroup.WithContext(ctx)
+	paths := make(chan string)
+	lock := sync.Mutex{}
+	progress := reporterOr(s.Progress)
+
+	routineGroup.Go(func() error {
+		defer close(paths)
+		for _, p := range toHash {
+			select {
+			case paths <- p:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+
+	for w := 0; w < workers; w++ {
+		routineGroup.Go(func() error {
+			for p := range paths {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+
+				lock.Lock()
+				src := i.Files[p]
+				lock.Unlock()
+
+				hash, err := s.hash(p, src)
+				if err != nil {
+					if err := s.FileErrors.handle(src.localPath(p), p, err, s.Skipped); err != nil {
+						return fmt.Errorf("unable to hash %s: %w", p, err)
+					}
+					progress.Failed(src.localPath(p), err)
+
+					lock.Lock()
+					delete(i.Files, p)
+					lock.Unlock()
+					continue
+				}
+
+				lock.Lock()
+				src.Hash = hash
+				i.Files[p] = src
+				lock.Unlock()
+				progress.Hashed(p, src.Size)
+			}
+			return nil
+		})
+	}
+
+	return routineGroup.Wait()
+}
+
+// hash finds the hash of a single file, using the cache if the file hasn't
+// changed
+func (s *Scanner) hash(p string, src Sourcefile) (string, error) {
+	local := src.localPath(p)
+	if s.Cache == nil {
+		doLog("Hashing %s", local)
+		return s.Hasher(local)
+	}
+
+	info, err := os.Stat(local)
+	if err != nil {
+		return "", err
+	}
+
+	if hash, found := s.Cache.Lookup(p, info); found {
+		doLog("Using cached hash of %s", local)
+		return hash, nil
+	}
+
+	doLog("Hashing %s", local)
+	hash, err := s.Hasher(local)
+	if err != nil {
+		return "", err
+	}
+
+	src.Hash = hash
+	s.Cache.Update(p, src, info)
+
+	return hash, nil
+}
@@ -0,0 +1,296 @@
+package s3backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createTestTree(t *testing.T, files map[string]string) string {
+	root, err := ioutil.TempDir("", "s3backup-scan")
+	require.NoError(t, err)
+
+	for p, contents := range files {
+		full := filepath.Join(root, filepath.FromSlash(p))
+		require.NoError(t, os.MkdirAll(filepath.Dir(full), 0755))
+		require.NoError(t, ioutil.WriteFile(full, []byte(contents), 0644))
+	}
+
+	return root
+}
+
+func TestScanner_Scan(t *testing.T) {
+	root := createTestTree(t, map[string]string{
+		"a":       "file a",
+		"dir/b":   "file b",
+		"dir/c/d": "file d",
+	})
+	defer os.RemoveAll(root)
+
+	s := &Scanner{Walker: FilePathWalker, Hasher: FileHasher, Workers: 2}
+	index, err := s.Scan("root", root)
+
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(index.Files))
+
+	src := index.Files["dir/c/d"]
+	assert.Equal(t, hashOf("file d"), src.Hash)
+	assert.Equal(t, int64(6), src.Size)
+	assert.Equal(t, "root/dir/c/d", src.Key)
+	assert.Equal(t, filepath.Join(root, "dir", "c", "d"), src.Path)
+	assert.Equal(t, IndexVersion, index.Version)
+}
+
+func TestScanner_RelativeToRoot(t *testing.T) {
+	root := createTestTree(t, map[string]string{
+		"photos/a.jpg": "file a",
+	})
+	defer os.RemoveAll(root)
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	relative, err := filepath.Rel(wd, filepath.Join(root, "photos"))
+	require.NoError(t, err)
+
+	s := &Scanner{Walker: FilePathWalker, Hasher: FileHasher, Workers: 1}
+	for _, dir := range []string{
+		filepath.Join(root, "photos"),
+		filepath.Join(root, "photos") + string(filepath.Separator),
+		filepath.Join(root, "photos", "..", "photos"),
+		relative,
+	} {
+		index, err := s.Scan("backup", dir)
+		require.NoError(t, err, dir)
+
+		assert.Equal(t, []string{"a.jpg"}, paths(index), dir)
+		assert.Equal(t, "backup/a.jpg", index.Files["a.jpg"].Key, dir)
+		assert.Equal(t, hashOf("file a"), index.Files["a.jpg"].Hash, dir)
+	}
+}
+
+func paths(index *Index) []string {
+	result := []string{}
+	for p := range index.Files {
+		result = append(result, p)
+	}
+	sort.Strings(result)
+
+	return result
+}
+
+func TestScanner_HashError(t *testing.T) {
+	root := createTestTree(t, map[string]string{
+		"a":     "file a",
+		"dir/b": "file b",
+	})
+	defer os.RemoveAll(root)
+
+	s := &Scanner{
+		Walker: FilePathWalker,
+		Hasher: func(p string) (string, error) {
+			if strings.HasSuffix(p, "b") {
+				return "", errors.New("oops")
+			}
+			return FileHasher(p)
+		},
+		Workers: 4,
+	}
+	index, err := s.Scan("", root)
+
+	assert.Error(t, err)
+	assert.Nil(t, index)
+}
+
+func TestScanner_Cancel(t *testing.T) {
+	files := map[string]string{}
+	for i := 0; i < 50; i++ {
+		files[fmt.Sprintf("file-%03d", i)] = "file"
+	}
+	root := createTestTree(t, files)
+	defer os.RemoveAll(root)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	hashed := int32(0)
+	s := &Scanner{
+		Walker: FilePathWalker,
+		Hasher: func(p string) (string, error) {
+			if atomic.AddInt32(&hashed, 1) == 5 {
+				cancel()
+			}
+			return FileHasher(p)
+		},
+		Workers: 1,
+	}
+	index, err := s.ScanContext(ctx, "", root)
+
+	assert.True(t, errors.Is(err, context.Canceled), "%v", err)
+	assert.Nil(t, index)
+	assert.True(t, atomic.LoadInt32(&hashed) < 10, "hashed %d files after cancelling", hashed)
+
+	index, err = s.ScanContext(ctx, "", root)
+	assert.True(t, errors.Is(err, context.Canceled), "%v", err)
+	assert.Nil(t, index)
+}
+
+func TestScanner_MissingRoot(t *testing.T) {
+	s := &Scanner{Walker: FilePathWalker, Hasher: FileHasher, Workers: 1}
+	index, err := s.Scan("", "does-not-exist")
+
+	assert.Error(t, err)
+	assert.Nil(t, index)
+}
+
+func TestHashReader(t *testing.T) {
+	hash, err := HashReader(strings.NewReader("file 1"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, hashOf("file 1"), hash)
+}
+
+func TestScanner_UsesCache(t *testing.T) {
+	root := createTestTree(t, map[string]string{
+		"a":     "file a",
+		"dir/b": "file b",
+	})
+	defer os.RemoveAll(root)
+
+	hashed := map[string]int{}
+	lock := sync.Mutex{}
+	cache, _ := NewCache("")
+	s := &Scanner{
+		Walker: FilePathWalker,
+		Hasher: func(p string) (string, error) {
+			lock.Lock()
+			hashed[p]++
+			lock.Unlock()
+			return FileHasher(p)
+		},
+		Workers: 2,
+		Cache:   cache,
+	}
+
+	_, err := s.Scan("", root)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(hashed))
+
+	b := filepath.Join(root, "dir", "b")
+	require.NoError(t, ioutil.WriteFile(b, []byte("changed b"), 0644))
+	require.NoError(t, os.Chtimes(b, time.Now(), time.Now().Add(time.Minute)))
+
+	index, err := s.Scan("", root)
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, hashed[filepath.Join(root, "a")])
+	assert.Equal(t, 2, hashed[b])
+	assert.Equal(t, hashOf("file a"), index.Files["a"].Hash)
+	assert.Equal(t, hashOf("changed b"), index.Files["dir/b"].Hash)
+	assert.Equal(t, hashOf("changed b"), cache.Files["dir/b"].Hash)
+
+	require.NoError(t, os.Remove(b))
+	_, err = s.Scan("", root)
+	require.NoError(t, err)
+	assert.NotContains(t, cache.Files, "dir/b")
+}
+
+func TestScanner_FileErrors(t *testing.T) {
+	root := createTestTree(t, map[string]string{
+		"a":     "file a",
+		"dir/b": "file b",
+		"dir/c": "file c",
+	})
+	defer os.RemoveAll(root)
+
+	hasher := func(p string) (string, error) {
+		switch filepath.Base(p) {
+		case "b":
+			return "", &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+		case "c":
+			return "", &os.PathError{Op: "open", Path: p, Err: os.ErrPermission}
+		}
+		return FileHasher(p)
+	}
+
+	skipped := &SkipLog{}
+	s := &Scanner{
+		Walker:     FilePathWalker,
+		Hasher:     hasher,
+		Workers:    2,
+		FileErrors: FileErrorConfig{Missing: PolicyWarn, PermissionDenied: PolicySkip},
+		Skipped:    skipped,
+	}
+	index, err := s.Scan("", root)
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, paths(index))
+	files := skipped.Files()
+	require.Equal(t, 1, len(files))
+	assert.Equal(t, filepath.Join(root, "dir", "b"), files[0].Path)
+	assert.Equal(t, "dir/b", files[0].IndexPath)
+	assert.True(t, errors.Is(files[0].Err, os.ErrNotExist))
+	assert.Equal(t, []string{"dir/b", "dir/c"}, skipped.IndexPaths())
+
+	s.FileErrors.PermissionDenied = PolicyFail
+	_, err = s.Scan("", root)
+	assert.True(t, errors.Is(err, os.ErrPermission))
+}
+
+func TestSkipLog_Merge(t *testing.T) {
+	source := &SkipLog{}
+	source.Add("/src/dir/a", "dir/a", os.ErrNotExist, true)
+	source.Add("/src/b", "b", os.ErrPermission, false)
+
+	skipped := &SkipLog{}
+	skipped.Merge(source, "to")
+
+	assert.Equal(t, []string{"to/b", "to/dir/a"}, skipped.IndexPaths())
+	require.Equal(t, 1, len(skipped.Files()))
+	assert.Equal(t, "/src/dir/a", skipped.Files()[0].Path)
+
+	var none *SkipLog
+	none.Merge(source, "to")
+	assert.Empty(t, none.IndexPaths())
+}
+
+func TestScanner_UnreadableDirectory(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permissions don't apply to root")
+	}
+
+	root := createTestTree(t, map[string]string{
+		"a":          "file a",
+		"secret/b":   "file b",
+		"secret/c/d": "file d",
+	})
+	defer os.RemoveAll(root)
+	require.NoError(t, os.Chmod(filepath.Join(root, "secret"), 0))
+	defer os.Chmod(filepath.Join(root, "secret"), 0755)
+
+	skipped := &SkipLog{}
+	s := &Scanner{
+		Walker:     FilePathWalker,
+		Hasher:     FileHasher,
+		Workers:    1,
+		FileErrors: FileErrorConfig{PermissionDenied: PolicyWarn},
+		Skipped:    skipped,
+	}
+	index, err := s.Scan("", root)
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, paths(index))
+	assert.Equal(t, []string{"secret"}, skipped.IndexPaths())
+
+	_, err = (&Scanner{Walker: FilePathWalker, Hasher: FileHasher, Workers: 1}).Scan("", root)
+	assert.True(t, errors.Is(err, os.ErrPermission))
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"io"
+	"sync"
+)
+
+// FetchFunc reads 'length' bytes of an object starting at 'offset'
+type FetchFunc func(offset, length int64) ([]byte, error)
+
+type part struct {
+	data []byte
+	err  error
+}
+
+// ParallelReader reads a large object by fetching several parts of it at the
+// same time, returning them in order. Only a few parts are held in memory at
+// once, no matter how large the object is.
+type ParallelReader struct {
+	parts   chan chan part
+	current []byte
+	err     error
+
+	// slots holds a value for every part that is being fetched or waiting
+	// to be read, so that there are never more than the concurrency
+	slots chan struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewParallelReader creates a ParallelReader for an object of 'size' bytes
+// where the 'first' bytes have already been read. The rest is fetched in
+// parts of 'partSize' bytes. No more than 'concurrency' parts are fetched or
+// held waiting to be read at once.
+func NewParallelReader(first []byte, size, partSize int64, concurrency int, fetch FetchFunc) *ParallelReader {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	r := &ParallelReader{
+		parts:   make(chan chan part, concurrency),
+		current: first,
+		slots:   make(chan struct{}, concurrency),
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(r.parts)
+		for offset := int64(len(first)); offset < size; offset += partSize {
+			length := partSize
+			if offset+length > size {
+				length = size - offset
+			}
+
+			select {
+			case r.slots <- struct{}{}:
+			case <-r.done:
+				return
+			}
+
+			result := make(chan part, 1)
+			go func(offset, length int64) {
+				data, err := fetch(offset, length)
+				result <- part{data: data, err: err}
+			}(offset, length)
+
+			r.parts <- result
+		}
+	}()
+
+	return r
+}
+
+// Read reads the next bytes of the object, waiting for the part that holds
+// them to be fetched
+func (r *ParallelReader) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		result, ok := <-r.parts
+		if !ok {
+			return 0, io.EOF
+		}
+
+		next := <-result
+		<-r.slots
+		if next.err != nil {
+			r.err = next.err
+			return 0, r.err
+		}
+		r.current = next.data
+	}
+
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+// Close stops any more parts from being fetched
+func (r *ParallelReader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+
+	return nil
+}
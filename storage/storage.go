@@ -0,0 +1,75 @@
+// Package storage holds the types that are shared by all of the places that
+// files can be backed up to.
+package storage
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// ErrConflict is returned by a conditional save when the object has been
+// changed since it was read
+var ErrConflict = errors.New("object has been changed by someone else")
+
+// TemporaryError is a failure of a store that may not happen again if the
+// same request is made a little later, such as a server error or a timeout
+type TemporaryError struct {
+	Err error
+}
+
+func (e *TemporaryError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error from the store
+func (e *TemporaryError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary is always true, so that TemporaryError can be found in the same
+// way as network errors
+func (e *TemporaryError) Temporary() bool {
+	return true
+}
+
+// Temporary returns true if the error is one that is worth trying again.
+// Missing objects and conflicts never are, otherwise the first error in the
+// chain that says whether it is temporary or a timeout decides.
+func Temporary(err error) bool {
+	if err == nil || errors.Is(err, os.ErrNotExist) || errors.Is(err, ErrConflict) {
+		return false
+	}
+
+	var t interface{ Temporary() bool }
+	if errors.As(err, &t) {
+		if t.Temporary() {
+			return true
+		}
+		timeout, ok := t.(interface{ Timeout() bool })
+		return ok && timeout.Timeout()
+	}
+
+	var timeout interface{ Timeout() bool }
+	if errors.As(err, &timeout) {
+		return timeout.Timeout()
+	}
+
+	return false
+}
+
+// ObjectInfo describes an object in a store without its contents
+type ObjectInfo struct {
+	// Key is the location of the object in the store
+	Key string
+	// Size is the size of the object in bytes
+	Size int64
+	// ETag identifies this version of the object, it changes whenever the
+	// object is saved with different contents
+	ETag string
+	// LastModified is when the object was last saved
+	LastModified time.Time
+	// Metadata is the user metadata that was saved with the object. It is
+	// only filled in by Head, and is empty for stores that can't save any.
+	Metadata map[string]string
+}
@@ -0,0 +1,181 @@
+package s3backup
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// ErrCorrupted is wrapped by the errors from objects that were read from the
+// store but can't be decoded, such as data that can't be decrypted or
+// decompressed
+var ErrCorrupted = errors.New("object is corrupted")
+
+// VerifyReport describes the problems found when checking the objects in a
+// store against an index
+type VerifyReport struct {
+	// Checked is the number of objects that were checked
+	Checked int
+	// Missing are the keys of objects that do not exist in the store
+	Missing []string
+	// Corrupted are the keys of objects that were read back but could not be
+	// decoded
+	Corrupted []string
+	// Unreadable are the keys of objects that could not be read from the
+	// store, such as when it can't be reached, so whether they are intact
+	// isn't known
+	Unreadable []string
+	// Mismatched are the keys of objects whose contents do not match the hash
+	// in the index
+	Mismatched []string
+}
+
+// OK is true if no problems were found
+func (r *VerifyReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Corrupted) == 0 && len(r.Unreadable) == 0 && len(r.Mismatched) == 0
+}
+
+func (r *VerifyReport) sort() {
+	sort.Strings(r.Missing)
+	sort.Strings(r.Corrupted)
+	sort.Strings(r.Unreadable)
+	sort.Strings(r.Mismatched)
+}
+
+// VerifyIndex downloads every object in the index from the repository and
+// checks that its contents have the same hash as recorded in the index. Objects
+// that are shared by more than one file are only checked once.
+func VerifyIndex(index *Index, repo FileRepository, parallelLimit int) *VerifyReport {
+	report := &VerifyReport{}
+	lock := sync.Mutex{}
+	routineGroup := new(errgroup.Group)
+	limiter := make(chan struct{}, parallelLimit)
+
+	objects := map[string]Sourcefile{}
+	for _, src := range index.Files {
+		objects[src.Key] = src
+	}
+
+	for _, src := range objects {
+		src := src // https://golang.org/doc/faq#closures_and_goroutines
+
+		limiter <- struct{}{}
+		routineGroup.Go(func() error {
+			defer func() {
+				<-limiter
+			}()
+
+			doLog("Verifying %s\n", src.Key)
+			hash, err := hashObject(repo, src)
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			report.Checked++
+			switch {
+			case errors.Is(err, os.ErrNotExist):
+				report.Missing = append(report.Missing, src.Key)
+			case errors.Is(err, ErrCorrupted):
+				doLog("Unable to decode %s: %v\n", src.Key, err)
+				report.Corrupted = append(report.Corrupted, src.Key)
+			case err != nil:
+				doLog("Unable to read %s: %v\n", src.Key, err)
+				report.Unreadable = append(report.Unreadable, src.Key)
+			case hash != src.Hash:
+				report.Mismatched = append(report.Mismatched, src.Key)
+			}
+
+			return nil
+		})
+	}
+
+	_ = routineGroup.Wait()
+	report.sort()
+
+	return report
+}
+
+func hashObject(repo FileRepository, src Sourcefile) (string, error) {
+	r, err := openObject(repo, src)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	return HashReader(r)
+}
+
+// corruptError is an error from decoding an object, rather than from reading
+// it
+type corruptError struct {
+	err error
+}
+
+func (e *corruptError) Error() string {
+	return e.err.Error()
+}
+
+func (e *corruptError) Unwrap() error {
+	return e.err
+}
+
+func (e *corruptError) Is(target error) bool {
+	return target == ErrCorrupted
+}
+
+// sourceReader remembers the first error from reading an object, so that
+// errors from decoding it can be told apart from errors reading it. Decoders
+// may read from it in another goroutine.
+type sourceReader struct {
+	r    io.Reader
+	lock sync.Mutex
+	err  error
+}
+
+func (s *sourceReader) Read(b []byte) (int, error) {
+	n, err := s.r.Read(b)
+	if err != nil && err != io.EOF {
+		s.lock.Lock()
+		if s.err == nil {
+			s.err = err
+		}
+		s.lock.Unlock()
+	}
+
+	return n, err
+}
+
+// decodeError marks 'err' from decoding what was read through the
+// sourceReader as ErrCorrupted, unless it was reading that failed
+func (s *sourceReader) decodeError(err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.err != nil {
+		return err
+	}
+
+	return &corruptError{err: err}
+}
+
+// decodedReader reads what has been decoded from a sourceReader, marking the
+// errors from decoding as ErrCorrupted
+type decodedReader struct {
+	r   io.Reader
+	src *sourceReader
+}
+
+func (d *decodedReader) Read(b []byte) (int, error) {
+	n, err := d.r.Read(b)
+	return n, d.src.decodeError(err)
+}
@@ -0,0 +1,126 @@
+package s3backup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type brokenReaderStore struct {
+	*mockStore
+	broken string
+}
+
+func (b *brokenReaderStore) GetByKey(key string) (io.ReadCloser, error) {
+	if key == b.broken {
+		return ioutil.NopCloser(errReader{}), nil
+	}
+
+	return b.mockStore.GetByKey(key)
+}
+
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestVerifyIndex(t *testing.T) {
+	mock := &mockStore{
+		Keys:      []string{"a", "b", "c"},
+		Values:    []string{"file 1", "file 2", "file 3"},
+		FailAfter: 99,
+	}
+	index := &Index{
+		Files: map[string]Sourcefile{
+			"1": Sourcefile{Key: "a", Hash: hashOf("file 1")},
+			"2": Sourcefile{Key: "b", Hash: hashOf("file 2")},
+			"3": Sourcefile{Key: "c", Hash: hashOf("file 3")},
+		},
+	}
+
+	report := VerifyIndex(index, mock, 2)
+
+	assert.True(t, report.OK())
+	assert.Equal(t, 3, report.Checked)
+}
+
+func TestVerifyIndex_FindsProblems(t *testing.T) {
+	mock := &brokenReaderStore{
+		mockStore: &mockStore{
+			Keys:      []string{"a", "b", "c", "f"},
+			Values:    []string{"file 1", "changed", "file 3", "not gzipped"},
+			FailAfter: 99,
+		},
+		broken: "c",
+	}
+	index := &Index{
+		Files: map[string]Sourcefile{
+			"1": Sourcefile{Key: "a", Hash: hashOf("file 1")},
+			"2": Sourcefile{Key: "b", Hash: hashOf("file 2")},
+			"3": Sourcefile{Key: "c", Hash: hashOf("file 3")},
+			"4": Sourcefile{Key: "d", Hash: hashOf("file 4")},
+			"5": Sourcefile{Key: "e", Hash: hashOf("file 5")},
+			"6": Sourcefile{Key: "f", Hash: hashOf("file 6"), Codec: CodecGzip},
+		},
+	}
+
+	report := VerifyIndex(index, mock, 2)
+
+	assert.False(t, report.OK())
+	assert.Equal(t, 6, report.Checked)
+	assert.Equal(t, []string{"d", "e"}, report.Missing)
+	assert.Equal(t, []string{"f"}, report.Corrupted)
+	assert.Equal(t, []string{"c"}, report.Unreadable)
+	assert.Equal(t, []string{"b"}, report.Mismatched)
+}
+
+func TestVerifyIndex_Encrypted(t *testing.T) {
+	mock := &brokenReaderStore{mockStore: &mockStore{FailAfter: 99}, broken: "c"}
+	store := &EncryptedStore{ObjectStore: mock, Encryption: testEncryption(t)}
+	require.NoError(t, store.Save("a", bytes.NewBufferString("file 1")))
+	require.NoError(t, store.Save("b", bytes.NewBufferString("file 2")))
+	require.NoError(t, store.Save("c", bytes.NewBufferString("file 3")))
+
+	tampered := []byte(mock.Values[1])
+	tampered[len(tampered)-1] ^= 1
+	mock.Values[1] = string(tampered)
+
+	index := &Index{
+		Files: map[string]Sourcefile{
+			"1": Sourcefile{Key: "a", Hash: hashOf("file 1")},
+			"2": Sourcefile{Key: "b", Hash: hashOf("file 2")},
+			"3": Sourcefile{Key: "c", Hash: hashOf("file 3")},
+		},
+	}
+
+	report := VerifyIndex(index, store, 2)
+
+	assert.Equal(t, []string{"b"}, report.Corrupted)
+	assert.Equal(t, []string{"c"}, report.Unreadable)
+	assert.Empty(t, report.Mismatched)
+}
+
+func TestVerifyIndex_SharedObjects(t *testing.T) {
+	mock := &mockStore{
+		Keys:      []string{"a"},
+		Values:    []string{"file 1"},
+		FailAfter: 99,
+	}
+	index := &Index{
+		Files: map[string]Sourcefile{
+			"1": Sourcefile{Key: "a", Hash: hashOf("file 1")},
+			"2": Sourcefile{Key: "a", Hash: hashOf("file 1")},
+		},
+	}
+
+	report := VerifyIndex(index, mock, 2)
+
+	assert.True(t, report.OK())
+	assert.Equal(t, 1, report.Checked)
+}